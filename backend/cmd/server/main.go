@@ -4,6 +4,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strings"
 
 	"secure-document-transfer/internal/config"
 	"secure-document-transfer/internal/database"
@@ -42,6 +43,12 @@ func main() {
 		log.Println("Please ensure the 'encrypted-files' bucket exists in Supabase Storage")
 	}
 
+	// Start deleting expired transfers in the background
+	startExpiryReaper(config.ExpiryReaperInterval())
+
+	// Start deleting abandoned incomplete uploads in the background
+	startUploadSweeper(config.UploadSweeperInterval(), config.AbandonedUploadTTL(), config.UploadSweeperDryRun())
+
 	// Create router
 	router := mux.NewRouter()
 
@@ -61,7 +68,39 @@ func main() {
 	api.HandleFunc("/users/search", middleware.AuthMiddleware(handlers.SearchUsersHandler())).Methods("GET")
 	api.HandleFunc("/users/public-key", middleware.AuthMiddleware(handlers.GetUserPublicKeyHandler())).Methods("GET")
 	api.HandleFunc("/users/public-keys", middleware.AuthMiddleware(handlers.GetPublicKeysByEmailsHandler())).Methods("POST")
+	api.HandleFunc("/usage", middleware.AuthMiddleware(handlers.GetUsageHandler())).Methods("GET")
+	api.HandleFunc("/transfers", middleware.AuthMiddleware(handlers.CreateTransferHandler())).Methods("POST")
+	api.HandleFunc("/transfers", middleware.AuthMiddleware(handlers.GetTransfersHandler())).Methods("GET")
+	api.HandleFunc("/transfers/{transfer_id}", middleware.AuthMiddleware(handlers.GetTransferHandler())).Methods("GET")
+	api.HandleFunc("/transfers/{transfer_id}/manifest", middleware.AuthMiddleware(handlers.GetTransferManifestHandler())).Methods("GET")
+	api.HandleFunc("/transfers/{transfer_id}/recipients", middleware.AuthMiddleware(handlers.AddTransferRecipientsHandler())).Methods("POST")
+	api.HandleFunc("/transfers/{transfer_id}/recipients/{email}", middleware.AuthMiddleware(handlers.RemoveTransferRecipientHandler())).Methods("DELETE")
+	api.HandleFunc("/transfers/{transfer_id}/forward", middleware.AuthMiddleware(handlers.ForwardTransferHandler())).Methods("POST")
+	api.HandleFunc("/transfers/{transfer_id}/messages", middleware.AuthMiddleware(handlers.PostTransferMessageHandler())).Methods("POST")
+	api.HandleFunc("/transfers/{transfer_id}/messages", middleware.AuthMiddleware(handlers.GetTransferMessagesHandler())).Methods("GET")
+	api.HandleFunc("/files", middleware.AuthMiddleware(handlers.CreateFileHandler())).Methods("POST")
 	api.HandleFunc("/files/send-chunk", middleware.AuthMiddleware(handlers.SendFileChunkHandler())).Methods("POST")
+	api.HandleFunc("/files/inbox", middleware.AuthMiddleware(handlers.GetInboxHandler())).Methods("GET")
+	api.HandleFunc("/files/sent", middleware.AuthMiddleware(handlers.GetSentFilesHandler())).Methods("GET")
+	api.HandleFunc("/files/{file_id}/chunks/batch", middleware.AuthMiddleware(handlers.UploadChunkBatchHandler())).Methods("POST")
+	api.HandleFunc("/files/{file_id}/upload-status", middleware.AuthMiddleware(handlers.UploadStatusHandler())).Methods("GET")
+	api.HandleFunc("/files/{file_id}/finalize", middleware.AuthMiddleware(handlers.FinalizeFileHandler())).Methods("POST")
+	api.HandleFunc("/files/{file_id}/manifest", middleware.AuthMiddleware(handlers.GetFileManifestHandler())).Methods("GET")
+	api.HandleFunc("/files/{file_id}/chunks/{index}", middleware.AuthMiddleware(handlers.DownloadChunkHandler())).Methods("GET")
+	api.HandleFunc("/files/{file_id}/recipients", middleware.AuthMiddleware(handlers.AddRecipientsHandler())).Methods("POST")
+	api.HandleFunc("/files/{file_id}/recipients/{email}", middleware.AuthMiddleware(handlers.RemoveRecipientHandler())).Methods("DELETE")
+	api.HandleFunc("/files/{file_id}/forward-policy", middleware.AuthMiddleware(handlers.UpdateForwardPolicyHandler())).Methods("PUT")
+	api.HandleFunc("/files/{file_id}/forward", middleware.AuthMiddleware(handlers.ForwardFileHandler())).Methods("POST")
+	api.HandleFunc("/files/{file_id}/messages", middleware.AuthMiddleware(handlers.PostMessageHandler())).Methods("POST")
+	api.HandleFunc("/files/{file_id}/messages", middleware.AuthMiddleware(handlers.GetMessagesHandler())).Methods("GET")
+	api.HandleFunc("/files/{file_id}/acknowledge", middleware.AuthMiddleware(handlers.AcknowledgeDownloadHandler())).Methods("POST")
+	api.HandleFunc("/files/{file_id}", middleware.AuthMiddleware(handlers.RevokeFileHandler())).Methods("DELETE")
+
+	// tus 1.0 resumable uploads, one encrypted chunk per upload (OPTIONS is answered by enableCORS)
+	api.HandleFunc("/tus", middleware.AuthMiddleware(handlers.CreateTusUploadHandler())).Methods("POST")
+	api.HandleFunc("/tus/{upload_id}", middleware.AuthMiddleware(handlers.GetTusUploadOffsetHandler())).Methods("HEAD")
+	api.HandleFunc("/tus/{upload_id}", middleware.AuthMiddleware(handlers.PatchTusUploadHandler())).Methods("PATCH")
+	api.HandleFunc("/tus/{upload_id}", middleware.AuthMiddleware(handlers.TerminateTusUploadHandler())).Methods("DELETE")
 
 	// Get port from environment or use default
 	port := os.Getenv("PORT")
@@ -80,10 +119,15 @@ func main() {
 func enableCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Idempotency-Key, Tus-Resumable, Upload-Length, Upload-Metadata, Upload-Offset")
+		w.Header().Set("Access-Control-Expose-Headers", "Location, Upload-Offset, Upload-Length, Tus-Resumable, Tus-Version, Tus-Extension, Tus-Max-Size")
 
 		if r.Method == "OPTIONS" {
+			// tus clients discover the server's capabilities with OPTIONS
+			if strings.HasPrefix(r.URL.Path, "/api/tus") {
+				handlers.SetTusCapabilities(w)
+			}
 			w.WriteHeader(http.StatusOK)
 			return
 		}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"secure-document-transfer/internal/database"
+	"secure-document-transfer/internal/storage"
+)
+
+// reaperBatchSize is the maximum number of expired files handled in one reaper run
+const reaperBatchSize = 100
+
+// startExpiryReaper runs reapExpiredFiles in the background every interval
+func startExpiryReaper(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			reapExpiredFiles()
+			<-ticker.C
+		}
+	}()
+}
+
+// reapExpiredFiles deletes the stored chunks of expired files and marks the files expired
+// Failures are logged and the file is retried on the next run
+func reapExpiredFiles() {
+	fileIDs, err := database.ListExpiredFiles(reaperBatchSize)
+	if err != nil {
+		log.Printf("Expiry reaper: failed to list expired files: %v", err)
+		return
+	}
+
+	reaped := 0
+	for _, fileID := range fileIDs {
+		if err := storage.DeleteFile(fileID); err != nil {
+			log.Printf("Expiry reaper: failed to delete chunks of file %s: %v", fileID, err)
+			continue
+		}
+
+		if err := database.MarkFileExpired(fileID); err != nil {
+			log.Printf("Expiry reaper: failed to mark file %s as expired: %v", fileID, err)
+			continue
+		}
+
+		reaped++
+	}
+
+	if reaped > 0 {
+		log.Printf("Expiry reaper: expired %d file(s)", reaped)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"secure-document-transfer/internal/database"
+	"secure-document-transfer/internal/storage"
+)
+
+// sweeperBatchSize is the maximum number of abandoned uploads handled in one sweeper run
+const sweeperBatchSize = 100
+
+// startUploadSweeper runs sweepAbandonedUploads in the background every interval
+func startUploadSweeper(interval, ttl time.Duration, dryRun bool) {
+	if dryRun {
+		log.Printf("Upload sweeper: dry run, abandoned uploads will be reported but not deleted")
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			sweepAbandonedUploads(ttl, dryRun)
+			<-ticker.C
+		}
+	}()
+}
+
+// sweepAbandonedUploads deletes the storage objects and rows of incomplete transfers that have seen
+// no upload activity for ttl. In dry-run mode it only logs what would be deleted
+// Failures are logged and the transfer is retried on the next run
+func sweepAbandonedUploads(ttl time.Duration, dryRun bool) {
+	cutoff := time.Now().Add(-ttl)
+
+	uploads, err := database.ListAbandonedUploads(cutoff, sweeperBatchSize)
+	if err != nil {
+		log.Printf("Upload sweeper: failed to list abandoned uploads: %v", err)
+		return
+	}
+
+	var files, chunks int
+	var bytes int64
+	for _, upload := range uploads {
+		if !dryRun {
+			deleted, err := database.DeleteAbandonedUpload(upload.FileID, cutoff, func() error {
+				return storage.DeleteFile(upload.FileID)
+			})
+			if err != nil {
+				log.Printf("Upload sweeper: failed to delete abandoned upload %s: %v", upload.FileID, err)
+				continue
+			}
+			if !deleted {
+				continue
+			}
+		}
+
+		log.Printf("Upload sweeper: %s abandoned upload %s (%q from sender %s, created %s, last activity %s, %d chunk(s), %d bytes)",
+			sweepVerb(dryRun), upload.FileID, upload.OriginalFilename, upload.SenderID,
+			upload.CreatedAt.Format(time.RFC3339), upload.LastActivityAt.Format(time.RFC3339),
+			upload.ChunksStored, upload.BytesStored)
+
+		files++
+		chunks += upload.ChunksStored
+		bytes += upload.BytesStored
+	}
+
+	if files > 0 {
+		log.Printf("Upload sweeper: %s %d abandoned upload(s), %d chunk(s), %d bytes", sweepVerb(dryRun), files, chunks, bytes)
+	}
+}
+
+// sweepVerb describes what the sweeper does with an abandoned upload in its log lines
+func sweepVerb(dryRun bool) string {
+	if dryRun {
+		return "would delete"
+	}
+	return "deleted"
+}
@@ -0,0 +1,58 @@
+package config
+
+import (
+	"log"
+	"os"
+	"strconv"
+)
+
+const (
+	// defaultStorageQuotaBytes is used when STORAGE_QUOTA_BYTES is not set (5 GiB)
+	defaultStorageQuotaBytes = 5 << 30
+	// defaultActiveTransferQuota is used when ACTIVE_TRANSFER_QUOTA is not set
+	defaultActiveTransferQuota = 100
+	// defaultMaxChunkUploadBytes is used when CHUNK_UPLOAD_MAX_BYTES is not set (8 MiB)
+	defaultMaxChunkUploadBytes = 8 << 20
+	// defaultMaxBatchUploadBytes is used when BATCH_UPLOAD_MAX_BYTES is not set (64 MiB)
+	defaultMaxBatchUploadBytes = 64 << 20
+)
+
+// DefaultStorageQuotaBytes returns how many bytes of ciphertext a user may have stored
+// Individual users can be given a different limit in the user_quotas table
+func DefaultStorageQuotaBytes() int64 {
+	return int64FromEnv("STORAGE_QUOTA_BYTES", defaultStorageQuotaBytes)
+}
+
+// DefaultActiveTransferQuota returns how many unexpired transfers a user may have at once
+// Individual users can be given a different limit in the user_quotas table
+func DefaultActiveTransferQuota() int64 {
+	return int64FromEnv("ACTIVE_TRANSFER_QUOTA", defaultActiveTransferQuota)
+}
+
+// MaxChunkUploadBytes returns the largest request body accepted by a single chunk upload
+// It must leave room for the multipart fields on top of the largest chunk clients send
+func MaxChunkUploadBytes() int64 {
+	return int64FromEnv("CHUNK_UPLOAD_MAX_BYTES", defaultMaxChunkUploadBytes)
+}
+
+// MaxBatchUploadBytes returns the largest request body accepted by a batch chunk upload
+func MaxBatchUploadBytes() int64 {
+	return int64FromEnv("BATCH_UPLOAD_MAX_BYTES", defaultMaxBatchUploadBytes)
+}
+
+// int64FromEnv reads a positive integer from the environment
+// Missing, invalid or non-positive values fall back to the given default
+func int64FromEnv(name string, fallback int64) int64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	number, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || number <= 0 {
+		log.Printf("Warning: invalid %s %q, using default %d", name, value, fallback)
+		return fallback
+	}
+
+	return number
+}
@@ -0,0 +1,86 @@
+package config
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	// defaultTransferExpiry is used when TRANSFER_DEFAULT_EXPIRY is not set
+	defaultTransferExpiry = 7 * 24 * time.Hour
+	// defaultMaxTransferExpiry is used when TRANSFER_MAX_EXPIRY is not set
+	defaultMaxTransferExpiry = 30 * 24 * time.Hour
+	// defaultExpiryReaperInterval is used when EXPIRY_REAPER_INTERVAL is not set
+	defaultExpiryReaperInterval = 10 * time.Minute
+	// defaultAbandonedUploadTTL is used when ABANDONED_UPLOAD_TTL is not set
+	defaultAbandonedUploadTTL = 48 * time.Hour
+	// defaultUploadSweeperInterval is used when UPLOAD_SWEEPER_INTERVAL is not set
+	defaultUploadSweeperInterval = time.Hour
+)
+
+// DefaultTransferExpiry returns how long a transfer stays available when the sender does not choose an expiry
+func DefaultTransferExpiry() time.Duration {
+	return durationFromEnv("TRANSFER_DEFAULT_EXPIRY", defaultTransferExpiry)
+}
+
+// MaxTransferExpiry returns the longest expiry a sender may choose for a transfer
+func MaxTransferExpiry() time.Duration {
+	return durationFromEnv("TRANSFER_MAX_EXPIRY", defaultMaxTransferExpiry)
+}
+
+// ExpiryReaperInterval returns how often expired transfers are cleaned up
+func ExpiryReaperInterval() time.Duration {
+	return durationFromEnv("EXPIRY_REAPER_INTERVAL", defaultExpiryReaperInterval)
+}
+
+// AbandonedUploadTTL returns how long an incomplete transfer may go without upload activity
+// before the upload sweeper deletes it
+func AbandonedUploadTTL() time.Duration {
+	return durationFromEnv("ABANDONED_UPLOAD_TTL", defaultAbandonedUploadTTL)
+}
+
+// UploadSweeperInterval returns how often abandoned uploads are looked for
+func UploadSweeperInterval() time.Duration {
+	return durationFromEnv("UPLOAD_SWEEPER_INTERVAL", defaultUploadSweeperInterval)
+}
+
+// UploadSweeperDryRun reports whether the upload sweeper should only log what it would delete
+func UploadSweeperDryRun() bool {
+	return boolFromEnv("UPLOAD_SWEEPER_DRY_RUN", false)
+}
+
+// durationFromEnv reads a Go duration (e.g. "72h") from the environment
+// Missing, invalid or non-positive values fall back to the given default
+func durationFromEnv(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		log.Printf("Warning: invalid %s %q, using default %s", name, value, fallback)
+		return fallback
+	}
+
+	return duration
+}
+
+// boolFromEnv reads a boolean (e.g. "true", "1") from the environment
+// Missing or invalid values fall back to the given default
+func boolFromEnv(name string, fallback bool) bool {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Warning: invalid %s %q, using default %t", name, value, fallback)
+		return fallback
+	}
+
+	return parsed
+}
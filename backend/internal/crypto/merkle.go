@@ -0,0 +1,119 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/sha256"
+)
+
+// Domain separation prefixes for Merkle tree hashes (as in RFC 6962)
+// They keep a leaf hash from ever being mistaken for an interior node
+const (
+	merkleLeafPrefix = 0x00
+	merkleNodePrefix = 0x01
+)
+
+// MerkleTree is a binary hash tree over the ordered chunk hashes of a file
+// The tree has the RFC 6962 shape: a node without a sibling is promoted to the next level unchanged,
+// so the root commits to the number, order and content of the chunks
+type MerkleTree struct {
+	levels [][][]byte // levels[0] are the leaf hashes, the last level holds the root
+}
+
+// NewMerkleTree builds a Merkle tree over the given chunk hashes in chunk order
+func NewMerkleTree(chunkHashes [][]byte) *MerkleTree {
+	leaves := make([][]byte, len(chunkHashes))
+	for i, chunkHash := range chunkHashes {
+		leaves[i] = merkleLeafHash(chunkHash)
+	}
+
+	levels := [][][]byte{leaves}
+	for level := leaves; len(level) > 1; {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 < len(level) {
+				next = append(next, merkleNodeHash(level[i], level[i+1]))
+			} else {
+				next = append(next, level[i])
+			}
+		}
+		levels = append(levels, next)
+		level = next
+	}
+
+	return &MerkleTree{levels: levels}
+}
+
+// Root returns the Merkle root, or the hash of the empty string for a tree without chunks
+func (t *MerkleTree) Root() []byte {
+	top := t.levels[len(t.levels)-1]
+	if len(top) == 0 {
+		empty := sha256.Sum256(nil)
+		return empty[:]
+	}
+	return top[0]
+}
+
+// Proof returns the inclusion proof for the chunk at index: the sibling hashes from the leaf up to the root
+// Returns nil if index is out of range
+func (t *MerkleTree) Proof(index int) [][]byte {
+	if index < 0 || index >= len(t.levels[0]) {
+		return nil
+	}
+
+	proof := [][]byte{}
+	for _, level := range t.levels[:len(t.levels)-1] {
+		sibling := index ^ 1
+		if sibling < len(level) {
+			proof = append(proof, level[sibling])
+		}
+		index /= 2
+	}
+	return proof
+}
+
+// VerifyMerkleProof checks that chunkHash is the chunk at index of a file with size chunks and the given root
+func VerifyMerkleProof(root, chunkHash []byte, index, size int, proof [][]byte) bool {
+	if index < 0 || index >= size {
+		return false
+	}
+
+	hash := merkleLeafHash(chunkHash)
+	for size > 1 {
+		switch {
+		case index%2 == 1:
+			if len(proof) == 0 {
+				return false
+			}
+			hash = merkleNodeHash(proof[0], hash)
+			proof = proof[1:]
+		case index+1 < size:
+			if len(proof) == 0 {
+				return false
+			}
+			hash = merkleNodeHash(hash, proof[0])
+			proof = proof[1:]
+		}
+		// A node without a sibling is promoted unchanged
+		index /= 2
+		size = (size + 1) / 2
+	}
+
+	return len(proof) == 0 && bytes.Equal(hash, root)
+}
+
+// merkleLeafHash hashes a chunk hash into a leaf of the tree
+func merkleLeafHash(chunkHash []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{merkleLeafPrefix})
+	h.Write(chunkHash)
+	return h.Sum(nil)
+}
+
+// merkleNodeHash hashes two child hashes into their parent
+func merkleNodeHash(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{merkleNodePrefix})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
@@ -0,0 +1,88 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"testing"
+)
+
+// referenceMerkleRoot is the recursive RFC 6962 definition of the tree hash
+func referenceMerkleRoot(chunkHashes [][]byte) []byte {
+	if len(chunkHashes) == 1 {
+		return merkleLeafHash(chunkHashes[0])
+	}
+	k := 1
+	for k*2 < len(chunkHashes) {
+		k *= 2
+	}
+	return merkleNodeHash(referenceMerkleRoot(chunkHashes[:k]), referenceMerkleRoot(chunkHashes[k:]))
+}
+
+func testChunkHashes(n int) [][]byte {
+	hashes := make([][]byte, n)
+	for i := range hashes {
+		sum := sha256.Sum256([]byte(fmt.Sprintf("chunk %d", i)))
+		hashes[i] = sum[:]
+	}
+	return hashes
+}
+
+func TestMerkleRootMatchesRFC6962(t *testing.T) {
+	for n := 1; n <= 17; n++ {
+		hashes := testChunkHashes(n)
+		got := NewMerkleTree(hashes).Root()
+		want := referenceMerkleRoot(hashes)
+		if !bytes.Equal(got, want) {
+			t.Errorf("root of %d chunks = %x, want %x", n, got, want)
+		}
+	}
+}
+
+func TestMerkleProofsVerify(t *testing.T) {
+	for n := 1; n <= 17; n++ {
+		hashes := testChunkHashes(n)
+		tree := NewMerkleTree(hashes)
+		root := tree.Root()
+
+		for i := 0; i < n; i++ {
+			proof := tree.Proof(i)
+			if !VerifyMerkleProof(root, hashes[i], i, n, proof) {
+				t.Errorf("proof for chunk %d of %d did not verify", i, n)
+			}
+		}
+	}
+}
+
+func TestMerkleProofRejectsTampering(t *testing.T) {
+	hashes := testChunkHashes(6)
+	tree := NewMerkleTree(hashes)
+	root := tree.Root()
+
+	// Wrong chunk content
+	if VerifyMerkleProof(root, hashes[1], 2, 6, tree.Proof(2)) {
+		t.Error("proof verified for the wrong chunk hash")
+	}
+
+	// Chunk presented at another position
+	if VerifyMerkleProof(root, hashes[2], 3, 6, tree.Proof(2)) {
+		t.Error("proof verified at the wrong index")
+	}
+
+	// Wrong number of chunks
+	if VerifyMerkleProof(root, hashes[2], 2, 4, tree.Proof(2)) {
+		t.Error("proof verified for the wrong file size")
+	}
+
+	// Reordered chunks change the root
+	reordered := append([][]byte{hashes[1], hashes[0]}, hashes[2:]...)
+	if bytes.Equal(NewMerkleTree(reordered).Root(), root) {
+		t.Error("reordering chunks did not change the root")
+	}
+
+	// Duplicated chunk changes the root
+	duplicated := append(append([][]byte{}, hashes...), hashes[5])
+	if bytes.Equal(NewMerkleTree(duplicated).Root(), root) {
+		t.Error("duplicating a chunk did not change the root")
+	}
+}
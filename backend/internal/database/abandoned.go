@@ -0,0 +1,125 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// lastUploadActivity is the latest time anything was uploaded to file_metadata row fm
+const lastUploadActivity = `
+	GREATEST(
+		fm.created_at,
+		(SELECT MAX(fc.created_at) FROM public.file_chunks fc WHERE fc.file_id = fm.file_id),
+		(SELECT MAX(tu.updated_at) FROM public.tus_uploads tu WHERE tu.file_id = fm.file_id)
+	)
+`
+
+// AbandonedUpload describes an incomplete transfer that has seen no upload activity since a cutoff
+type AbandonedUpload struct {
+	FileID           string
+	SenderID         string
+	OriginalFilename string
+	CreatedAt        time.Time
+	LastActivityAt   time.Time
+	ChunksStored     int
+	BytesStored      int64
+}
+
+// ListAbandonedUploads returns incomplete transfers with no upload activity since cutoff, oldest first
+func ListAbandonedUploads(cutoff time.Time, limit int) ([]AbandonedUpload, error) {
+	query := `
+		SELECT
+			fm.file_id,
+			fm.sender_id,
+			fm.original_filename,
+			fm.created_at,
+			` + lastUploadActivity + ` AS last_activity_at,
+			(SELECT COUNT(*) FROM public.file_chunks fc WHERE fc.file_id = fm.file_id),
+			(SELECT COALESCE(SUM(fc.chunk_size), 0) FROM public.file_chunks fc WHERE fc.file_id = fm.file_id)
+		FROM public.file_metadata fm
+		WHERE fm.completed_at IS NULL AND fm.created_at < $1 AND ` + lastUploadActivity + ` < $1
+		ORDER BY fm.created_at
+		LIMIT $2
+	`
+
+	rows, err := DB.Query(query, cutoff, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve abandoned uploads: %w", err)
+	}
+	defer rows.Close()
+
+	var uploads []AbandonedUpload
+	for rows.Next() {
+		var upload AbandonedUpload
+		err := rows.Scan(
+			&upload.FileID,
+			&upload.SenderID,
+			&upload.OriginalFilename,
+			&upload.CreatedAt,
+			&upload.LastActivityAt,
+			&upload.ChunksStored,
+			&upload.BytesStored,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan abandoned upload: %w", err)
+		}
+		uploads = append(uploads, upload)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating abandoned uploads: %w", err)
+	}
+
+	return uploads, nil
+}
+
+// DeleteAbandonedUpload deletes an incomplete transfer that has still seen no upload activity since cutoff
+// deleteObjects is called to remove the transfer's storage objects while the row is locked, so no chunk
+// can be recorded in between; if it fails nothing is deleted. Returns false if the transfer was completed,
+// deleted or uploaded to since it was listed
+func DeleteAbandonedUpload(fileID string, cutoff time.Time, deleteObjects func() error) (bool, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Chunk inserts take a share lock on the file row, so this waits for uploads in flight
+	var locked string
+	err = tx.QueryRow(`SELECT file_id FROM public.file_metadata WHERE file_id = $1 FOR UPDATE`, fileID).Scan(&locked)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to lock file metadata: %w", err)
+	}
+
+	var abandoned bool
+	query := `
+		SELECT fm.completed_at IS NULL AND ` + lastUploadActivity + ` < $2
+		FROM public.file_metadata fm
+		WHERE fm.file_id = $1
+	`
+	if err := tx.QueryRow(query, fileID, cutoff).Scan(&abandoned); err != nil {
+		return false, fmt.Errorf("failed to check upload activity: %w", err)
+	}
+	if !abandoned {
+		return false, nil
+	}
+
+	if err := deleteObjects(); err != nil {
+		return false, err
+	}
+
+	// Chunks, recipients and tus uploads are removed by ON DELETE CASCADE
+	if _, err := tx.Exec(`DELETE FROM public.file_metadata WHERE file_id = $1`, fileID); err != nil {
+		return false, fmt.Errorf("failed to delete file metadata: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return true, nil
+}
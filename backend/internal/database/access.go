@@ -0,0 +1,108 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrFileNotFound is returned when no file exists with the requested file ID
+	ErrFileNotFound = errors.New("file not found")
+	// ErrFileAccessDenied is returned when the user is neither the sender nor a recipient of the file
+	ErrFileAccessDenied = errors.New("access to file denied")
+	// ErrFileRevoked is returned when the sender revoked a file the user used to have access to
+	ErrFileRevoked = errors.New("file revoked by sender")
+	// ErrRecipientRemoved is returned when the sender removed the user from the file's recipients
+	ErrRecipientRemoved = errors.New("recipient removed by sender")
+)
+
+// FileAccess describes the relationship between a user and a file they are allowed to access
+type FileAccess struct {
+	FileID           string
+	SenderID         string
+	TransferID       string // Empty when the file was sent on its own
+	IsSender         bool
+	IsRecipient      bool
+	RecipientRowID   string // file_recipients.id, empty when the user is not a recipient
+	EncryptedFileKey string // The user's wrapped file key, empty when the user is not a recipient
+	Completed        bool
+	Expired          bool // The expiry has passed, whether or not the reaper has deleted the chunks yet
+	ForwardPolicy    string
+	MaxDownloads     sql.NullInt64
+	DownloadCount    int
+}
+
+// DownloadLimitReached reports whether a recipient has used up all downloads allowed by the sender
+func (a *FileAccess) DownloadLimitReached() bool {
+	return a.IsRecipient && a.MaxDownloads.Valid && int64(a.DownloadCount) >= a.MaxDownloads.Int64
+}
+
+// GetFileAccess checks whether a user may access a file as its sender or as one of its recipients
+// Recipients are matched by user ID or case-insensitively by email
+func GetFileAccess(fileID, userID, userEmail string) (*FileAccess, error) {
+	query := `
+		SELECT
+			fm.sender_id::text,
+			fm.completed_at IS NOT NULL,
+			fm.expired_at IS NOT NULL OR fm.expires_at <= NOW(),
+			fm.forward_policy,
+			COALESCE(fm.transfer_id::text, ''),
+			fr.id::text,
+			fr.encrypted_file_key,
+			fr.max_downloads,
+			COALESCE(fr.download_count, 0)
+		FROM public.file_metadata fm
+		LEFT JOIN public.file_recipients fr
+			ON fr.file_id = fm.file_id
+			AND (fr.recipient_id = $2::uuid OR LOWER(fr.recipient_email) = LOWER($3))
+		WHERE fm.file_id = $1
+		ORDER BY (fr.recipient_id = $2::uuid) DESC NULLS LAST
+		LIMIT 1
+	`
+
+	access := FileAccess{FileID: fileID}
+	var recipientRowID, encryptedFileKey sql.NullString
+	err := DB.QueryRow(query, fileID, userID, userEmail).Scan(
+		&access.SenderID,
+		&access.Completed,
+		&access.Expired,
+		&access.ForwardPolicy,
+		&access.TransferID,
+		&recipientRowID,
+		&encryptedFileKey,
+		&access.MaxDownloads,
+		&access.DownloadCount,
+	)
+	if err == sql.ErrNoRows {
+		revoked, err := isRevokedForUser(fileID, userID, userEmail)
+		if err != nil {
+			return nil, err
+		}
+		if revoked {
+			return nil, ErrFileRevoked
+		}
+		return nil, ErrFileNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to check file access: %w", err)
+	}
+
+	access.IsSender = access.SenderID == userID
+	access.IsRecipient = recipientRowID.Valid
+	access.RecipientRowID = recipientRowID.String
+	access.EncryptedFileKey = encryptedFileKey.String
+
+	if !access.IsSender && !access.IsRecipient {
+		removed, err := isRemovedRecipient(fileID, userID, userEmail)
+		if err != nil {
+			return nil, err
+		}
+		if removed {
+			return nil, ErrRecipientRemoved
+		}
+		return nil, ErrFileAccessDenied
+	}
+
+	return &access, nil
+}
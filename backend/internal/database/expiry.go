@@ -0,0 +1,76 @@
+package database
+
+import (
+	"fmt"
+)
+
+// ListExpiredFiles returns the IDs of files whose expiry has passed but whose chunks have not been reaped yet
+func ListExpiredFiles(limit int) ([]string, error) {
+	query := `
+		SELECT file_id
+		FROM public.file_metadata
+		WHERE expired_at IS NULL AND expires_at <= NOW()
+		ORDER BY expires_at
+		LIMIT $1
+	`
+
+	rows, err := DB.Query(query, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve expired files: %w", err)
+	}
+	defer rows.Close()
+
+	var fileIDs []string
+	for rows.Next() {
+		var fileID string
+		if err := rows.Scan(&fileID); err != nil {
+			return nil, fmt.Errorf("failed to scan expired file: %w", err)
+		}
+		fileIDs = append(fileIDs, fileID)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating expired files: %w", err)
+	}
+
+	return fileIDs, nil
+}
+
+// MarkFileExpired removes the chunk records, download progress and tus uploads of a file whose storage objects
+// (chunks and tus segments alike) were deleted, and marks it expired
+// The metadata and recipient rows are kept so senders and recipients can still see the transfer
+func MarkFileExpired(fileID string) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Marking the file first waits for uploads holding the file row, so the deletes below see what they wrote
+	_, err = tx.Exec(`UPDATE public.file_metadata SET expired_at = NOW() WHERE file_id = $1 AND expired_at IS NULL`, fileID)
+	if err != nil {
+		return fmt.Errorf("failed to mark file as expired: %w", err)
+	}
+
+	if _, err := tx.Exec(`DELETE FROM public.file_chunks WHERE file_id = $1`, fileID); err != nil {
+		return fmt.Errorf("failed to delete chunk records: %w", err)
+	}
+
+	_, err = tx.Exec(`
+		DELETE FROM public.file_chunk_downloads
+		WHERE file_recipient_id IN (SELECT id FROM public.file_recipients WHERE file_id = $1)
+	`, fileID)
+	if err != nil {
+		return fmt.Errorf("failed to delete download progress: %w", err)
+	}
+
+	if _, err := tx.Exec(`DELETE FROM public.tus_uploads WHERE file_id = $1`, fileID); err != nil {
+		return fmt.Errorf("failed to delete tus uploads: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return nil
+}
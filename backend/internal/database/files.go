@@ -2,9 +2,24 @@ package database
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
+	"sort"
+	"time"
 )
 
+// ErrChunkNotFound is returned when a file has no stored chunk at the requested index
+var ErrChunkNotFound = errors.New("chunk not found")
+
+// ErrFileAlreadyComplete is returned when a chunk is uploaded for a file that has already been finalized
+var ErrFileAlreadyComplete = errors.New("file upload is already complete")
+
+// ErrForwardAllowanceExceeded is returned when a recipient forwards a file with more downloads than they have left
+var ErrForwardAllowanceExceeded = errors.New("not enough downloads left to forward")
+
+// ErrFileExpired is returned when upload data is written to a file whose expiry has passed
+var ErrFileExpired = errors.New("file has expired")
+
 // FileMetadata represents file metadata in the database
 type FileMetadata struct {
 	ID               string
@@ -14,16 +29,58 @@ type FileMetadata struct {
 	FileSize         int64
 	TotalChunks      int
 	MimeType         sql.NullString
+	CreatedAt        time.Time
+	CompletedAt      sql.NullTime
+	ExpiresAt        time.Time
+	ExpiredAt        sql.NullTime
+	MerkleRoot       sql.NullString // Set when the upload is finalized
+	ForwardPolicy    string
+	TransferID       sql.NullString // Set when the file is part of a multi-file transfer
+	RelativePath     sql.NullString // Path of the file within its transfer
+}
+
+// HasExpired reports whether the file's expiry has passed, whether or not the reaper has deleted its chunks yet
+func (m *FileMetadata) HasExpired() bool {
+	return m.ExpiredAt.Valid || !m.ExpiresAt.After(time.Now())
 }
 
 // FileChunk represents a file chunk in the database
 type FileChunk struct {
-	ID           string
-	FileID       string
-	ChunkIndex   int
-	ChunkSize    int64
-	StoragePath  string
-	EncryptionIV string
+	ID             string
+	FileID         string
+	ChunkIndex     int
+	ChunkSize      int64
+	StoragePath    string
+	EncryptionIV   string
+	ContentSHA256  string // Hex SHA-256 of the encrypted chunk as received by the server
+	IdempotencyKey string // Optional client-supplied Idempotency-Key of the upload that stored the chunk
+}
+
+// fileChunkColumns is the column list read by scanFileChunk
+const fileChunkColumns = `id::text, file_id, chunk_index, chunk_size, storage_path, encryption_iv, content_sha256, COALESCE(idempotency_key, '')`
+
+// rowScanner is implemented by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanFileChunk scans a row selected with fileChunkColumns
+func scanFileChunk(row rowScanner) (*FileChunk, error) {
+	var chunk FileChunk
+	err := row.Scan(
+		&chunk.ID,
+		&chunk.FileID,
+		&chunk.ChunkIndex,
+		&chunk.ChunkSize,
+		&chunk.StoragePath,
+		&chunk.EncryptionIV,
+		&chunk.ContentSHA256,
+		&chunk.IdempotencyKey,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &chunk, nil
 }
 
 // FileRecipient represents a file recipient and their encrypted key
@@ -35,94 +92,136 @@ type FileRecipient struct {
 	EncryptedFileKey string
 }
 
-// CreateFileMetadata creates a new file metadata record
-func CreateFileMetadata(fileID, senderID, originalFilename string, fileSize int64, totalChunks int, mimeType string) error {
-	query := `
-		INSERT INTO public.file_metadata (file_id, sender_id, original_filename, file_size, total_chunks, mime_type)
-		VALUES ($1, $2, $3, $4, $5, $6)
-	`
+// RecipientRecord describes a recipient to be added to a file
+type RecipientRecord struct {
+	Email        string
+	EncryptedKey string
+	RecipientID  *string
+	MaxDownloads *int    // nil means unlimited
+	ForwardedBy  *string // User ID of the recipient who forwarded the file, nil when added by the sender
+}
 
-	var mimeTypeVal sql.NullString
-	if mimeType != "" {
-		mimeTypeVal = sql.NullString{String: mimeType, Valid: true}
+// CreateFileChunk creates a new file chunk record
+// If a chunk with the same index or idempotency key is already stored nothing is written and false is returned,
+// so the caller can compare the stored chunk with the one being uploaded
+// Returns ErrFileAlreadyComplete if the file has already been finalized
+func CreateFileChunk(chunk FileChunk) (bool, error) {
+	inserted, err := CreateFileChunks(chunk.FileID, []FileChunk{chunk})
+	if err != nil {
+		return false, err
 	}
+	return inserted[0], nil
+}
 
-	_, err := DB.Exec(query, fileID, senderID, originalFilename, fileSize, totalChunks, mimeTypeVal)
+// CreateFileChunks creates several chunk records of one file in a single transaction
+// Returns, for each chunk in order, whether it was inserted; chunks whose index or idempotency key
+// is already stored are skipped as in CreateFileChunk
+// Returns ErrFileAlreadyComplete if the file has already been finalized, ErrFileExpired if its expiry has passed
+// and ErrStorageQuotaExceeded if the chunks would take the sender past their storage quota
+func CreateFileChunks(fileID string, chunks []FileChunk) ([]bool, error) {
+	tx, err := DB.Begin()
 	if err != nil {
-		return fmt.Errorf("failed to create file metadata: %w", err)
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
 	}
+	defer tx.Rollback()
 
-	return nil
-}
+	// The file row is share-locked so a chunk cannot slip in while the file is being finalized or expired
+	senderID, completed, err := lockFileForUpload(tx, fileID)
+	if err != nil {
+		return nil, err
+	}
+	if completed {
+		return nil, ErrFileAlreadyComplete
+	}
+	if err := lockQuota(tx, senderID); err != nil {
+		return nil, err
+	}
 
-// CreateFileChunk creates a new file chunk record
-func CreateFileChunk(fileID string, chunkIndex int, chunkSize int64, storagePath, encryptionIV string) error {
 	query := `
-		INSERT INTO public.file_chunks (file_id, chunk_index, chunk_size, storage_path, encryption_iv)
-		VALUES ($1, $2, $3, $4, $5)
+		INSERT INTO public.file_chunks (file_id, chunk_index, chunk_size, storage_path, encryption_iv, content_sha256, idempotency_key)
+		VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''))
+		ON CONFLICT DO NOTHING
 	`
 
-	_, err := DB.Exec(query, fileID, chunkIndex, chunkSize, storagePath, encryptionIV)
-	if err != nil {
-		return fmt.Errorf("failed to create file chunk: %w", err)
+	// Insert in index order so concurrent batches for the same file cannot deadlock
+	order := make([]int, len(chunks))
+	for i := range order {
+		order[i] = i
 	}
+	sort.Slice(order, func(a, b int) bool { return chunks[order[a]].ChunkIndex < chunks[order[b]].ChunkIndex })
 
-	return nil
-}
+	inserted := make([]bool, len(chunks))
+	for _, i := range order {
+		chunk := chunks[i]
+		result, err := tx.Exec(query, fileID, chunk.ChunkIndex, chunk.ChunkSize, chunk.StoragePath, chunk.EncryptionIV, chunk.ContentSHA256, chunk.IdempotencyKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create file chunk %d: %w", chunk.ChunkIndex, err)
+		}
 
-// CreateFileRecipient creates a new file recipient record
-func CreateFileRecipient(fileID, recipientEmail, encryptedFileKey string, recipientID *string) error {
-	query := `
-		INSERT INTO public.file_recipients (file_id, recipient_id, recipient_email, encrypted_file_key)
-		VALUES ($1, $2, $3, $4)
-	`
+		rows, err := result.RowsAffected()
+		if err != nil {
+			return nil, fmt.Errorf("failed to create file chunk %d: %w", chunk.ChunkIndex, err)
+		}
+		inserted[i] = rows > 0
+	}
 
-	var recipientIDVal sql.NullString
-	if recipientID != nil && *recipientID != "" {
-		recipientIDVal = sql.NullString{String: *recipientID, Valid: true}
+	// Chunks within the file's reserved size do not change the usage; larger ones must still fit
+	if err := enforceQuota(tx, senderID, false); err != nil {
+		return nil, err
 	}
 
-	_, err := DB.Exec(query, fileID, recipientIDVal, recipientEmail, encryptedFileKey)
-	if err != nil {
-		return fmt.Errorf("failed to create file recipient: %w", err)
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
 	}
 
-	return nil
+	return inserted, nil
 }
 
-// FileMetadataExists checks if file metadata already exists
-func FileMetadataExists(fileID string) (bool, error) {
-	query := `SELECT EXISTS(SELECT 1 FROM public.file_metadata WHERE file_id = $1)`
-
-	var exists bool
-	err := DB.QueryRow(query, fileID).Scan(&exists)
+// lockFileForUpload share-locks a file's metadata row for a transaction that writes upload data
+// The lock holds off FinalizeFile and MarkFileExpired until the transaction ends
+// Returns the sender ID and whether the upload was finalized, ErrFileNotFound, or ErrFileExpired once the file's
+// expiry has passed, so nothing is written after the reaper may have deleted the file's storage objects
+func lockFileForUpload(tx *sql.Tx, fileID string) (string, bool, error) {
+	var senderID string
+	var completed, expired bool
+	err := tx.QueryRow(`
+		SELECT sender_id::text, completed_at IS NOT NULL, expired_at IS NOT NULL OR expires_at <= NOW()
+		FROM public.file_metadata
+		WHERE file_id = $1
+		FOR SHARE
+	`, fileID).Scan(&senderID, &completed, &expired)
+	if err == sql.ErrNoRows {
+		return "", false, ErrFileNotFound
+	}
 	if err != nil {
-		return false, fmt.Errorf("failed to check file metadata existence: %w", err)
+		return "", false, fmt.Errorf("failed to lock file metadata: %w", err)
+	}
+	if expired {
+		return "", false, ErrFileExpired
 	}
 
-	return exists, nil
+	return senderID, completed, nil
 }
 
-// MarkFileComplete marks a file as completely uploaded
-func MarkFileComplete(fileID string) error {
-	query := `UPDATE public.file_metadata SET completed_at = NOW() WHERE file_id = $1`
-
-	_, err := DB.Exec(query, fileID)
+// CreateFileWithRecipients creates a file and all of its recipients in a single transaction
+// The file ID is issued by the database and returned to the caller. The file's expected ciphertext size is
+// reserved against the sender's storage quota; returns ErrStorageQuotaExceeded or ErrTransferQuotaExceeded if
+// the sender has no room for it
+func CreateFileWithRecipients(senderID, originalFilename string, fileSize int64, totalChunks int, mimeType string, expiresAt time.Time, forwardPolicy string, recipients []RecipientRecord) (string, error) {
+	tx, err := DB.Begin()
 	if err != nil {
-		return fmt.Errorf("failed to mark file as complete: %w", err)
+		return "", fmt.Errorf("failed to begin transaction: %w", err)
 	}
+	defer tx.Rollback()
 
-	return nil
-}
+	if err := lockQuota(tx, senderID); err != nil {
+		return "", err
+	}
 
-// CreateFileMetadataIfNotExists creates file metadata only if it doesn't exist yet
-// This is safe for concurrent chunk uploads
-func CreateFileMetadataIfNotExists(fileID, senderID, originalFilename string, fileSize int64, totalChunks int, mimeType string) error {
-	// Use INSERT ... ON CONFLICT DO NOTHING for safe concurrent inserts
 	query := `
-		INSERT INTO public.file_metadata (file_id, sender_id, original_filename, file_size, total_chunks, mime_type)
-		VALUES ($1, $2, $3, $4, $5, $6)
-		ON CONFLICT (file_id) DO NOTHING
+		INSERT INTO public.file_metadata (sender_id, original_filename, file_size, total_chunks, mime_type, expires_at, forward_policy)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING file_id
 	`
 
 	var mimeTypeVal sql.NullString
@@ -130,56 +229,363 @@ func CreateFileMetadataIfNotExists(fileID, senderID, originalFilename string, fi
 		mimeTypeVal = sql.NullString{String: mimeType, Valid: true}
 	}
 
-	_, err := DB.Exec(query, fileID, senderID, originalFilename, fileSize, totalChunks, mimeTypeVal)
+	var fileID string
+	err = tx.QueryRow(query, senderID, originalFilename, fileSize, totalChunks, mimeTypeVal, expiresAt, forwardPolicy).Scan(&fileID)
 	if err != nil {
-		return fmt.Errorf("failed to create file metadata: %w", err)
+		return "", fmt.Errorf("failed to create file metadata: %w", err)
 	}
 
-	return nil
-}
+	if err := enforceQuota(tx, senderID, true); err != nil {
+		return "", err
+	}
 
-// CreateFileRecipientsIfNotExists creates file recipient records if they don't exist yet
-// This is safe for concurrent chunk uploads
-func CreateFileRecipientsIfNotExists(fileID string, recipients []struct {
-	Email        string
-	EncryptedKey string
-	RecipientID  *string
-}) error {
-	// Start a transaction for atomic inserts
-	tx, err := DB.Begin()
-	if err != nil {
-		return fmt.Errorf("failed to begin transaction: %w", err)
+	if _, err := insertRecipients(tx, fileID, recipients); err != nil {
+		return "", err
 	}
-	defer tx.Rollback()
 
+	if err = tx.Commit(); err != nil {
+		return "", fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return fileID, nil
+}
+
+// insertRecipients adds recipient records to a file within a transaction
+// Recipients that are already on the file (emails compare case-insensitively) are left unchanged
+// Returns the emails of the recipients that were added
+func insertRecipients(tx *sql.Tx, fileID string, recipients []RecipientRecord) ([]string, error) {
 	query := `
-		INSERT INTO public.file_recipients (file_id, recipient_id, recipient_email, encrypted_file_key)
-		VALUES ($1, $2, $3, $4)
+		INSERT INTO public.file_recipients (file_id, recipient_id, recipient_email, encrypted_file_key, max_downloads, forwarded_by)
+		SELECT $1, $2, $3, $4, $5, $6
+		WHERE NOT EXISTS (
+			SELECT 1 FROM public.file_recipients WHERE file_id = $1 AND LOWER(recipient_email) = LOWER($3)
+		)
 		ON CONFLICT (file_id, recipient_email) DO NOTHING
+		RETURNING recipient_email
 	`
 
 	stmt, err := tx.Prepare(query)
 	if err != nil {
-		return fmt.Errorf("failed to prepare statement: %w", err)
+		return nil, fmt.Errorf("failed to prepare statement: %w", err)
 	}
 	defer stmt.Close()
 
+	added := []string{}
 	for _, recipient := range recipients {
 		var recipientIDVal sql.NullString
 		if recipient.RecipientID != nil && *recipient.RecipientID != "" {
 			recipientIDVal = sql.NullString{String: *recipient.RecipientID, Valid: true}
 		}
 
-		_, err = stmt.Exec(fileID, recipientIDVal, recipient.Email, recipient.EncryptedKey)
+		var maxDownloadsVal sql.NullInt64
+		if recipient.MaxDownloads != nil {
+			maxDownloadsVal = sql.NullInt64{Int64: int64(*recipient.MaxDownloads), Valid: true}
+		}
+
+		var forwardedByVal sql.NullString
+		if recipient.ForwardedBy != nil {
+			forwardedByVal = sql.NullString{String: *recipient.ForwardedBy, Valid: true}
+		}
+
+		var email string
+		err = stmt.QueryRow(fileID, recipientIDVal, recipient.Email, recipient.EncryptedKey, maxDownloadsVal, forwardedByVal).Scan(&email)
+		if err == sql.ErrNoRows {
+			continue
+		}
 		if err != nil {
-			return fmt.Errorf("failed to create file recipient: %w", err)
+			return nil, fmt.Errorf("failed to create file recipient: %w", err)
 		}
+		added = append(added, email)
+	}
+
+	return added, nil
+}
+
+// AddFileRecipients adds recipients to an existing file in a single transaction
+// Recipients that are already on the file are skipped. Returns the emails of the recipients that were added
+func AddFileRecipients(fileID string, recipients []RecipientRecord) ([]string, error) {
+	return addFileRecipients(fileID, "", recipients)
+}
+
+// ForwardFileRecipients adds recipients forwarded by the recipient whose file_recipients row is forwarderRowID
+// Forwarded recipients the sender removed from the file are refused with ErrForwardToRemovedRecipient. If the
+// forwarder has a download limit, every added recipient must have one too, and their limits are deducted from the
+// forwarder's in the same transaction, so forwarding never raises the number of downloads the sender allowed.
+// Returns ErrForwardAllowanceExceeded if the forwarder has fewer downloads left than that, and ErrRecipientNotFound
+// if the forwarder is no longer a recipient
+func ForwardFileRecipients(fileID, forwarderRowID string, recipients []RecipientRecord) ([]string, error) {
+	return addFileRecipients(fileID, forwarderRowID, recipients)
+}
+
+// addFileRecipients implements AddFileRecipients and, with a forwarderRowID, ForwardFileRecipients
+func addFileRecipients(fileID, forwarderRowID string, recipients []RecipientRecord) ([]string, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	added, err := addRecipientsToFile(tx, fileID, forwarderRowID, recipients)
+	if err != nil {
+		return nil, err
 	}
 
 	if err = tx.Commit(); err != nil {
-		return fmt.Errorf("failed to commit transaction: %w", err)
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return added, nil
+}
+
+// addRecipientsToFile adds recipients to one file within tx, see AddFileRecipients and ForwardFileRecipients
+func addRecipientsToFile(tx *sql.Tx, fileID, forwarderRowID string, recipients []RecipientRecord) ([]string, error) {
+	// Lock the file so it cannot be revoked while recipients are being added
+	var locked string
+	err := tx.QueryRow(`SELECT file_id FROM public.file_metadata WHERE file_id = $1 FOR SHARE`, fileID).Scan(&locked)
+	if err == sql.ErrNoRows {
+		return nil, ErrFileNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock file metadata: %w", err)
+	}
+
+	if err := checkForwardedRecipients(tx, fileID, recipients); err != nil {
+		return nil, err
+	}
+
+	// Lock the forwarder's row so concurrent downloads and forwards see the deducted limit
+	var forwarderMax sql.NullInt64
+	var forwarderCount int
+	if forwarderRowID != "" {
+		err = tx.QueryRow(`
+			SELECT max_downloads, download_count
+			FROM public.file_recipients
+			WHERE id = $1::uuid AND file_id = $2
+			FOR UPDATE
+		`, forwarderRowID, fileID).Scan(&forwarderMax, &forwarderCount)
+		if err == sql.ErrNoRows {
+			return nil, ErrRecipientNotFound
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to lock forwarding recipient: %w", err)
+		}
+	}
+
+	added, err := insertRecipients(tx, fileID, recipients)
+	if err != nil {
+		return nil, err
+	}
+
+	if forwarderMax.Valid {
+		if err := chargeForwardedDownloads(tx, forwarderRowID, forwarderMax.Int64-int64(forwarderCount), recipients, added); err != nil {
+			return nil, err
+		}
+	}
+
+	return added, nil
+}
+
+// chargeForwardedDownloads deducts the download limits of the added forwarded recipients from the forwarder's
+// limit, whose remaining downloads are given. The forwarder's wrapped key is wiped if no downloads are left,
+// as it is when a recipient reaches their limit by downloading
+func chargeForwardedDownloads(tx *sql.Tx, forwarderRowID string, remaining int64, recipients []RecipientRecord, added []string) error {
+	isAdded := make(map[string]bool, len(added))
+	for _, email := range added {
+		isAdded[email] = true
+	}
+
+	var charged int64
+	for _, recipient := range recipients {
+		if !isAdded[recipient.Email] {
+			continue
+		}
+		if recipient.MaxDownloads == nil {
+			return fmt.Errorf("forwarded recipient %s has no download limit", recipient.Email)
+		}
+		charged += int64(*recipient.MaxDownloads)
+	}
+	if charged == 0 {
+		return nil
+	}
+	if charged > remaining {
+		return fmt.Errorf("%w: %d download(s) left, %d requested", ErrForwardAllowanceExceeded, remaining, charged)
+	}
+
+	_, err := tx.Exec(`
+		UPDATE public.file_recipients
+		SET max_downloads = max_downloads - $2,
+			encrypted_file_key = CASE
+				WHEN download_count >= max_downloads - $2 THEN ''
+				ELSE encrypted_file_key
+			END
+		WHERE id = $1::uuid
+	`, forwarderRowID, charged)
+	if err != nil {
+		return fmt.Errorf("failed to charge forwarded downloads: %w", err)
 	}
 
 	return nil
 }
 
+// SetForwardPolicy changes whether the recipients of a file may forward it
+// Returns ErrFileNotFound if no file exists with the given file ID
+func SetForwardPolicy(fileID, forwardPolicy string) error {
+	result, err := DB.Exec(`UPDATE public.file_metadata SET forward_policy = $2 WHERE file_id = $1`, fileID, forwardPolicy)
+	if err != nil {
+		return fmt.Errorf("failed to update forward policy: %w", err)
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed to update forward policy: %w", err)
+	}
+	if updated == 0 {
+		return ErrFileNotFound
+	}
+
+	return nil
+}
+
+// GetFileMetadata retrieves the metadata of a single file
+// Returns ErrFileNotFound if no file exists with the given file ID
+func GetFileMetadata(fileID string) (*FileMetadata, error) {
+	query := `
+		SELECT id::text, file_id, sender_id::text, original_filename, file_size, total_chunks, mime_type,
+			created_at, completed_at, expires_at, expired_at, merkle_root, forward_policy,
+			transfer_id::text, relative_path
+		FROM public.file_metadata
+		WHERE file_id = $1
+	`
+
+	var metadata FileMetadata
+	err := DB.QueryRow(query, fileID).Scan(
+		&metadata.ID,
+		&metadata.FileID,
+		&metadata.SenderID,
+		&metadata.OriginalFilename,
+		&metadata.FileSize,
+		&metadata.TotalChunks,
+		&metadata.MimeType,
+		&metadata.CreatedAt,
+		&metadata.CompletedAt,
+		&metadata.ExpiresAt,
+		&metadata.ExpiredAt,
+		&metadata.MerkleRoot,
+		&metadata.ForwardPolicy,
+		&metadata.TransferID,
+		&metadata.RelativePath,
+	)
+	if err == sql.ErrNoRows {
+		return nil, ErrFileNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve file metadata: %w", err)
+	}
+
+	return &metadata, nil
+}
+
+// GetFileChunks retrieves all stored chunks of a file ordered by chunk index
+func GetFileChunks(fileID string) ([]FileChunk, error) {
+	query := `
+		SELECT ` + fileChunkColumns + `
+		FROM public.file_chunks
+		WHERE file_id = $1
+		ORDER BY chunk_index
+	`
+
+	rows, err := DB.Query(query, fileID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve file chunks: %w", err)
+	}
+	defer rows.Close()
+
+	chunks := []FileChunk{}
+	for rows.Next() {
+		chunk, err := scanFileChunk(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan file chunk: %w", err)
+		}
+		chunks = append(chunks, *chunk)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating file chunks: %w", err)
+	}
+
+	return chunks, nil
+}
+
+// GetFileChunk retrieves a single stored chunk of a file
+// Returns ErrChunkNotFound if the chunk has not been uploaded
+func GetFileChunk(fileID string, chunkIndex int) (*FileChunk, error) {
+	query := `
+		SELECT ` + fileChunkColumns + `
+		FROM public.file_chunks
+		WHERE file_id = $1 AND chunk_index = $2
+	`
+
+	chunk, err := scanFileChunk(DB.QueryRow(query, fileID, chunkIndex))
+	if err == sql.ErrNoRows {
+		return nil, ErrChunkNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve file chunk: %w", err)
+	}
+
+	return chunk, nil
+}
+
+// GetFileChunkByIdempotencyKey retrieves the chunk of a file stored by the upload with the given Idempotency-Key
+// Returns ErrChunkNotFound if no chunk was stored with that key
+func GetFileChunkByIdempotencyKey(fileID, idempotencyKey string) (*FileChunk, error) {
+	query := `
+		SELECT ` + fileChunkColumns + `
+		FROM public.file_chunks
+		WHERE file_id = $1 AND idempotency_key = $2
+	`
+
+	chunk, err := scanFileChunk(DB.QueryRow(query, fileID, idempotencyKey))
+	if err == sql.ErrNoRows {
+		return nil, ErrChunkNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve file chunk: %w", err)
+	}
+
+	return chunk, nil
+}
+
+// GetUploadedChunks retrieves the indices of the chunks stored for a file and their total size in bytes
+func GetUploadedChunks(fileID string) ([]int, int64, error) {
+	query := `
+		SELECT chunk_index, chunk_size
+		FROM public.file_chunks
+		WHERE file_id = $1
+		ORDER BY chunk_index
+	`
+
+	rows, err := DB.Query(query, fileID)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to retrieve uploaded chunks: %w", err)
+	}
+	defer rows.Close()
+
+	indices := []int{}
+	var bytesReceived int64
+	for rows.Next() {
+		var index int
+		var size int64
+		if err := rows.Scan(&index, &size); err != nil {
+			return nil, 0, fmt.Errorf("failed to scan uploaded chunk: %w", err)
+		}
+		indices = append(indices, index)
+		bytesReceived += size
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("error iterating uploaded chunks: %w", err)
+	}
+
+	return indices, bytesReceived, nil
+}
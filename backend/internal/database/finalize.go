@@ -0,0 +1,176 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"secure-document-transfer/internal/crypto"
+)
+
+// gcmTagSize is the size of the authentication tag AES-GCM appends to every encrypted chunk
+const gcmTagSize = 16
+
+// ExpectedCiphertextSize returns the total size of a file's encrypted chunks
+func ExpectedCiphertextSize(fileSize int64, totalChunks int) int64 {
+	return fileSize + int64(totalChunks)*gcmTagSize
+}
+
+// FinalizeResult describes the outcome of finalizing a file upload
+// CompletedAt is only set when the upload passed every check
+type FinalizeResult struct {
+	CompletedAt           time.Time
+	MerkleRoot            string   // Hex Merkle root over the ordered chunk hashes
+	MissingChunks         []int    // Chunk indices in [0, total_chunks) that were never stored
+	ExpectedSize          int64    // Ciphertext size implied by file_size and total_chunks
+	ReceivedSize          int64    // Sum of the stored chunk sizes
+	RecipientsWithoutKeys []string // Recipients whose wrapped file key is still empty
+}
+
+// Complete reports whether the file passed every check and was marked complete
+func (r *FinalizeResult) Complete() bool {
+	return !r.CompletedAt.IsZero()
+}
+
+// FinalizeFile verifies that a file upload is complete and, if so, sets completed_at and the Merkle root
+// Every chunk index must be present, the chunk sizes must add up to the expected ciphertext size
+// and every recipient must have a wrapped key
+// encryptedKeys (recipient email -> wrapped key) may fill in keys that were missing when the file was created
+// Finalizing an already completed file returns its original completion time
+func FinalizeFile(fileID string, encryptedKeys map[string]string) (*FinalizeResult, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Lock the file row so no chunk can be stored while the upload is checked
+	var totalChunks int
+	var fileSize int64
+	var completedAt sql.NullTime
+	var merkleRoot sql.NullString
+	err = tx.QueryRow(`
+		SELECT total_chunks, file_size, completed_at, merkle_root
+		FROM public.file_metadata
+		WHERE file_id = $1
+		FOR UPDATE
+	`, fileID).Scan(&totalChunks, &fileSize, &completedAt, &merkleRoot)
+	if err == sql.ErrNoRows {
+		return nil, ErrFileNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock file metadata: %w", err)
+	}
+
+	result := &FinalizeResult{
+		ExpectedSize:          ExpectedCiphertextSize(fileSize, totalChunks),
+		MissingChunks:         []int{},
+		RecipientsWithoutKeys: []string{},
+	}
+
+	if completedAt.Valid {
+		result.CompletedAt = completedAt.Time
+		result.MerkleRoot = merkleRoot.String
+		return result, nil
+	}
+
+	for email, key := range encryptedKeys {
+		if strings.TrimSpace(key) == "" {
+			continue
+		}
+		_, err := tx.Exec(`
+			UPDATE public.file_recipients
+			SET encrypted_file_key = $3
+			WHERE file_id = $1 AND LOWER(recipient_email) = LOWER($2) AND encrypted_file_key = ''
+		`, fileID, email, key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to store recipient key: %w", err)
+		}
+	}
+
+	rows, err := tx.Query(`
+		SELECT chunk_index, chunk_size, content_sha256
+		FROM public.file_chunks
+		WHERE file_id = $1
+		ORDER BY chunk_index
+	`, fileID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve file chunks: %w", err)
+	}
+	present := make(map[int]bool)
+	var chunkHashes [][]byte
+	for rows.Next() {
+		var index int
+		var size int64
+		var contentSHA256 string
+		if err := rows.Scan(&index, &size, &contentSHA256); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan file chunk: %w", err)
+		}
+		chunkHash, err := hex.DecodeString(contentSHA256)
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("invalid hash for chunk %d: %w", index, err)
+		}
+		present[index] = true
+		chunkHashes = append(chunkHashes, chunkHash)
+		result.ReceivedSize += size
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return nil, fmt.Errorf("error iterating file chunks: %w", err)
+	}
+	rows.Close()
+
+	for i := 0; i < totalChunks; i++ {
+		if !present[i] {
+			result.MissingChunks = append(result.MissingChunks, i)
+		}
+	}
+
+	rows, err = tx.Query(`
+		SELECT recipient_email
+		FROM public.file_recipients
+		WHERE file_id = $1 AND encrypted_file_key = ''
+		ORDER BY recipient_email
+	`, fileID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve recipients without keys: %w", err)
+	}
+	for rows.Next() {
+		var email string
+		if err := rows.Scan(&email); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan recipient: %w", err)
+		}
+		result.RecipientsWithoutKeys = append(result.RecipientsWithoutKeys, email)
+	}
+	if err := rows.Err(); err != nil {
+		rows.Close()
+		return nil, fmt.Errorf("error iterating recipients: %w", err)
+	}
+	rows.Close()
+
+	// Keys supplied with this request are kept even if other checks fail
+	if len(result.MissingChunks) == 0 && result.ReceivedSize == result.ExpectedSize && len(result.RecipientsWithoutKeys) == 0 {
+		// Chunks are ordered by index and every index is present, so the root commits to the whole file
+		result.MerkleRoot = hex.EncodeToString(crypto.NewMerkleTree(chunkHashes).Root())
+		err = tx.QueryRow(`
+			UPDATE public.file_metadata
+			SET completed_at = NOW(), merkle_root = $2
+			WHERE file_id = $1
+			RETURNING completed_at
+		`, fileID, result.MerkleRoot).Scan(&result.CompletedAt)
+		if err != nil {
+			return nil, fmt.Errorf("failed to mark file as complete: %w", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return result, nil
+}
@@ -0,0 +1,260 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+	"secure-document-transfer/internal/models"
+)
+
+// GetInboxFiles retrieves a page of files shared with a user
+// Recipients are matched by user ID or, for rows created before the account existed, by email
+// Files whose upload has not completed are skipped unless includeIncomplete is set
+func GetInboxFiles(userID, userEmail string, includeIncomplete bool, limit, offset int) ([]models.InboxFile, int, error) {
+	countQuery := `
+		SELECT COUNT(*)
+		FROM public.file_recipients fr
+		INNER JOIN public.file_metadata fm ON fm.file_id = fr.file_id
+		WHERE (fr.recipient_id = $1::uuid OR LOWER(fr.recipient_email) = LOWER($2))
+			AND ($3 OR fm.completed_at IS NOT NULL)
+	`
+
+	var total int
+	err := DB.QueryRow(countQuery, userID, userEmail, includeIncomplete).Scan(&total)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to count inbox files: %w", err)
+	}
+
+	query := `
+		SELECT
+			fm.file_id,
+			fm.original_filename,
+			fm.file_size,
+			COALESCE(fm.mime_type, ''),
+			fm.sender_id::text,
+			COALESCE(su.email, ''),
+			COALESCE(su.raw_user_meta_data->>'full_name', ''),
+			fm.created_at,
+			fm.completed_at,
+			fm.expires_at,
+			fm.expired_at IS NOT NULL OR fm.expires_at <= NOW(),
+			fr.downloaded_at,
+			fr.max_downloads,
+			fr.download_count
+		FROM public.file_recipients fr
+		INNER JOIN public.file_metadata fm ON fm.file_id = fr.file_id
+		LEFT JOIN auth.users su ON su.id = fm.sender_id
+		WHERE (fr.recipient_id = $1::uuid OR LOWER(fr.recipient_email) = LOWER($2))
+			AND ($3 OR fm.completed_at IS NOT NULL)
+		ORDER BY fm.created_at DESC, fm.file_id
+		LIMIT $4 OFFSET $5
+	`
+
+	rows, err := DB.Query(query, userID, userEmail, includeIncomplete, limit, offset)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to retrieve inbox files: %w", err)
+	}
+	defer rows.Close()
+
+	files := []models.InboxFile{}
+	for rows.Next() {
+		var file models.InboxFile
+		var completedAt, downloadedAt sql.NullTime
+		var maxDownloads sql.NullInt64
+		if err := rows.Scan(
+			&file.FileID,
+			&file.OriginalFilename,
+			&file.FileSize,
+			&file.MimeType,
+			&file.Sender.ID,
+			&file.Sender.Email,
+			&file.Sender.FullName,
+			&file.CreatedAt,
+			&completedAt,
+			&file.ExpiresAt,
+			&file.Expired,
+			&downloadedAt,
+			&maxDownloads,
+			&file.DownloadCount,
+		); err != nil {
+			return nil, 0, fmt.Errorf("failed to scan inbox file: %w", err)
+		}
+		file.CompletedAt = nullTimePtr(completedAt)
+		file.DownloadedAt = nullTimePtr(downloadedAt)
+		file.MaxDownloads = nullIntPtr(maxDownloads)
+		files = append(files, file)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("error iterating inbox files: %w", err)
+	}
+
+	return files, total, nil
+}
+
+// nullTimePtr converts a nullable timestamp into a pointer suitable for JSON responses
+func nullTimePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+// nullIntPtr converts a nullable integer into a pointer suitable for JSON responses
+func nullIntPtr(n sql.NullInt64) *int {
+	if !n.Valid {
+		return nil
+	}
+	value := int(n.Int64)
+	return &value
+}
+
+// GetSentFiles retrieves a page of files sent by a user, including per-recipient delivery status
+// Incomplete uploads are included so the sender can follow their progress
+func GetSentFiles(senderID string, limit, offset int) ([]models.SentFile, int, error) {
+	countQuery := `SELECT COUNT(*) FROM public.file_metadata WHERE sender_id = $1::uuid`
+
+	var total int
+	err := DB.QueryRow(countQuery, senderID).Scan(&total)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to count sent files: %w", err)
+	}
+
+	query := `
+		SELECT
+			fm.file_id,
+			fm.original_filename,
+			fm.file_size,
+			COALESCE(fm.mime_type, ''),
+			fm.total_chunks,
+			(SELECT COUNT(*) FROM public.file_chunks fc WHERE fc.file_id = fm.file_id),
+			fm.created_at,
+			fm.completed_at,
+			fm.expires_at,
+			fm.expired_at IS NOT NULL OR fm.expires_at <= NOW(),
+			fm.forward_policy
+		FROM public.file_metadata fm
+		WHERE fm.sender_id = $1::uuid
+		ORDER BY fm.created_at DESC, fm.file_id
+		LIMIT $2 OFFSET $3
+	`
+
+	rows, err := DB.Query(query, senderID, limit, offset)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to retrieve sent files: %w", err)
+	}
+	defer rows.Close()
+
+	files := []models.SentFile{}
+	fileIDs := []string{}
+	for rows.Next() {
+		var file models.SentFile
+		var completedAt sql.NullTime
+		if err := rows.Scan(
+			&file.FileID,
+			&file.OriginalFilename,
+			&file.FileSize,
+			&file.MimeType,
+			&file.TotalChunks,
+			&file.ChunksStored,
+			&file.CreatedAt,
+			&completedAt,
+			&file.ExpiresAt,
+			&file.Expired,
+			&file.ForwardPolicy,
+		); err != nil {
+			return nil, 0, fmt.Errorf("failed to scan sent file: %w", err)
+		}
+		file.CompletedAt = nullTimePtr(completedAt)
+		file.Recipients = []models.SentFileRecipient{}
+		file.RemovedRecipients = []models.RecipientRemoval{}
+		files = append(files, file)
+		fileIDs = append(fileIDs, file.FileID)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("error iterating sent files: %w", err)
+	}
+
+	if len(fileIDs) == 0 {
+		return files, total, nil
+	}
+
+	recipients, err := getRecipientStatuses(fileIDs)
+	if err != nil {
+		return nil, 0, err
+	}
+	removals, err := getRecipientRemovals(fileIDs)
+	if err != nil {
+		return nil, 0, err
+	}
+	for i := range files {
+		if statuses, ok := recipients[files[i].FileID]; ok {
+			files[i].Recipients = statuses
+		}
+		if removed, ok := removals[files[i].FileID]; ok {
+			files[i].RemovedRecipients = removed
+		}
+	}
+
+	return files, total, nil
+}
+
+// getRecipientStatuses retrieves the delivery status of every recipient of the given files
+// Returns a map of file_id -> recipients
+func getRecipientStatuses(fileIDs []string) (map[string][]models.SentFileRecipient, error) {
+	query := `
+		SELECT
+			file_id,
+			recipient_email,
+			COALESCE(recipient_id::text, ''),
+			encrypted_file_key <> '',
+			downloaded_at,
+			last_downloaded_at,
+			max_downloads,
+			download_count,
+			COALESCE((SELECT email FROM auth.users WHERE id = forwarded_by), '')
+		FROM public.file_recipients
+		WHERE file_id = ANY($1)
+		ORDER BY created_at, recipient_email
+	`
+
+	rows, err := DB.Query(query, pq.Array(fileIDs))
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve recipient statuses: %w", err)
+	}
+	defer rows.Close()
+
+	statuses := make(map[string][]models.SentFileRecipient)
+	for rows.Next() {
+		var fileID string
+		var recipient models.SentFileRecipient
+		var downloadedAt, lastDownloadedAt sql.NullTime
+		var maxDownloads sql.NullInt64
+		if err := rows.Scan(
+			&fileID,
+			&recipient.Email,
+			&recipient.RecipientID,
+			&recipient.HasKey,
+			&downloadedAt,
+			&lastDownloadedAt,
+			&maxDownloads,
+			&recipient.DownloadCount,
+			&recipient.ForwardedBy,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan recipient status: %w", err)
+		}
+		recipient.DownloadedAt = nullTimePtr(downloadedAt)
+		recipient.LastDownloadedAt = nullTimePtr(lastDownloadedAt)
+		recipient.MaxDownloads = nullIntPtr(maxDownloads)
+		statuses[fileID] = append(statuses[fileID], recipient)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating recipient statuses: %w", err)
+	}
+
+	return statuses, nil
+}
@@ -0,0 +1,388 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"secure-document-transfer/internal/models"
+
+	"github.com/lib/pq"
+)
+
+var (
+	// ErrThreadNotFound is returned when no message thread with the requested ID exists on the transfer
+	ErrThreadNotFound = errors.New("message thread not found")
+	// ErrInvalidThreadKeys is returned when wrapped thread keys do not fit the thread they were sent for
+	ErrInvalidThreadKeys = errors.New("invalid thread keys")
+	// ErrInvalidKeyFile is returned when a thread encrypted with a file key does not name a file of the transfer
+	ErrInvalidKeyFile = errors.New("invalid key file")
+)
+
+// Conversation identifies the message threads of one transfer
+// A multi-file transfer is identified by TransferID. A file sent on its own is its own transfer and is
+// identified by FileID. Exactly one of the two is set
+type Conversation struct {
+	TransferID string
+	FileID     string
+}
+
+// String describes the conversation for log messages
+func (c Conversation) String() string {
+	if c.TransferID != "" {
+		return "transfer " + c.TransferID
+	}
+	return "file " + c.FileID
+}
+
+// filter returns the condition selecting the conversation's rows from a table with transfer_id and file_id
+// columns (file_metadata or message_threads) under the given alias, and its argument
+func (c Conversation) filter(alias string, param int) (string, string) {
+	if c.TransferID != "" {
+		return fmt.Sprintf("%s.transfer_id = $%d::uuid", alias, param), c.TransferID
+	}
+	return fmt.Sprintf("%s.file_id = $%d", alias, param), c.FileID
+}
+
+// NewMessage describes a message to be posted on a transfer
+// An empty ThreadID starts a new thread with the given KeySource and, for file keys, KeyFileID
+// ThreadKeys are keyed by lowercase email
+type NewMessage struct {
+	Conversation Conversation
+	SenderID     string
+	ThreadID     string
+	KeySource    string
+	KeyFileID    string
+	ThreadKeys   map[string]string
+	Ciphertext   string
+	IV           string
+}
+
+// PostedMessage is the outcome of CreateMessage
+// MissingKeys lists, for threads with their own key, the participants who have no wrapped copy of it yet
+type PostedMessage struct {
+	Message     models.Message
+	KeySource   string
+	KeyFileID   string
+	MissingKeys []string
+}
+
+// CreateMessage stores a message, starting its thread first if needed, and any wrapped thread keys sent with it
+// Thread keys may only be given to the transfer's sender and the current recipients of any of its files, and are
+// never replaced once stored. Returns ErrFileNotFound if the transfer has no files left
+func CreateMessage(msg NewMessage) (*PostedMessage, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	fileIDs, participants, err := lockConversation(tx, msg.Conversation)
+	if err != nil {
+		return nil, err
+	}
+
+	posted := PostedMessage{KeySource: msg.KeySource, KeyFileID: msg.KeyFileID}
+	threadID := msg.ThreadID
+	if threadID == "" {
+		var keyFileID sql.NullString
+		if posted.KeySource == models.MessageKeySourceFile {
+			if posted.KeyFileID == "" && len(fileIDs) == 1 {
+				posted.KeyFileID = fileIDs[0]
+			}
+			if !containsString(fileIDs, posted.KeyFileID) {
+				return nil, fmt.Errorf("%w: key_file_id must name a file of the transfer", ErrInvalidKeyFile)
+			}
+			keyFileID = sql.NullString{String: posted.KeyFileID, Valid: true}
+		}
+
+		var transferID, fileID sql.NullString
+		if msg.Conversation.TransferID != "" {
+			transferID = sql.NullString{String: msg.Conversation.TransferID, Valid: true}
+		} else {
+			fileID = sql.NullString{String: msg.Conversation.FileID, Valid: true}
+		}
+
+		err = tx.QueryRow(`
+			INSERT INTO public.message_threads (transfer_id, file_id, created_by, key_source, key_file_id)
+			VALUES ($1::uuid, $2, $3, $4, $5)
+			RETURNING id::text
+		`, transferID, fileID, msg.SenderID, posted.KeySource, keyFileID).Scan(&threadID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create message thread: %w", err)
+		}
+	} else {
+		filter, arg := msg.Conversation.filter("t", 2)
+		var keyFileID sql.NullString
+		err = tx.QueryRow(`
+			SELECT t.key_source, t.key_file_id
+			FROM public.message_threads t
+			WHERE t.id = $1::uuid AND `+filter, threadID, arg).Scan(&posted.KeySource, &keyFileID)
+		if err == sql.ErrNoRows {
+			return nil, ErrThreadNotFound
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to retrieve message thread: %w", err)
+		}
+		posted.KeyFileID = keyFileID.String
+	}
+
+	if posted.KeySource == models.MessageKeySourceThread {
+		posted.MissingKeys, err = insertThreadKeys(tx, threadID, msg.ThreadKeys, participants)
+		if err != nil {
+			return nil, err
+		}
+	} else if len(msg.ThreadKeys) > 0 {
+		return nil, fmt.Errorf("%w: the thread is encrypted with a file key", ErrInvalidThreadKeys)
+	}
+
+	posted.Message = models.Message{ThreadID: threadID, Ciphertext: msg.Ciphertext, IV: msg.IV}
+	err = tx.QueryRow(`
+		INSERT INTO public.messages (thread_id, sender_id, ciphertext, iv)
+		VALUES ($1::uuid, $2, $3, $4)
+		RETURNING id::text, sender_id::text, created_at
+	`, threadID, msg.SenderID, msg.Ciphertext, msg.IV).Scan(&posted.Message.MessageID, &posted.Message.Sender.ID, &posted.Message.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create message: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return &posted, nil
+}
+
+// lockConversation share-locks the files of a conversation so their recipients cannot change while thread keys
+// are checked. Returns the file IDs and the lowercase emails of the sender and every current recipient
+func lockConversation(tx *sql.Tx, conversation Conversation) ([]string, map[string]bool, error) {
+	filter, arg := conversation.filter("fm", 1)
+	rows, err := tx.Query(`
+		SELECT fm.file_id, COALESCE(LOWER(su.email), '')
+		FROM public.file_metadata fm
+		LEFT JOIN auth.users su ON su.id = fm.sender_id
+		WHERE `+filter+`
+		ORDER BY fm.file_id
+		FOR SHARE OF fm
+	`, arg)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to lock file metadata: %w", err)
+	}
+	defer rows.Close()
+
+	var fileIDs []string
+	participants := map[string]bool{}
+	for rows.Next() {
+		var fileID, senderEmail string
+		if err := rows.Scan(&fileID, &senderEmail); err != nil {
+			return nil, nil, fmt.Errorf("failed to scan file metadata: %w", err)
+		}
+		fileIDs = append(fileIDs, fileID)
+		if senderEmail != "" {
+			participants[senderEmail] = true
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("error iterating file metadata: %w", err)
+	}
+	if len(fileIDs) == 0 {
+		return nil, nil, ErrFileNotFound
+	}
+
+	recipientRows, err := tx.Query(`
+		SELECT DISTINCT LOWER(recipient_email)
+		FROM public.file_recipients
+		WHERE file_id = ANY($1)
+	`, pq.Array(fileIDs))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to retrieve file recipients: %w", err)
+	}
+	defer recipientRows.Close()
+
+	for recipientRows.Next() {
+		var email string
+		if err := recipientRows.Scan(&email); err != nil {
+			return nil, nil, fmt.Errorf("failed to scan file recipient: %w", err)
+		}
+		participants[email] = true
+	}
+
+	if err := recipientRows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("error iterating file recipients: %w", err)
+	}
+
+	return fileIDs, participants, nil
+}
+
+// containsString reports whether values contains value
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// insertThreadKeys stores the wrapped thread keys of participants who do not have one yet
+// Returns the participants still without a wrapped thread key, sorted
+func insertThreadKeys(tx *sql.Tx, threadID string, threadKeys map[string]string, participants map[string]bool) ([]string, error) {
+	for email, key := range threadKeys {
+		if !participants[email] {
+			return nil, fmt.Errorf("%w: %s is not the sender or a recipient of the transfer", ErrInvalidThreadKeys, email)
+		}
+
+		_, err := tx.Exec(`
+			INSERT INTO public.message_thread_keys (thread_id, recipient_email, encrypted_thread_key)
+			VALUES ($1::uuid, $2, $3)
+			ON CONFLICT (thread_id, recipient_email) DO NOTHING
+		`, threadID, email, key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to store thread key for %s: %w", email, err)
+		}
+	}
+
+	rows, err := tx.Query(`
+		SELECT recipient_email
+		FROM public.message_thread_keys
+		WHERE thread_id = $1::uuid
+	`, threadID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve thread keys: %w", err)
+	}
+	defer rows.Close()
+
+	withKey := map[string]bool{}
+	for rows.Next() {
+		var email string
+		if err := rows.Scan(&email); err != nil {
+			return nil, fmt.Errorf("failed to scan thread key: %w", err)
+		}
+		withKey[email] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating thread keys: %w", err)
+	}
+
+	missing := []string{}
+	for email := range participants {
+		if !withKey[email] {
+			missing = append(missing, email)
+		}
+	}
+	sort.Strings(missing)
+
+	return missing, nil
+}
+
+// GetMessageThreads retrieves a page of the message threads on a transfer, oldest thread first, with all of
+// their messages and the caller's wrapped file or thread key
+func GetMessageThreads(conversation Conversation, userID, userEmail string, limit, offset int) ([]models.MessageThread, int, error) {
+	filter, arg := conversation.filter("t", 1)
+
+	var total int
+	err := DB.QueryRow(`SELECT COUNT(*) FROM public.message_threads t WHERE `+filter, arg).Scan(&total)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to count message threads: %w", err)
+	}
+
+	rows, err := DB.Query(`
+		SELECT
+			t.id::text,
+			t.key_source,
+			COALESCE(t.key_file_id, ''),
+			t.created_by::text,
+			COALESCE(cu.email, ''),
+			t.created_at,
+			COALESCE(fk.encrypted_file_key, ''),
+			COALESCE(k.encrypted_thread_key, '')
+		FROM public.message_threads t
+		LEFT JOIN auth.users cu ON cu.id = t.created_by
+		LEFT JOIN public.message_thread_keys k ON k.thread_id = t.id AND k.recipient_email = LOWER($3)
+		LEFT JOIN LATERAL (
+			SELECT fr.encrypted_file_key
+			FROM public.file_recipients fr
+			WHERE fr.file_id = t.key_file_id
+				AND (fr.recipient_id = $2::uuid OR LOWER(fr.recipient_email) = LOWER($3))
+			ORDER BY (fr.recipient_id = $2::uuid) DESC NULLS LAST
+			LIMIT 1
+		) fk ON true
+		WHERE `+filter+`
+		ORDER BY t.created_at, t.id
+		LIMIT $4 OFFSET $5
+	`, arg, userID, strings.TrimSpace(userEmail), limit, offset)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to retrieve message threads: %w", err)
+	}
+	defer rows.Close()
+
+	threads := []models.MessageThread{}
+	threadIndex := map[string]int{}
+	for rows.Next() {
+		thread := models.MessageThread{Messages: []models.Message{}}
+		if err := rows.Scan(
+			&thread.ThreadID,
+			&thread.KeySource,
+			&thread.KeyFileID,
+			&thread.CreatedBy.ID,
+			&thread.CreatedBy.Email,
+			&thread.CreatedAt,
+			&thread.EncryptedFileKey,
+			&thread.EncryptedThreadKey,
+		); err != nil {
+			return nil, 0, fmt.Errorf("failed to scan message thread: %w", err)
+		}
+		threadIndex[thread.ThreadID] = len(threads)
+		threads = append(threads, thread)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("error iterating message threads: %w", err)
+	}
+
+	if len(threads) == 0 {
+		return threads, total, nil
+	}
+
+	threadIDs := make([]string, len(threads))
+	for i, thread := range threads {
+		threadIDs[i] = thread.ThreadID
+	}
+
+	messageRows, err := DB.Query(`
+		SELECT m.id::text, m.thread_id::text, m.sender_id::text, COALESCE(su.email, ''), m.ciphertext, m.iv, m.created_at
+		FROM public.messages m
+		LEFT JOIN auth.users su ON su.id = m.sender_id
+		WHERE m.thread_id = ANY($1::uuid[])
+		ORDER BY m.created_at, m.id
+	`, pq.Array(threadIDs))
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to retrieve messages: %w", err)
+	}
+	defer messageRows.Close()
+
+	for messageRows.Next() {
+		var message models.Message
+		if err := messageRows.Scan(
+			&message.MessageID,
+			&message.ThreadID,
+			&message.Sender.ID,
+			&message.Sender.Email,
+			&message.Ciphertext,
+			&message.IV,
+			&message.CreatedAt,
+		); err != nil {
+			return nil, 0, fmt.Errorf("failed to scan message: %w", err)
+		}
+		thread := &threads[threadIndex[message.ThreadID]]
+		thread.Messages = append(thread.Messages, message)
+	}
+
+	if err := messageRows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("error iterating messages: %w", err)
+	}
+
+	return threads, total, nil
+}
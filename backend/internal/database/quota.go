@@ -0,0 +1,146 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"secure-document-transfer/internal/config"
+)
+
+var (
+	// ErrStorageQuotaExceeded is returned when a write would take a user past their storage quota
+	ErrStorageQuotaExceeded = errors.New("storage quota exceeded")
+	// ErrTransferQuotaExceeded is returned when a new transfer would take a user past their active transfer quota
+	ErrTransferQuotaExceeded = errors.New("active transfer quota exceeded")
+)
+
+// StorageUsage describes how much a user currently has stored and any per-user quota overrides
+type StorageUsage struct {
+	StoredBytes        int64         // Ciphertext bytes stored or reserved across the user's files, see storageUsageQuery
+	ActiveTransfers    int64         // Transfers that have not expired yet, including unfinished uploads; a file sent on its own counts as one
+	MaxStorageBytes    sql.NullInt64 // Per-user override from user_quotas, if any
+	MaxActiveTransfers sql.NullInt64 // Per-user override from user_quotas, if any
+}
+
+// Limits returns the storage and active transfer limits that apply to the user
+// Per-user overrides from user_quotas take precedence over the configured defaults
+func (u *StorageUsage) Limits() (int64, int64) {
+	maxStorageBytes := config.DefaultStorageQuotaBytes()
+	if u.MaxStorageBytes.Valid {
+		maxStorageBytes = u.MaxStorageBytes.Int64
+	}
+	maxActiveTransfers := config.DefaultActiveTransferQuota()
+	if u.MaxActiveTransfers.Valid {
+		maxActiveTransfers = u.MaxActiveTransfers.Int64
+	}
+	return maxStorageBytes, maxActiveTransfers
+}
+
+// queryRower is implemented by *sql.DB and *sql.Tx
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// storageUsageQuery computes a sender's usage and quota overrides
+// A file counts the chunks it has committed plus the full Upload-Length of its pending tus uploads, whose
+// segments are already stored but not yet part of a chunk; an upload stops counting once its chunk is stored
+// An unfinished upload counts at least its expected ciphertext size from the moment it is created, so space
+// promised to one upload cannot be taken by another
+const storageUsageQuery = `
+	SELECT
+		COALESCE((
+			SELECT SUM(CASE
+				WHEN fm.completed_at IS NULL AND fm.expired_at IS NULL
+					THEN GREATEST(committed.bytes + pending.bytes, fm.file_size + $2 * fm.total_chunks)
+				ELSE committed.bytes + pending.bytes
+			END)
+			FROM public.file_metadata fm
+			CROSS JOIN LATERAL (
+				SELECT COALESCE(SUM(fc.chunk_size), 0) AS bytes
+				FROM public.file_chunks fc
+				WHERE fc.file_id = fm.file_id
+			) committed
+			CROSS JOIN LATERAL (
+				SELECT COALESCE(SUM(tu.upload_length), 0) AS bytes
+				FROM public.tus_uploads tu
+				WHERE tu.file_id = fm.file_id
+					AND NOT EXISTS (
+						SELECT 1 FROM public.file_chunks fc
+						WHERE fc.file_id = tu.file_id AND fc.chunk_index = tu.chunk_index
+					)
+			) pending
+			WHERE fm.sender_id = $1::uuid
+		), 0),
+		(
+			SELECT COUNT(DISTINCT COALESCE(fm.transfer_id::text, fm.file_id))
+			FROM public.file_metadata fm
+			WHERE fm.sender_id = $1::uuid AND fm.expired_at IS NULL AND fm.expires_at > NOW()
+		),
+		uq.max_storage_bytes,
+		uq.max_active_transfers
+	FROM (SELECT 1) AS one
+	LEFT JOIN public.user_quotas uq ON uq.user_id = $1::uuid
+`
+
+// GetStorageUsage retrieves a sender's current storage usage and quota overrides
+func GetStorageUsage(userID string) (*StorageUsage, error) {
+	return getStorageUsage(DB, userID)
+}
+
+func getStorageUsage(q queryRower, userID string) (*StorageUsage, error) {
+	var usage StorageUsage
+	err := q.QueryRow(storageUsageQuery, userID, gcmTagSize).Scan(
+		&usage.StoredBytes,
+		&usage.ActiveTransfers,
+		&usage.MaxStorageBytes,
+		&usage.MaxActiveTransfers,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve storage usage: %w", err)
+	}
+
+	return &usage, nil
+}
+
+// lockQuota serializes the quota-checked writes of one user by locking their user_quotas row
+// Users without a row get an empty one, which keeps the configured defaults
+// It must be called before the writes that enforceQuota checks
+func lockQuota(tx *sql.Tx, userID string) error {
+	_, err := tx.Exec(`
+		INSERT INTO public.user_quotas (user_id)
+		VALUES ($1)
+		ON CONFLICT (user_id) DO NOTHING
+	`, userID)
+	if err != nil {
+		return fmt.Errorf("failed to create quota row: %w", err)
+	}
+
+	var locked string
+	err = tx.QueryRow(`SELECT user_id::text FROM public.user_quotas WHERE user_id = $1 FOR UPDATE`, userID).Scan(&locked)
+	if err != nil {
+		return fmt.Errorf("failed to lock quota row: %w", err)
+	}
+
+	return nil
+}
+
+// enforceQuota checks, after the writes of a transaction holding lockQuota, that the user is still within their
+// storage quota and, if newTransfer is set, their active transfer quota
+// Returns ErrStorageQuotaExceeded or ErrTransferQuotaExceeded (wrapped with the numbers) so the caller rolls back
+func enforceQuota(tx *sql.Tx, userID string, newTransfer bool) error {
+	usage, err := getStorageUsage(tx, userID)
+	if err != nil {
+		return err
+	}
+
+	maxStorageBytes, maxActiveTransfers := usage.Limits()
+	if newTransfer && usage.ActiveTransfers > maxActiveTransfers {
+		return fmt.Errorf("%w: the limit is %d active transfers", ErrTransferQuotaExceeded, maxActiveTransfers)
+	}
+	if usage.StoredBytes > maxStorageBytes {
+		return fmt.Errorf("%w: %d of %d bytes would be used", ErrStorageQuotaExceeded, usage.StoredBytes, maxStorageBytes)
+	}
+
+	return nil
+}
@@ -0,0 +1,150 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrDownloadLimitReached is returned when a recipient has used up all downloads allowed by the sender
+var ErrDownloadLimitReached = errors.New("download limit reached")
+
+// DownloadReceipt records when a recipient first and most recently completed a download
+type DownloadReceipt struct {
+	DownloadedAt     time.Time
+	LastDownloadedAt time.Time
+	DownloadCount    int
+	LimitReached     bool // The recipient has used up their downloads and their wrapped key was removed
+}
+
+// RecordChunkDownload records that a chunk of a file is being served to a recipient
+// It must be called before the chunk is sent: the recipient row is locked while the download limit
+// is checked, so parallel chunk requests cannot exceed the limit
+// When the recipient has been served every chunk, the download is recorded as complete on file_recipients
+// Returns the receipt if this chunk completed a download, nil otherwise
+func RecordChunkDownload(recipientRowID string, chunkIndex int) (*DownloadReceipt, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Lock the recipient row so that parallel chunk requests are counted one at a time
+	query := `
+		SELECT fm.total_chunks, fr.max_downloads, fr.download_count
+		FROM public.file_recipients fr
+		INNER JOIN public.file_metadata fm ON fm.file_id = fr.file_id
+		WHERE fr.id = $1
+		FOR UPDATE OF fr
+	`
+
+	var totalChunks, downloadCount int
+	var maxDownloads sql.NullInt64
+	if err := tx.QueryRow(query, recipientRowID).Scan(&totalChunks, &maxDownloads, &downloadCount); err != nil {
+		return nil, fmt.Errorf("failed to lock recipient record: %w", err)
+	}
+
+	if maxDownloads.Valid && int64(downloadCount) >= maxDownloads.Int64 {
+		return nil, ErrDownloadLimitReached
+	}
+
+	// Fetching the same chunk again within one download (e.g. a retry) is not counted twice
+	_, err = tx.Exec(`
+		INSERT INTO public.file_chunk_downloads (file_recipient_id, chunk_index)
+		VALUES ($1, $2)
+		ON CONFLICT (file_recipient_id, chunk_index) DO NOTHING
+	`, recipientRowID, chunkIndex)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record chunk download: %w", err)
+	}
+
+	var fetched int
+	err = tx.QueryRow(`SELECT COUNT(*) FROM public.file_chunk_downloads WHERE file_recipient_id = $1`, recipientRowID).Scan(&fetched)
+	if err != nil {
+		return nil, fmt.Errorf("failed to count downloaded chunks: %w", err)
+	}
+
+	if fetched < totalChunks {
+		if err = tx.Commit(); err != nil {
+			return nil, fmt.Errorf("failed to commit transaction: %w", err)
+		}
+		return nil, nil
+	}
+
+	// Every chunk has been fetched: record the download and start a fresh count for the next one
+	receipt, err := markRecipientDownloaded(tx, recipientRowID, true)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(`DELETE FROM public.file_chunk_downloads WHERE file_recipient_id = $1`, recipientRowID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reset chunk downloads: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return receipt, nil
+}
+
+// AcknowledgeDownload records a download that the recipient has explicitly confirmed
+// An acknowledgement does not count towards the recipient's download limit
+func AcknowledgeDownload(recipientRowID string) (*DownloadReceipt, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	receipt, err := markRecipientDownloaded(tx, recipientRowID, false)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return receipt, nil
+}
+
+// markRecipientDownloaded sets the download timestamps of a recipient
+// downloaded_at keeps the first completed download, last_downloaded_at always moves forward
+// If countDownload is set the download counter is incremented, and the wrapped key is wiped once
+// the counter reaches the recipient's download limit
+func markRecipientDownloaded(tx *sql.Tx, recipientRowID string, countDownload bool) (*DownloadReceipt, error) {
+	query := `
+		UPDATE public.file_recipients
+		SET downloaded_at = COALESCE(downloaded_at, NOW()),
+			last_downloaded_at = NOW(),
+			download_count = download_count + $2,
+			encrypted_file_key = CASE
+				WHEN max_downloads IS NOT NULL AND download_count + $2 >= max_downloads THEN ''
+				ELSE encrypted_file_key
+			END
+		WHERE id = $1
+		RETURNING downloaded_at, last_downloaded_at, download_count,
+			max_downloads IS NOT NULL AND download_count >= max_downloads
+	`
+
+	increment := 0
+	if countDownload {
+		increment = 1
+	}
+
+	var receipt DownloadReceipt
+	err := tx.QueryRow(query, recipientRowID, increment).Scan(
+		&receipt.DownloadedAt,
+		&receipt.LastDownloadedAt,
+		&receipt.DownloadCount,
+		&receipt.LimitReached,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record download: %w", err)
+	}
+
+	return &receipt, nil
+}
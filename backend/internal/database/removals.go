@@ -0,0 +1,227 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"secure-document-transfer/internal/models"
+
+	"github.com/lib/pq"
+)
+
+var (
+	// ErrRecipientNotFound is returned when an email is not a recipient of the file
+	ErrRecipientNotFound = errors.New("recipient not found")
+	// ErrForwardToRemovedRecipient is returned when a recipient forwards a file to someone the sender removed from it
+	ErrForwardToRemovedRecipient = errors.New("the sender removed this recipient from the file")
+)
+
+// RemoveFileRecipient deletes one recipient of a file, along with their wrapped key and download progress,
+// and records the removal. Returns ErrRecipientNotFound if the email is not a recipient of the file
+func RemoveFileRecipient(fileID, recipientEmail string) (*models.RecipientRemoval, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	removal, err := removeRecipientFromFile(tx, fileID, recipientEmail)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return removal, nil
+}
+
+// RemoveTransferRecipient removes a recipient from every file of a transfer in a single transaction, recording a
+// removal for each file as RemoveFileRecipient does. Returns the removals by file ID, or ErrRecipientNotFound if
+// the email is not a recipient of any file of the transfer
+func RemoveTransferRecipient(transferID, recipientEmail string) (map[string]models.RecipientRemoval, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	fileIDs, err := lockTransferFiles(tx, transferID)
+	if err != nil {
+		return nil, err
+	}
+
+	removals := make(map[string]models.RecipientRemoval)
+	for _, fileID := range fileIDs {
+		removal, err := removeRecipientFromFile(tx, fileID, recipientEmail)
+		if errors.Is(err, ErrRecipientNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		removals[fileID] = *removal
+	}
+	if len(removals) == 0 {
+		return nil, ErrRecipientNotFound
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return removals, nil
+}
+
+// removeRecipientFromFile deletes one recipient of a file within tx and records the removal, see RemoveFileRecipient
+func removeRecipientFromFile(tx *sql.Tx, fileID, recipientEmail string) (*models.RecipientRemoval, error) {
+	// Download progress is removed by ON DELETE CASCADE
+	var recipientID sql.NullString
+	var downloadCount int
+	err := tx.QueryRow(`
+		DELETE FROM public.file_recipients
+		WHERE file_id = $1 AND LOWER(recipient_email) = LOWER($2)
+		RETURNING recipient_id::text, download_count
+	`, fileID, recipientEmail).Scan(&recipientID, &downloadCount)
+	if err == sql.ErrNoRows {
+		return nil, ErrRecipientNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to delete file recipient: %w", err)
+	}
+
+	removal := models.RecipientRemoval{
+		Email:         strings.ToLower(recipientEmail),
+		RecipientID:   recipientID.String,
+		DownloadCount: downloadCount,
+	}
+	err = tx.QueryRow(`
+		INSERT INTO public.file_recipient_removals (file_id, recipient_id, recipient_email, download_count)
+		VALUES ($1, $2, $3, $4)
+		RETURNING removed_at
+	`, fileID, recipientID, removal.Email, downloadCount).Scan(&removal.RemovedAt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to record recipient removal: %w", err)
+	}
+
+	return &removal, nil
+}
+
+// isRemovedRecipient checks whether the sender removed the user from a file's recipients
+func isRemovedRecipient(fileID, userID, userEmail string) (bool, error) {
+	query := `
+		SELECT EXISTS(
+			SELECT 1 FROM public.file_recipient_removals
+			WHERE file_id = $1 AND (recipient_id = $2::uuid OR recipient_email = LOWER($3))
+		)
+	`
+
+	var removed bool
+	if err := DB.QueryRow(query, fileID, userID, userEmail).Scan(&removed); err != nil {
+		return false, fmt.Errorf("failed to check recipient removal: %w", err)
+	}
+
+	return removed, nil
+}
+
+// CheckRemovedRecipients checks, without locking anything, whether the sender removed any of the emails (or the
+// account registered under one of them) from a file. Returns ErrForwardToRemovedRecipient naming the first such
+// email. It lets a forward be refused before accounts are created for its recipients; ForwardFileRecipients
+// repeats the check under its lock
+func CheckRemovedRecipients(fileID string, emails []string) error {
+	lowerEmails := make([]string, len(emails))
+	for i, email := range emails {
+		lowerEmails[i] = strings.ToLower(email)
+	}
+
+	query := `
+		SELECT e.email
+		FROM unnest($2::text[]) AS e(email)
+		WHERE EXISTS (
+			SELECT 1 FROM public.file_recipient_removals r
+			WHERE r.file_id = $1
+				AND (r.recipient_email = e.email
+					OR r.recipient_id IN (SELECT u.id FROM auth.users u WHERE LOWER(u.email) = e.email))
+		)
+		LIMIT 1
+	`
+
+	var removed string
+	err := DB.QueryRow(query, fileID, pq.Array(lowerEmails)).Scan(&removed)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check recipient removals: %w", err)
+	}
+
+	return fmt.Errorf("%w: %s", ErrForwardToRemovedRecipient, removed)
+}
+
+// checkForwardedRecipients rejects forwarded recipients the sender removed from the file, matched by user ID or email
+// Only the sender may add a removed recipient back. Returns ErrForwardToRemovedRecipient naming the first such recipient
+func checkForwardedRecipients(tx *sql.Tx, fileID string, recipients []RecipientRecord) error {
+	query := `
+		SELECT EXISTS(
+			SELECT 1 FROM public.file_recipient_removals
+			WHERE file_id = $1 AND (recipient_id = $2::uuid OR recipient_email = LOWER($3))
+		)
+	`
+
+	for _, recipient := range recipients {
+		if recipient.ForwardedBy == nil {
+			continue
+		}
+
+		var recipientIDVal sql.NullString
+		if recipient.RecipientID != nil && *recipient.RecipientID != "" {
+			recipientIDVal = sql.NullString{String: *recipient.RecipientID, Valid: true}
+		}
+
+		var removed bool
+		if err := tx.QueryRow(query, fileID, recipientIDVal, recipient.Email).Scan(&removed); err != nil {
+			return fmt.Errorf("failed to check recipient removal: %w", err)
+		}
+		if removed {
+			return fmt.Errorf("%w: %s", ErrForwardToRemovedRecipient, recipient.Email)
+		}
+	}
+
+	return nil
+}
+
+// getRecipientRemovals retrieves the recipients removed from the given files, oldest removal first
+// Returns a map of file_id -> removals
+func getRecipientRemovals(fileIDs []string) (map[string][]models.RecipientRemoval, error) {
+	query := `
+		SELECT file_id, recipient_email, COALESCE(recipient_id::text, ''), download_count, removed_at
+		FROM public.file_recipient_removals
+		WHERE file_id = ANY($1)
+		ORDER BY removed_at, recipient_email
+	`
+
+	rows, err := DB.Query(query, pq.Array(fileIDs))
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve recipient removals: %w", err)
+	}
+	defer rows.Close()
+
+	removals := make(map[string][]models.RecipientRemoval)
+	for rows.Next() {
+		var fileID string
+		var removal models.RecipientRemoval
+		if err := rows.Scan(&fileID, &removal.Email, &removal.RecipientID, &removal.DownloadCount, &removal.RemovedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan recipient removal: %w", err)
+		}
+		removals[fileID] = append(removals[fileID], removal)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating recipient removals: %w", err)
+	}
+
+	return removals, nil
+}
@@ -0,0 +1,68 @@
+package database
+
+import (
+	"fmt"
+	"time"
+)
+
+// RevokeFile deletes a file's metadata, chunks and recipients and leaves a tombstone in their place
+// Storage objects must be deleted separately through the storage package
+// Returns the time the file was revoked
+func RevokeFile(fileID string) (time.Time, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// Remember who had access before the recipient rows are deleted
+	query := `
+		INSERT INTO public.file_tombstones (file_id, sender_id, original_filename, recipient_ids, recipient_emails)
+		SELECT
+			fm.file_id,
+			fm.sender_id,
+			fm.original_filename,
+			COALESCE(array_agg(fr.recipient_id) FILTER (WHERE fr.recipient_id IS NOT NULL), '{}'),
+			COALESCE(array_agg(LOWER(fr.recipient_email)) FILTER (WHERE fr.recipient_email IS NOT NULL), '{}')
+		FROM public.file_metadata fm
+		LEFT JOIN public.file_recipients fr ON fr.file_id = fm.file_id
+		WHERE fm.file_id = $1
+		GROUP BY fm.file_id, fm.sender_id, fm.original_filename
+		ON CONFLICT (file_id) DO UPDATE SET revoked_at = NOW()
+		RETURNING revoked_at
+	`
+
+	var revokedAt time.Time
+	if err := tx.QueryRow(query, fileID).Scan(&revokedAt); err != nil {
+		return time.Time{}, fmt.Errorf("failed to create file tombstone: %w", err)
+	}
+
+	// Chunks, recipients and download progress are removed by ON DELETE CASCADE
+	if _, err := tx.Exec(`DELETE FROM public.file_metadata WHERE file_id = $1`, fileID); err != nil {
+		return time.Time{}, fmt.Errorf("failed to delete file metadata: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return time.Time{}, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return revokedAt, nil
+}
+
+// isRevokedForUser checks whether a file was revoked and the user was its sender or one of its recipients
+func isRevokedForUser(fileID, userID, userEmail string) (bool, error) {
+	query := `
+		SELECT EXISTS(
+			SELECT 1 FROM public.file_tombstones
+			WHERE file_id = $1
+				AND (sender_id = $2::uuid OR $2::uuid = ANY(recipient_ids) OR LOWER($3) = ANY(recipient_emails))
+		)
+	`
+
+	var revoked bool
+	if err := DB.QueryRow(query, fileID, userID, userEmail).Scan(&revoked); err != nil {
+		return false, fmt.Errorf("failed to check file tombstone: %w", err)
+	}
+
+	return revoked, nil
+}
@@ -0,0 +1,314 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"secure-document-transfer/internal/models"
+)
+
+var (
+	// ErrTransferNotFound is returned when no transfer exists with the requested transfer ID
+	ErrTransferNotFound = errors.New("transfer not found")
+	// ErrTransferFilesChanged is returned when recipients are added for a different set of files than the transfer has
+	ErrTransferFilesChanged = errors.New("the files of the transfer have changed")
+)
+
+// TransferFileRecord describes one file to be created as part of a transfer
+type TransferFileRecord struct {
+	RelativePath     string
+	OriginalFilename string
+	FileSize         int64
+	TotalChunks      int
+	MimeType         string
+	Recipients       []RecipientRecord // The transfer's recipients with this file's wrapped keys
+}
+
+// TransferRecord represents a row of the transfers table
+type TransferRecord struct {
+	ID          string
+	SenderID    string
+	SenderEmail string
+	ExpiresAt   time.Time
+	CreatedAt   time.Time
+}
+
+// TransferFileRecipients holds the recipients to add to one file of a transfer, with that file's wrapped keys
+// ForwarderRowID is the forwarding recipient's file_recipients row of the file when the recipients are forwarded
+type TransferFileRecipients struct {
+	FileID         string
+	ForwarderRowID string
+	Recipients     []RecipientRecord
+}
+
+// CreateTransfer creates a transfer and all of its files and recipients in a single transaction
+// Returns the server-issued transfer ID and the file IDs in the order of files. The expected ciphertext size of
+// every file is reserved against the sender's storage quota; returns ErrStorageQuotaExceeded or
+// ErrTransferQuotaExceeded if the sender has no room for the transfer
+func CreateTransfer(senderID string, expiresAt time.Time, forwardPolicy string, files []TransferFileRecord) (string, []string, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if err := lockQuota(tx, senderID); err != nil {
+		return "", nil, err
+	}
+
+	var transferID string
+	err = tx.QueryRow(`
+		INSERT INTO public.transfers (sender_id, expires_at)
+		VALUES ($1, $2)
+		RETURNING id::text
+	`, senderID, expiresAt).Scan(&transferID)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create transfer: %w", err)
+	}
+
+	stmt, err := tx.Prepare(`
+		INSERT INTO public.file_metadata
+			(sender_id, original_filename, file_size, total_chunks, mime_type, expires_at, forward_policy, transfer_id, relative_path)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING file_id
+	`)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to prepare statement: %w", err)
+	}
+	defer stmt.Close()
+
+	fileIDs := make([]string, len(files))
+	for i, file := range files {
+		var mimeTypeVal sql.NullString
+		if file.MimeType != "" {
+			mimeTypeVal = sql.NullString{String: file.MimeType, Valid: true}
+		}
+
+		err = stmt.QueryRow(senderID, file.OriginalFilename, file.FileSize, file.TotalChunks, mimeTypeVal,
+			expiresAt, forwardPolicy, transferID, file.RelativePath).Scan(&fileIDs[i])
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to create file metadata for %s: %w", file.RelativePath, err)
+		}
+
+		if _, err := insertRecipients(tx, fileIDs[i], file.Recipients); err != nil {
+			return "", nil, err
+		}
+	}
+
+	if err := enforceQuota(tx, senderID, true); err != nil {
+		return "", nil, err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return "", nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return transferID, fileIDs, nil
+}
+
+// AddTransferRecipients adds recipients to every file of a transfer in a single transaction, so the files keep
+// sharing one recipient list. Each file is handled as by AddFileRecipients or, if it has a ForwarderRowID, by
+// ForwardFileRecipients, and any of their errors rolls back every file. files must cover exactly the transfer's
+// current files, otherwise ErrTransferFilesChanged is returned. Returns the emails that were added to any file
+func AddTransferRecipients(transferID string, files []TransferFileRecipients) ([]string, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	fileIDs, err := lockTransferFiles(tx, transferID)
+	if err != nil {
+		return nil, err
+	}
+	requested := make(map[string]bool, len(files))
+	for _, file := range files {
+		requested[file.FileID] = true
+	}
+	if len(requested) != len(fileIDs) {
+		return nil, ErrTransferFilesChanged
+	}
+	for _, fileID := range fileIDs {
+		if !requested[fileID] {
+			return nil, ErrTransferFilesChanged
+		}
+	}
+
+	// Add in file ID order, the order the files were locked in, so concurrent forwards cannot deadlock
+	sort.Slice(files, func(a, b int) bool { return files[a].FileID < files[b].FileID })
+
+	added := []string{}
+	seen := make(map[string]bool)
+	for _, file := range files {
+		fileAdded, err := addRecipientsToFile(tx, file.FileID, file.ForwarderRowID, file.Recipients)
+		if err != nil {
+			return nil, err
+		}
+		for _, email := range fileAdded {
+			if !seen[email] {
+				seen[email] = true
+				added = append(added, email)
+			}
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return added, nil
+}
+
+// lockTransferFiles share-locks the files of a transfer, so none can be revoked while the transaction changes
+// their recipients, and returns their IDs. Returns ErrTransferNotFound if the transfer has no files left
+func lockTransferFiles(tx *sql.Tx, transferID string) ([]string, error) {
+	rows, err := tx.Query(`
+		SELECT file_id
+		FROM public.file_metadata
+		WHERE transfer_id = $1::uuid
+		ORDER BY file_id
+		FOR SHARE
+	`, transferID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock transfer files: %w", err)
+	}
+	defer rows.Close()
+
+	var fileIDs []string
+	for rows.Next() {
+		var fileID string
+		if err := rows.Scan(&fileID); err != nil {
+			return nil, fmt.Errorf("failed to scan transfer file: %w", err)
+		}
+		fileIDs = append(fileIDs, fileID)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating transfer files: %w", err)
+	}
+	if len(fileIDs) == 0 {
+		return nil, ErrTransferNotFound
+	}
+
+	return fileIDs, nil
+}
+
+// GetTransfer retrieves a transfer and the IDs of its files, ordered by relative path
+// Returns ErrTransferNotFound if no transfer exists with the given transfer ID
+func GetTransfer(transferID string) (*TransferRecord, []string, error) {
+	var transfer TransferRecord
+	err := DB.QueryRow(`
+		SELECT t.id::text, t.sender_id::text, COALESCE(su.email, ''), t.expires_at, t.created_at
+		FROM public.transfers t
+		LEFT JOIN auth.users su ON su.id = t.sender_id
+		WHERE t.id = $1::uuid
+	`, transferID).Scan(&transfer.ID, &transfer.SenderID, &transfer.SenderEmail, &transfer.ExpiresAt, &transfer.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil, ErrTransferNotFound
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to retrieve transfer: %w", err)
+	}
+
+	rows, err := DB.Query(`
+		SELECT file_id
+		FROM public.file_metadata
+		WHERE transfer_id = $1::uuid
+		ORDER BY relative_path
+	`, transferID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to retrieve transfer files: %w", err)
+	}
+	defer rows.Close()
+
+	var fileIDs []string
+	for rows.Next() {
+		var fileID string
+		if err := rows.Scan(&fileID); err != nil {
+			return nil, nil, fmt.Errorf("failed to scan transfer file: %w", err)
+		}
+		fileIDs = append(fileIDs, fileID)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("error iterating transfer files: %w", err)
+	}
+
+	return &transfer, fileIDs, nil
+}
+
+// GetTransfers retrieves a page of transfers sent by the user or shared with them
+// Recipients are matched by user ID or email and only see transfers with at least one completed file
+func GetTransfers(userID, userEmail string, limit, offset int) ([]models.Transfer, int, error) {
+	visible := `
+		(t.sender_id = $1::uuid OR EXISTS (
+			SELECT 1
+			FROM public.file_metadata rfm
+			INNER JOIN public.file_recipients fr ON fr.file_id = rfm.file_id
+			WHERE rfm.transfer_id = t.id
+				AND rfm.completed_at IS NOT NULL
+				AND (fr.recipient_id = $1::uuid OR LOWER(fr.recipient_email) = LOWER($2))
+		))
+	`
+
+	var total int
+	countQuery := `SELECT COUNT(*) FROM public.transfers t WHERE ` + visible
+	if err := DB.QueryRow(countQuery, userID, userEmail).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("failed to count transfers: %w", err)
+	}
+
+	query := `
+		SELECT
+			t.id::text,
+			t.sender_id::text,
+			COALESCE(su.email, ''),
+			t.created_at,
+			t.expires_at,
+			t.expires_at <= NOW(),
+			COUNT(fm.file_id),
+			COALESCE(SUM(fm.file_size), 0),
+			COUNT(fm.file_id) > 0 AND COUNT(fm.file_id) = COUNT(fm.completed_at)
+		FROM public.transfers t
+		LEFT JOIN public.file_metadata fm ON fm.transfer_id = t.id
+		LEFT JOIN auth.users su ON su.id = t.sender_id
+		WHERE ` + visible + `
+		GROUP BY t.id, su.email
+		ORDER BY t.created_at DESC, t.id
+		LIMIT $3 OFFSET $4
+	`
+
+	rows, err := DB.Query(query, userID, userEmail, limit, offset)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to retrieve transfers: %w", err)
+	}
+	defer rows.Close()
+
+	transfers := []models.Transfer{}
+	for rows.Next() {
+		var transfer models.Transfer
+		if err := rows.Scan(
+			&transfer.TransferID,
+			&transfer.Sender.ID,
+			&transfer.Sender.Email,
+			&transfer.CreatedAt,
+			&transfer.ExpiresAt,
+			&transfer.Expired,
+			&transfer.FileCount,
+			&transfer.TotalSize,
+			&transfer.Completed,
+		); err != nil {
+			return nil, 0, fmt.Errorf("failed to scan transfer: %w", err)
+		}
+		transfer.IsSender = transfer.Sender.ID == userID
+		transfers = append(transfers, transfer)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, 0, fmt.Errorf("error iterating transfers: %w", err)
+	}
+
+	return transfers, total, nil
+}
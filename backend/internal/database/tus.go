@@ -0,0 +1,154 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var (
+	// ErrTusUploadNotFound is returned when a tus upload does not exist
+	ErrTusUploadNotFound = errors.New("tus upload not found")
+	// ErrTusOffsetMismatch is returned when a tus PATCH does not start at the upload's current offset
+	ErrTusOffsetMismatch = errors.New("tus upload offset mismatch")
+)
+
+// TusUpload represents a tus resumable upload of one encrypted chunk
+type TusUpload struct {
+	ID            string
+	FileID        string
+	SenderID      string
+	ChunkIndex    int
+	EncryptionIV  string
+	ContentSHA256 string // Optional client checksum
+	UploadLength  int64
+	UploadOffset  int64
+	SegmentPaths  []string
+	CreatedAt     time.Time
+}
+
+// CreateTusUpload creates a new tus upload and returns its ID
+// The full Upload-Length counts towards the sender's storage quota until the upload is completed or removed
+// Returns ErrFileExpired if the file's expiry has passed and ErrStorageQuotaExceeded if the sender has no room for it
+func CreateTusUpload(upload TusUpload) (string, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return "", fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, _, err := lockFileForUpload(tx, upload.FileID); err != nil {
+		return "", err
+	}
+	if err := lockQuota(tx, upload.SenderID); err != nil {
+		return "", err
+	}
+
+	query := `
+		INSERT INTO public.tus_uploads (file_id, sender_id, chunk_index, encryption_iv, content_sha256, upload_length)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''), $6)
+		RETURNING id::text
+	`
+
+	var id string
+	err = tx.QueryRow(query, upload.FileID, upload.SenderID, upload.ChunkIndex, upload.EncryptionIV, upload.ContentSHA256, upload.UploadLength).Scan(&id)
+	if err != nil {
+		return "", fmt.Errorf("failed to create tus upload: %w", err)
+	}
+
+	if err := enforceQuota(tx, upload.SenderID, false); err != nil {
+		return "", err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return "", fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return id, nil
+}
+
+// GetTusUpload retrieves a tus upload by ID
+// Returns ErrTusUploadNotFound if it does not exist
+func GetTusUpload(id string) (*TusUpload, error) {
+	query := `
+		SELECT id::text, file_id, sender_id::text, chunk_index, encryption_iv, COALESCE(content_sha256, ''),
+			upload_length, upload_offset, segment_paths, created_at
+		FROM public.tus_uploads
+		WHERE id = $1::uuid
+	`
+
+	var upload TusUpload
+	err := DB.QueryRow(query, id).Scan(
+		&upload.ID,
+		&upload.FileID,
+		&upload.SenderID,
+		&upload.ChunkIndex,
+		&upload.EncryptionIV,
+		&upload.ContentSHA256,
+		&upload.UploadLength,
+		&upload.UploadOffset,
+		pq.Array(&upload.SegmentPaths),
+		&upload.CreatedAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, ErrTusUploadNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve tus upload: %w", err)
+	}
+
+	return &upload, nil
+}
+
+// AppendTusSegment records a segment of received bytes of an upload of fileID and advances the upload offset
+// expectedOffset must still be the upload's offset, otherwise ErrTusOffsetMismatch is returned
+// (another PATCH got there first). Returns ErrFileExpired if the file's expiry has passed, otherwise the new offset
+func AppendTusSegment(fileID, id string, expectedOffset, size int64, storagePath string) (int64, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, _, err := lockFileForUpload(tx, fileID); err != nil {
+		return 0, err
+	}
+
+	query := `
+		UPDATE public.tus_uploads
+		SET upload_offset = upload_offset + $4,
+			segment_paths = array_append(segment_paths, $5),
+			updated_at = NOW()
+		WHERE id = $1::uuid AND file_id = $2 AND upload_offset = $3 AND upload_offset + $4 <= upload_length
+		RETURNING upload_offset
+	`
+
+	var offset int64
+	err = tx.QueryRow(query, id, fileID, expectedOffset, size, storagePath).Scan(&offset)
+	if err == sql.ErrNoRows {
+		return 0, ErrTusOffsetMismatch
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to record tus segment: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %w", err)
+	}
+
+	return offset, nil
+}
+
+// DeleteTusUpload deletes a tus upload record
+// The caller is responsible for deleting its segment objects
+func DeleteTusUpload(id string) error {
+	_, err := DB.Exec(`DELETE FROM public.tus_uploads WHERE id = $1::uuid`, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete tus upload: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,209 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+
+	"secure-document-transfer/internal/config"
+	"secure-document-transfer/internal/database"
+	"secure-document-transfer/internal/models"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// maxBatchChunks is the largest number of chunks accepted in one batch upload
+	maxBatchChunks = 32
+	// maxManifestBytes is the largest manifest part accepted in a batch upload
+	maxManifestBytes = 64 << 10
+)
+
+// UploadChunkBatchHandler uploads several encrypted chunks of a file in one multipart request
+// The first part is a JSON "manifest" listing the chunks; each chunk follows as a part named chunk_<index>
+// in manifest order and is streamed straight to storage. All rows are inserted in one transaction and
+// the response carries a status for every chunk
+func UploadChunkBatchHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fileID := mux.Vars(r)["file_id"]
+
+		access, ok := authorizeFileAccess(w, r, fileID)
+		if !ok || !requireNotExpired(w, access) {
+			return
+		}
+
+		if !access.IsSender {
+			RespondWithError(w, http.StatusForbidden, "Only the sender can upload chunks to this file", "")
+			return
+		}
+
+		maxBytes := config.MaxBatchUploadBytes()
+		r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+
+		reader, err := r.MultipartReader()
+		if err != nil {
+			RespondWithError(w, http.StatusBadRequest, "Failed to parse form data", err.Error())
+			return
+		}
+
+		manifest, err := readBatchManifest(reader)
+		if err != nil {
+			if isBodyTooLarge(err) {
+				RespondWithError(w, http.StatusRequestEntityTooLarge, "Request body too large", err.Error())
+				return
+			}
+			RespondWithError(w, http.StatusBadRequest, "Invalid manifest", err.Error())
+			return
+		}
+		for _, entry := range manifest.Chunks {
+			if entry.SHA256 != "" && !isSHA256Hex(entry.SHA256) {
+				RespondWithError(w, http.StatusBadRequest, "Invalid sha256", fmt.Sprintf("Chunk %d: sha256 must be hex-encoded", entry.ChunkIndex))
+				return
+			}
+			if len(entry.IdempotencyKey) > maxIdempotencyKeyLength {
+				RespondWithError(w, http.StatusBadRequest, "Idempotency key is too long", fmt.Sprintf("Chunk %d", entry.ChunkIndex))
+				return
+			}
+		}
+
+		metadata, err := database.GetFileMetadata(fileID)
+		if err != nil {
+			log.Printf("Error retrieving metadata for file %s: %v", fileID, err)
+			RespondWithError(w, http.StatusInternalServerError, "Failed to retrieve file metadata", err.Error())
+			return
+		}
+
+		// The file's space was reserved when it was created; the chunks are checked again when they are recorded
+		if !requireQuota(w, metadata.SenderID, 0, false) {
+			return
+		}
+
+		results := make([]chunkResult, len(manifest.Chunks))
+		uploads := make([]chunkUpload, len(manifest.Chunks))
+		var staged []database.FileChunk
+		var stagedPositions []int
+
+		// Stream each chunk to storage; the rows are recorded together afterwards
+		var readErr error
+		for i, entry := range manifest.Chunks {
+			uploads[i] = chunkUpload{
+				FileID:         fileID,
+				ChunkIndex:     entry.ChunkIndex,
+				IV:             entry.IV,
+				ClientSHA256:   entry.SHA256,
+				IdempotencyKey: entry.IdempotencyKey,
+			}
+
+			if readErr != nil {
+				results[i] = failedChunk(http.StatusBadRequest, "Chunk part missing", readErr.Error())
+				continue
+			}
+
+			part, err := reader.NextPart()
+			if err != nil {
+				if err == io.EOF {
+					err = fmt.Errorf("request ended before chunk_%d", entry.ChunkIndex)
+				}
+				readErr = err
+				results[i] = readFailure(err)
+				continue
+			}
+			if part.FormName() != fmt.Sprintf("chunk_%d", entry.ChunkIndex) {
+				part.Close()
+				readErr = fmt.Errorf("expected part chunk_%d, got %q", entry.ChunkIndex, part.FormName())
+				results[i] = failedChunk(http.StatusBadRequest, "Chunk parts must follow the manifest order", readErr.Error())
+				continue
+			}
+
+			chunk, result := stageChunk(metadata, uploads[i], part)
+			part.Close()
+			if result != nil {
+				results[i] = *result
+				if result.Status == http.StatusRequestEntityTooLarge {
+					readErr = fmt.Errorf("request body too large")
+				}
+				continue
+			}
+			staged = append(staged, *chunk)
+			stagedPositions = append(stagedPositions, i)
+		}
+
+		if len(staged) > 0 {
+			inserted, err := database.CreateFileChunks(fileID, staged)
+			for j, chunk := range staged {
+				i := stagedPositions[j]
+				if err != nil {
+					discardChunk(chunk.StoragePath)
+					results[i] = recordFailure(err)
+					continue
+				}
+				results[i] = recordedChunkResult(chunk, uploads[i], inserted[j])
+			}
+		}
+
+		response := models.BatchUploadResponse{
+			FileID:      fileID,
+			TotalChunks: metadata.TotalChunks,
+			Chunks:      make([]models.BatchChunkStatus, len(results)),
+		}
+		for i, result := range results {
+			status := models.BatchChunkStatus{
+				ChunkIndex:    manifest.Chunks[i].ChunkIndex,
+				Status:        result.Status,
+				Error:         result.Error,
+				Details:       result.Details,
+				AlreadyStored: result.AlreadyStored,
+			}
+			if result.Chunk != nil {
+				status.StoragePath = result.Chunk.StoragePath
+			}
+			if result.Status == http.StatusOK {
+				response.Stored++
+			} else {
+				response.Failed++
+			}
+			response.Chunks[i] = status
+		}
+
+		log.Printf("Batch upload for file %s: %d stored, %d failed", fileID, response.Stored, response.Failed)
+
+		RespondWithJSON(w, http.StatusOK, response)
+	}
+}
+
+// readBatchManifest reads and validates the manifest part, which must be the first part of a batch upload
+func readBatchManifest(reader *multipart.Reader) (*models.BatchUploadManifest, error) {
+	part, err := reader.NextPart()
+	if err == io.EOF {
+		return nil, fmt.Errorf("missing manifest part")
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer part.Close()
+
+	if part.FormName() != "manifest" {
+		return nil, fmt.Errorf("the first part must be the manifest, got %q", part.FormName())
+	}
+
+	data, err := io.ReadAll(io.LimitReader(part, maxManifestBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxManifestBytes {
+		return nil, fmt.Errorf("manifest is too long")
+	}
+
+	var manifest models.BatchUploadManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, err
+	}
+	if err := manifest.Validate(maxBatchChunks); err != nil {
+		return nil, err
+	}
+
+	return &manifest, nil
+}
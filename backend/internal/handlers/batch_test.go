@@ -0,0 +1,43 @@
+package handlers
+
+import (
+	"testing"
+)
+
+func TestReadBatchManifest(t *testing.T) {
+	manifest := `{"chunks":[{"chunk_index":0,"iv":"aXY="},{"chunk_index":1,"iv":"aXY=","sha256":"ABC"}]}`
+	reader := buildMultipart(t, [][2]string{{"manifest", manifest}}, "chunk_0", []byte("x"))
+
+	got, err := readBatchManifest(reader)
+	if err != nil {
+		t.Fatalf("readBatchManifest failed: %v", err)
+	}
+	if len(got.Chunks) != 2 || got.Chunks[1].ChunkIndex != 1 {
+		t.Errorf("unexpected manifest: %+v", got)
+	}
+	if got.Chunks[1].SHA256 != "abc" {
+		t.Errorf("sha256 = %q, want it lowercased", got.Chunks[1].SHA256)
+	}
+}
+
+func TestReadBatchManifestRejects(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields [][2]string
+	}{
+		{name: "manifest not first", fields: [][2]string{{"other", "x"}, {"manifest", `{"chunks":[{"chunk_index":0,"iv":"aXY="}]}`}}},
+		{name: "invalid json", fields: [][2]string{{"manifest", `{"chunks":`}}},
+		{name: "no chunks", fields: [][2]string{{"manifest", `{"chunks":[]}`}}},
+		{name: "missing iv", fields: [][2]string{{"manifest", `{"chunks":[{"chunk_index":0}]}`}}},
+		{name: "duplicate index", fields: [][2]string{{"manifest", `{"chunks":[{"chunk_index":2,"iv":"a"},{"chunk_index":2,"iv":"b"}]}`}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := buildMultipart(t, tt.fields, "chunk_0", []byte("x"))
+			if _, err := readBatchManifest(reader); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
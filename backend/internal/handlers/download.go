@@ -0,0 +1,293 @@
+package handlers
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"secure-document-transfer/internal/crypto"
+	"secure-document-transfer/internal/database"
+	"secure-document-transfer/internal/models"
+	"secure-document-transfer/internal/storage"
+
+	"github.com/gorilla/mux"
+)
+
+// authorizeFileAccess checks that the authenticated user is the sender or a recipient of the file
+// On failure it writes the error response and returns false
+func authorizeFileAccess(w http.ResponseWriter, r *http.Request, fileID string) (*database.FileAccess, bool) {
+	userID := r.Context().Value("user_id")
+	userEmail := r.Context().Value("user_email")
+	if userID == nil || userEmail == nil {
+		RespondWithError(w, http.StatusUnauthorized, "User not authenticated", "")
+		return nil, false
+	}
+
+	if !models.IsValidFileID(fileID) {
+		RespondWithError(w, http.StatusBadRequest, "Invalid file ID", "")
+		return nil, false
+	}
+
+	access, err := database.GetFileAccess(fileID, userID.(string), userEmail.(string))
+	switch {
+	case errors.Is(err, database.ErrFileNotFound):
+		RespondWithError(w, http.StatusNotFound, "File not found", "")
+		return nil, false
+	case errors.Is(err, database.ErrFileRevoked):
+		RespondWithError(w, http.StatusGone, "File has been revoked by the sender", "")
+		return nil, false
+	case errors.Is(err, database.ErrRecipientRemoved):
+		RespondWithError(w, http.StatusForbidden, "Your access to this file was removed by the sender", "")
+		return nil, false
+	case errors.Is(err, database.ErrFileAccessDenied):
+		RespondWithError(w, http.StatusForbidden, "You do not have access to this file", "")
+		return nil, false
+	case err != nil:
+		log.Printf("Error checking access to file %s: %v", fileID, err)
+		RespondWithError(w, http.StatusInternalServerError, "Failed to check file access", err.Error())
+		return nil, false
+	}
+
+	// Recipients only see a file once the sender has finished uploading it
+	if !access.IsSender && !access.Completed {
+		RespondWithError(w, http.StatusConflict, "File upload is not complete yet", "")
+		return nil, false
+	}
+
+	return access, true
+}
+
+// requireNotExpired rejects requests for files whose expiry has passed
+// On failure it writes the error response and returns false
+func requireNotExpired(w http.ResponseWriter, access *database.FileAccess) bool {
+	if access.Expired {
+		RespondWithError(w, http.StatusGone, "File has expired", "")
+		return false
+	}
+	return true
+}
+
+// requireDownloadsRemaining rejects recipients who have used up their download limit
+// On failure it writes the error response and returns false
+func requireDownloadsRemaining(w http.ResponseWriter, access *database.FileAccess) bool {
+	if access.DownloadLimitReached() {
+		RespondWithError(w, http.StatusForbidden, "Download limit reached", "")
+		return false
+	}
+	return true
+}
+
+// GetFileManifestHandler returns the metadata, ordered chunk list and the caller's wrapped key for a file
+func GetFileManifestHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fileID := mux.Vars(r)["file_id"]
+
+		access, ok := authorizeFileAccess(w, r, fileID)
+		if !ok || !requireNotExpired(w, access) || !requireDownloadsRemaining(w, access) {
+			return
+		}
+
+		metadata, err := database.GetFileMetadata(fileID)
+		if err != nil {
+			log.Printf("Error retrieving metadata for file %s: %v", fileID, err)
+			RespondWithError(w, http.StatusInternalServerError, "Failed to retrieve file metadata", err.Error())
+			return
+		}
+
+		manifest, err := buildFileManifest(metadata, access)
+		if err != nil {
+			log.Printf("Error building manifest for file %s: %v", fileID, err)
+			RespondWithError(w, http.StatusInternalServerError, "Failed to build file manifest", err.Error())
+			return
+		}
+
+		RespondWithJSON(w, http.StatusOK, manifest)
+	}
+}
+
+// buildFileManifest builds the manifest of a file for a caller with the given access
+// Once the upload is finalized every chunk comes with its inclusion proof under the Merkle root,
+// so recipients can verify chunks one at a time while streaming
+func buildFileManifest(metadata *database.FileMetadata, access *database.FileAccess) (*models.FileManifest, error) {
+	chunks, err := database.GetFileChunks(metadata.FileID)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := models.FileManifest{
+		FileID:           metadata.FileID,
+		OriginalFilename: metadata.OriginalFilename,
+		RelativePath:     metadata.RelativePath.String,
+		TransferID:       metadata.TransferID.String,
+		FileSize:         metadata.FileSize,
+		MimeType:         metadata.MimeType.String,
+		TotalChunks:      metadata.TotalChunks,
+		SenderID:         metadata.SenderID,
+		CreatedAt:        metadata.CreatedAt,
+		ExpiresAt:        metadata.ExpiresAt,
+		ForwardPolicy:    metadata.ForwardPolicy,
+		EncryptedFileKey: access.EncryptedFileKey,
+		Chunks:           make([]models.ManifestChunk, len(chunks)),
+	}
+	if metadata.CompletedAt.Valid {
+		manifest.CompletedAt = &metadata.CompletedAt.Time
+	}
+	for i, chunk := range chunks {
+		manifest.Chunks[i] = models.ManifestChunk{
+			ChunkIndex:   chunk.ChunkIndex,
+			ChunkSize:    chunk.ChunkSize,
+			StoragePath:  chunk.StoragePath,
+			EncryptionIV: chunk.EncryptionIV,
+			SHA256:       chunk.ContentSHA256,
+		}
+	}
+
+	if metadata.MerkleRoot.Valid {
+		proofs, err := chunkInclusionProofs(chunks)
+		if err != nil {
+			return nil, err
+		}
+		manifest.MerkleRoot = metadata.MerkleRoot.String
+		for i := range manifest.Chunks {
+			manifest.Chunks[i].Proof = proofs[i]
+		}
+	}
+
+	return &manifest, nil
+}
+
+// chunkInclusionProofs builds the hex Merkle inclusion proof of every chunk
+// chunks must be the complete chunk list of a finalized file, ordered by index
+func chunkInclusionProofs(chunks []database.FileChunk) ([][]string, error) {
+	chunkHashes := make([][]byte, len(chunks))
+	for i, chunk := range chunks {
+		chunkHash, err := hex.DecodeString(chunk.ContentSHA256)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hash for chunk %d: %w", chunk.ChunkIndex, err)
+		}
+		chunkHashes[i] = chunkHash
+	}
+
+	tree := crypto.NewMerkleTree(chunkHashes)
+	proofs := make([][]string, len(chunks))
+	for i := range chunks {
+		proof := tree.Proof(i)
+		proofs[i] = make([]string, len(proof))
+		for j, sibling := range proof {
+			proofs[i][j] = hex.EncodeToString(sibling)
+		}
+	}
+
+	return proofs, nil
+}
+
+// DownloadChunkHandler streams a single encrypted chunk to an authorized user
+// The ciphertext is copied straight from storage to the response without being buffered
+func DownloadChunkHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		fileID := vars["file_id"]
+
+		chunkIndex, err := strconv.Atoi(vars["index"])
+		if err != nil || chunkIndex < 0 {
+			RespondWithError(w, http.StatusBadRequest, "Invalid chunk index", "")
+			return
+		}
+
+		access, ok := authorizeFileAccess(w, r, fileID)
+		if !ok || !requireNotExpired(w, access) {
+			return
+		}
+
+		chunk, err := database.GetFileChunk(fileID, chunkIndex)
+		if errors.Is(err, database.ErrChunkNotFound) {
+			RespondWithError(w, http.StatusNotFound, "Chunk not found", "")
+			return
+		}
+		if err != nil {
+			log.Printf("Error retrieving chunk %d of file %s: %v", chunkIndex, fileID, err)
+			RespondWithError(w, http.StatusInternalServerError, "Failed to retrieve chunk metadata", err.Error())
+			return
+		}
+
+		// Recipients' chunk requests are counted before streaming so the download limit holds
+		// even when chunks are requested in parallel; a download counts once every chunk has been served
+		if access.IsRecipient {
+			receipt, err := database.RecordChunkDownload(access.RecipientRowID, chunkIndex)
+			if errors.Is(err, database.ErrDownloadLimitReached) {
+				RespondWithError(w, http.StatusForbidden, "Download limit reached", "")
+				return
+			}
+			if err != nil {
+				log.Printf("Error recording download of chunk %d of file %s: %v", chunkIndex, fileID, err)
+				RespondWithError(w, http.StatusInternalServerError, "Failed to record download", err.Error())
+				return
+			}
+			if receipt != nil {
+				log.Printf("Recipient %s completed download %d of file %s (first download: %s)",
+					r.Context().Value("user_email"), receipt.DownloadCount, fileID, receipt.DownloadedAt.Format(time.RFC3339))
+				if receipt.LimitReached {
+					log.Printf("Recipient %s reached the download limit of file %s, wrapped key removed",
+						r.Context().Value("user_email"), fileID)
+				}
+			}
+		}
+
+		body, size, err := storage.DownloadEncryptedChunk(chunk.StoragePath)
+		if err != nil {
+			log.Printf("Error downloading chunk from storage: %v", err)
+			RespondWithError(w, http.StatusBadGateway, "Failed to download chunk", err.Error())
+			return
+		}
+		defer body.Close()
+
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Cache-Control", "no-store")
+		if size >= 0 {
+			w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		}
+		w.WriteHeader(http.StatusOK)
+
+		// Headers are already sent, so a failure here can only be logged
+		if _, err := io.Copy(w, body); err != nil {
+			log.Printf("Error streaming chunk %d of file %s: %v", chunkIndex, fileID, err)
+		}
+	}
+}
+
+// AcknowledgeDownloadHandler lets a recipient explicitly confirm that they have downloaded a file
+func AcknowledgeDownloadHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fileID := mux.Vars(r)["file_id"]
+
+		access, ok := authorizeFileAccess(w, r, fileID)
+		if !ok {
+			return
+		}
+
+		if !access.IsRecipient {
+			RespondWithError(w, http.StatusForbidden, "Only recipients can acknowledge a download", "")
+			return
+		}
+
+		receipt, err := database.AcknowledgeDownload(access.RecipientRowID)
+		if err != nil {
+			log.Printf("Error acknowledging download of file %s: %v", fileID, err)
+			RespondWithError(w, http.StatusInternalServerError, "Failed to record download", err.Error())
+			return
+		}
+
+		log.Printf("Recipient %s acknowledged download of file %s", r.Context().Value("user_email"), fileID)
+
+		RespondWithJSON(w, http.StatusOK, models.DownloadReceiptResponse{
+			FileID:           fileID,
+			DownloadedAt:     receipt.DownloadedAt,
+			LastDownloadedAt: receipt.LastDownloadedAt,
+		})
+	}
+}
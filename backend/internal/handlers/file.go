@@ -1,26 +1,25 @@
 package handlers
 
 import (
-	"encoding/json"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"strconv"
 	"strings"
-	"sync"
+	"time"
 
+	"secure-document-transfer/internal/config"
 	"secure-document-transfer/internal/database"
-	"secure-document-transfer/internal/storage"
+	"secure-document-transfer/internal/models"
 )
 
-// Mutex for synchronizing file metadata and recipient creation
-// This prevents race conditions when chunks are uploaded concurrently
-var (
-	fileMetadataLock sync.Mutex
-	fileMetadataMap  = make(map[string]bool) // tracks which files have had metadata created
-)
-
-	// SendFileChunkHandler handles encrypted file chunk uploads
-func SendFileChunkHandler() http.HandlerFunc {
+// CreateFileHandler starts a file upload
+// It creates the file metadata and all recipients once, in a single transaction, and returns the
+// server-issued file ID that the chunk uploads refer to
+func CreateFileHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// Get authenticated user ID
 		userID := r.Context().Value("user_id")
@@ -29,249 +28,275 @@ func SendFileChunkHandler() http.HandlerFunc {
 			return
 		}
 		senderID := userID.(string)
-		
-		// Get user token for authenticated storage operations
-		userToken := r.Context().Value("user_token")
-		if userToken == nil {
-			RespondWithError(w, http.StatusUnauthorized, "User token not found", "")
+
+		var req models.CreateFileRequest
+		if err := parseJSON(r, &req); err != nil {
+			RespondWithError(w, http.StatusBadRequest, "Invalid request body", err.Error())
 			return
 		}
-		token := userToken.(string)
 
-		// Parse multipart form (10MB max memory)
-		err := r.ParseMultipartForm(10 << 20)
-		if err != nil {
-			RespondWithError(w, http.StatusBadRequest, "Failed to parse form data", err.Error())
+		if err := req.Validate(); err != nil {
+			RespondWithError(w, http.StatusBadRequest, err.Error(), "")
 			return
 		}
 
-		// Extract form fields
-		fileID := r.FormValue("file_id")
-		chunkIndexStr := r.FormValue("chunk_index")
-		totalChunksStr := r.FormValue("total_chunks")
-		originalFilename := r.FormValue("original_filename")
-		fileSizeStr := r.FormValue("file_size")
-		chunkSizeStr := r.FormValue("chunk_size")
-		iv := r.FormValue("iv")
-		encryptedKeysJSON := r.FormValue("encrypted_keys")
-		mimeType := r.FormValue("mime_type")
-
-	// Validate required fields
-	var missingFields []string
-	if fileID == "" {
-		missingFields = append(missingFields, "file_id")
-	}
-	if chunkIndexStr == "" {
-		missingFields = append(missingFields, "chunk_index")
-	}
-	if totalChunksStr == "" {
-		missingFields = append(missingFields, "total_chunks")
-	}
-	if originalFilename == "" {
-		missingFields = append(missingFields, "original_filename")
-	}
-	if fileSizeStr == "" {
-		missingFields = append(missingFields, "file_size")
-	}
-	if chunkSizeStr == "" {
-		missingFields = append(missingFields, "chunk_size")
-	}
-	if iv == "" {
-		missingFields = append(missingFields, "iv")
-	}
-	if encryptedKeysJSON == "" {
-		missingFields = append(missingFields, "encrypted_keys")
-	}
-	if len(missingFields) > 0 {
-		RespondWithError(w, http.StatusBadRequest, "Missing required fields: "+strings.Join(missingFields, ", "), "")
-		return
-	}
-
-		// Parse numeric values
-		chunkIndex, err := strconv.Atoi(chunkIndexStr)
+		// Resolve the transfer expiry chosen by the sender (or the server default)
+		expiresAt, err := resolveExpiry(req.ExpiresAt, time.Now(), config.DefaultTransferExpiry(), config.MaxTransferExpiry())
 		if err != nil {
-			RespondWithError(w, http.StatusBadRequest, "Invalid chunk_index", err.Error())
+			RespondWithError(w, http.StatusBadRequest, "Invalid expires_at", err.Error())
 			return
 		}
 
-		totalChunks, err := strconv.Atoi(totalChunksStr)
-		if err != nil {
-			RespondWithError(w, http.StatusBadRequest, "Invalid total_chunks", err.Error())
+		// The whole file must fit in the sender's remaining storage quota; its size is reserved when it is created
+		if !requireQuota(w, senderID, database.ExpectedCiphertextSize(req.FileSize, req.TotalChunks), true) {
 			return
 		}
 
-		fileSize, err := strconv.ParseInt(fileSizeStr, 10, 64)
+		recipientRecords, missingKeys, err := prepareRecipients(req.Recipients)
 		if err != nil {
-			RespondWithError(w, http.StatusBadRequest, "Invalid file_size", err.Error())
+			RespondWithError(w, http.StatusInternalServerError, "Failed to prepare recipients", err.Error())
 			return
 		}
 
-		chunkSize, err := strconv.ParseInt(chunkSizeStr, 10, 64)
+		fileID, err := database.CreateFileWithRecipients(senderID, req.OriginalFilename, req.FileSize, req.TotalChunks, req.MimeType, expiresAt, req.ForwardPolicy, recipientRecords)
+		if respondQuotaError(w, err) {
+			return
+		}
 		if err != nil {
-			RespondWithError(w, http.StatusBadRequest, "Invalid chunk_size", err.Error())
+			log.Printf("Error creating file: %v", err)
+			RespondWithError(w, http.StatusInternalServerError, "Failed to create file", err.Error())
 			return
 		}
 
-		// Parse encrypted keys
-		var encryptedKeys map[string]string
-		if err := json.Unmarshal([]byte(encryptedKeysJSON), &encryptedKeys); err != nil {
-			RespondWithError(w, http.StatusBadRequest, "Invalid encrypted_keys format", err.Error())
-			return
+		log.Printf("Created file %s (%s, %d chunks) for %d recipient(s)", fileID, req.OriginalFilename, req.TotalChunks, len(recipientRecords))
+
+		RespondWithJSON(w, http.StatusCreated, models.CreateFileResponse{
+			Message:       "File created successfully",
+			FileID:        fileID,
+			TotalChunks:   req.TotalChunks,
+			ExpiresAt:     expiresAt,
+			ForwardPolicy: req.ForwardPolicy,
+			MissingKeys:   missingKeys,
+		})
+	}
+}
+
+// prepareRecipients turns the requested recipients into database records
+// Recipients without an account are created and sent a password reset email
+// Returns the records and the emails of recipients for whom no wrapped key was supplied
+func prepareRecipients(recipients []models.FileRecipientRequest) ([]database.RecipientRecord, []string, error) {
+	var createdUsers []string
+	records := make([]database.RecipientRecord, 0, len(recipients))
+	missingKeys := []string{}
+
+	for _, recipient := range recipients {
+		email := recipient.Email
+
+		// Check if user exists
+		exists, err := database.UserExistsByEmail(email)
+		if err != nil {
+			log.Printf("Error checking if user exists for email %s: %v", email, err)
+			return nil, nil, fmt.Errorf("failed to check user existence: %w", err)
+		}
+
+		// If user doesn't exist, create them and send password reset email
+		var recipientID *string
+		if !exists {
+			log.Printf("Creating new user for email: %s", email)
+			newUser, err := CreateUserAndSendResetEmail(email)
+			if err != nil {
+				log.Printf("Failed to create user for email %s: %v", email, err)
+				return nil, nil, fmt.Errorf("failed to create user: %w", err)
+			}
+			createdUsers = append(createdUsers, newUser.Email)
+			log.Printf("Successfully created user %s and sent password reset email", newUser.Email)
+			recipientID = &newUser.ID
+		} else {
+			// Get existing user ID
+			user, err := database.GetUserByEmail(email)
+			if err == nil {
+				recipientID = &user.ID
+			}
+		}
+
+		if recipient.EncryptedKey == "" {
+			log.Printf("Warning: No encrypted key provided for recipient %s", email)
+			missingKeys = append(missingKeys, email)
 		}
 
-		// Get recipient emails
-		recipientEmails := r.Form["recipient_emails[]"]
-		if len(recipientEmails) == 0 {
-			RespondWithError(w, http.StatusBadRequest, "At least one recipient email is required", "")
+		records = append(records, database.RecipientRecord{
+			Email:        email,
+			EncryptedKey: recipient.EncryptedKey,
+			RecipientID:  recipientID,
+			MaxDownloads: recipient.MaxDownloads,
+		})
+	}
+
+	// Include created users in log
+	if len(createdUsers) > 0 {
+		log.Printf("Created new users: %v", createdUsers)
+	}
+
+	return records, missingKeys, nil
+}
+
+// SendFileChunkHandler handles encrypted file chunk uploads
+// The file must have been created with CreateFileHandler. The multipart fields (file_id, chunk_index, iv,
+// optional sha256) must come before the encrypted_chunk part, which is streamed straight to storage
+func SendFileChunkHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Get authenticated user ID
+		userID := r.Context().Value("user_id")
+		if userID == nil {
+			RespondWithError(w, http.StatusUnauthorized, "User not authenticated", "")
 			return
 		}
+		senderID := userID.(string)
+
+		// Cap the request body; the chunk itself is never held in memory
+		maxBytes := config.MaxChunkUploadBytes()
+		r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
 
-		// Get the encrypted file chunk
-		file, _, err := r.FormFile("encrypted_chunk")
+		reader, err := r.MultipartReader()
 		if err != nil {
-			RespondWithError(w, http.StatusBadRequest, "Failed to get encrypted chunk", err.Error())
+			RespondWithError(w, http.StatusBadRequest, "Failed to parse form data", err.Error())
 			return
 		}
-		defer file.Close()
-
-		// Safely create file metadata and recipients (only once, even with concurrent requests)
-		// This uses a mutex to ensure only one goroutine processes this for each file
-		fileMetadataLock.Lock()
-		if !fileMetadataMap[fileID] {
-			// Create file metadata using safe upsert
-			err = database.CreateFileMetadataIfNotExists(fileID, senderID, originalFilename, fileSize, totalChunks, mimeType)
-			if err != nil {
-				fileMetadataLock.Unlock()
-				log.Printf("Error creating file metadata: %v", err)
-				RespondWithError(w, http.StatusInternalServerError, "Failed to create file metadata", err.Error())
-				return
-			}
 
-			// Process recipients
-			var createdUsers []string
-			var recipientRecords []struct {
-				Email        string
-				EncryptedKey string
-				RecipientID  *string
-			}
-
-			for _, email := range recipientEmails {
-				email = strings.TrimSpace(email)
-				if email == "" {
-					continue
-				}
-
-				// Check if user exists
-				exists, err := database.UserExistsByEmail(email)
-				if err != nil {
-					fileMetadataLock.Unlock()
-					log.Printf("Error checking if user exists for email %s: %v", email, err)
-					RespondWithError(w, http.StatusInternalServerError, "Failed to check user existence", err.Error())
-					return
-				}
-
-				// If user doesn't exist, create them and send password reset email
-				var recipientID *string
-				if !exists {
-					log.Printf("Creating new user for email: %s", email)
-					newUser, err := CreateUserAndSendResetEmail(email)
-					if err != nil {
-						fileMetadataLock.Unlock()
-						log.Printf("Failed to create user for email %s: %v", email, err)
-						RespondWithError(w, http.StatusInternalServerError, "Failed to create user", err.Error())
-						return
-					}
-					createdUsers = append(createdUsers, newUser.Email)
-					log.Printf("Successfully created user %s and sent password reset email", newUser.Email)
-					recipientID = &newUser.ID
-				} else {
-					// Get existing user ID
-					user, err := database.GetUserByEmail(email)
-					if err == nil {
-						recipientID = &user.ID
-					}
-				}
-
-				// Get encrypted key for this recipient
-				encryptedKey, hasKey := encryptedKeys[email]
-				if !hasKey {
-					log.Printf("Warning: No encrypted key provided for recipient %s", email)
-					encryptedKey = ""
-				}
-
-				recipientRecords = append(recipientRecords, struct {
-					Email        string
-					EncryptedKey string
-					RecipientID  *string
-				}{
-					Email:        email,
-					EncryptedKey: encryptedKey,
-					RecipientID:  recipientID,
-				})
+		fields, part, err := readMultipartFields(reader, "encrypted_chunk")
+		if err != nil {
+			if isBodyTooLarge(err) {
+				RespondWithError(w, http.StatusRequestEntityTooLarge, "Request body too large", err.Error())
+				return
 			}
+			RespondWithError(w, http.StatusBadRequest, "Failed to parse form data", err.Error())
+			return
+		}
+		defer part.Close()
 
-			// Create all recipient records in a transaction
-			if len(recipientRecords) > 0 {
-				err = database.CreateFileRecipientsIfNotExists(fileID, recipientRecords)
-				if err != nil {
-					fileMetadataLock.Unlock()
-					log.Printf("Error creating file recipient records: %v", err)
-					RespondWithError(w, http.StatusInternalServerError, "Failed to store recipient info", err.Error())
-					return
-				}
-			}
+		// Extract form fields
+		fileID := fields["file_id"]
+		chunkIndexStr := fields["chunk_index"]
+		iv := fields["iv"]
+		clientSHA256 := strings.ToLower(strings.TrimSpace(fields["sha256"]))
+		idempotencyKey := strings.TrimSpace(r.Header.Get("Idempotency-Key"))
 
-			// Mark that we've processed metadata for this file
-			fileMetadataMap[fileID] = true
+		// Validate required fields
+		var missingFields []string
+		if fileID == "" {
+			missingFields = append(missingFields, "file_id")
+		}
+		if chunkIndexStr == "" {
+			missingFields = append(missingFields, "chunk_index")
+		}
+		if iv == "" {
+			missingFields = append(missingFields, "iv")
+		}
+		if len(missingFields) > 0 {
+			RespondWithError(w, http.StatusBadRequest, "Missing required fields: "+strings.Join(missingFields, ", "), "")
+			return
+		}
 
-			// Include created users in log
-			if len(createdUsers) > 0 {
-				log.Printf("Created new users: %v", createdUsers)
-			}
+		if !models.IsValidFileID(fileID) {
+			RespondWithError(w, http.StatusBadRequest, "Invalid file_id", "")
+			return
+		}
 
-			log.Printf("Created file metadata and recipients for file ID: %s", fileID)
+		if clientSHA256 != "" && !isSHA256Hex(clientSHA256) {
+			RespondWithError(w, http.StatusBadRequest, "Invalid sha256", "sha256 must be the hex-encoded SHA-256 of the encrypted chunk")
+			return
+		}
+		if len(idempotencyKey) > maxIdempotencyKeyLength {
+			RespondWithError(w, http.StatusBadRequest, "Idempotency-Key is too long", "")
+			return
 		}
-		fileMetadataLock.Unlock()
 
-		// Upload encrypted chunk to Supabase Storage
-		// This can happen concurrently for different chunks
-		storagePath, err := storage.UploadEncryptedChunk(fileID, chunkIndex, file, token)
+		// Parse numeric values
+		chunkIndex, err := strconv.Atoi(chunkIndexStr)
 		if err != nil {
-			log.Printf("Error uploading chunk to storage: %v", err)
-			RespondWithError(w, http.StatusInternalServerError, "Failed to upload chunk", err.Error())
+			RespondWithError(w, http.StatusBadRequest, "Invalid chunk_index", err.Error())
 			return
 		}
 
-		// Store chunk metadata in database
-		// PostgreSQL handles concurrent inserts well
-		err = database.CreateFileChunk(fileID, chunkIndex, chunkSize, storagePath, iv)
+		metadata, err := database.GetFileMetadata(fileID)
+		if errors.Is(err, database.ErrFileNotFound) {
+			RespondWithError(w, http.StatusNotFound, "File not found", "Create the file with POST /api/files before uploading chunks")
+			return
+		}
 		if err != nil {
-			log.Printf("Error creating chunk metadata: %v", err)
-			RespondWithError(w, http.StatusInternalServerError, "Failed to store chunk metadata", err.Error())
+			log.Printf("Error retrieving metadata for file %s: %v", fileID, err)
+			RespondWithError(w, http.StatusInternalServerError, "Failed to retrieve file metadata", err.Error())
 			return
 		}
 
-		// Check if this is the last chunk and mark file as complete
-		// Multiple chunks might think they're last due to concurrency, but the update is idempotent
-		if chunkIndex == totalChunks-1 {
-			err = database.MarkFileComplete(fileID)
-			if err != nil {
-				log.Printf("Error marking file as complete: %v", err)
-				// Don't fail the request, just log it
-			}
-			log.Printf("File %s marked as complete", fileID)
+		// Only the sender who created the file may upload its chunks
+		if metadata.SenderID != senderID {
+			RespondWithError(w, http.StatusForbidden, "Only the sender can upload chunks to this file", "")
+			return
+		}
+
+		// The file's space was reserved when it was created, so only senders already over their quota are turned
+		// away here; the chunk is checked against the quota again when it is recorded
+		if !requireQuota(w, senderID, 0, false) {
+			return
 		}
 
-		log.Printf("Stored encrypted chunk - File ID: %s, Chunk: %d/%d, Filename: %s, Storage: %s",
-			fileID, chunkIndex+1, totalChunks, originalFilename, storagePath)
+		result := ingestChunk(metadata, chunkUpload{
+			FileID:         fileID,
+			ChunkIndex:     chunkIndex,
+			IV:             iv,
+			ClientSHA256:   clientSHA256,
+			IdempotencyKey: idempotencyKey,
+		}, part)
+		if result.Status != http.StatusOK {
+			RespondWithError(w, result.Status, result.Error, result.Details)
+			return
+		}
+
+		message := "Encrypted chunk uploaded successfully"
+		if result.AlreadyStored {
+			message = "Encrypted chunk already stored"
+		} else {
+			log.Printf("Stored encrypted chunk - File ID: %s, Chunk: %d/%d, Filename: %s, Storage: %s",
+				fileID, chunkIndex+1, metadata.TotalChunks, metadata.OriginalFilename, result.Chunk.StoragePath)
+		}
 
 		RespondWithJSON(w, http.StatusOK, map[string]interface{}{
-			"message":       "Encrypted chunk uploaded successfully",
-			"file_id":       fileID,
-			"chunk_index":   chunkIndex,
-			"total_chunks":  totalChunks,
-			"storage_path":  storagePath,
+			"message":      message,
+			"file_id":      fileID,
+			"chunk_index":  chunkIndex,
+			"total_chunks": metadata.TotalChunks,
+			"storage_path": result.Chunk.StoragePath,
 		})
 	}
 }
 
+// isSHA256Hex reports whether value is a lowercase hex-encoded SHA-256 digest
+func isSHA256Hex(value string) bool {
+	if len(value) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(value)
+	return err == nil
+}
+
+// resolveExpiry turns the sender's requested expiry (RFC 3339) into an absolute time
+// An empty value uses the default expiry; times in the past or beyond the maximum expiry are rejected
+func resolveExpiry(requested string, now time.Time, defaultExpiry, maxExpiry time.Duration) (time.Time, error) {
+	if requested == "" {
+		return now.Add(defaultExpiry), nil
+	}
+
+	expiresAt, err := time.Parse(time.RFC3339, requested)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("expires_at must be an RFC 3339 timestamp")
+	}
+	if !expiresAt.After(now) {
+		return time.Time{}, fmt.Errorf("expires_at must be in the future")
+	}
+	if expiresAt.Sub(now) > maxExpiry {
+		return time.Time{}, fmt.Errorf("expires_at must be within %s", maxExpiry)
+	}
+
+	return expiresAt, nil
+}
@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestResolveExpiry(t *testing.T) {
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	defaultExpiry := 7 * 24 * time.Hour
+	maxExpiry := 30 * 24 * time.Hour
+
+	tests := []struct {
+		name      string
+		requested string
+		want      time.Time
+		wantErr   bool
+	}{
+		{name: "empty uses default", requested: "", want: now.Add(defaultExpiry)},
+		{name: "within maximum", requested: "2025-01-02T12:00:00Z", want: now.Add(24 * time.Hour)},
+		{name: "exactly maximum", requested: "2025-01-31T12:00:00Z", want: now.Add(maxExpiry)},
+		{name: "beyond maximum", requested: "2025-02-01T12:00:00Z", wantErr: true},
+		{name: "in the past", requested: "2024-12-31T12:00:00Z", wantErr: true},
+		{name: "not a timestamp", requested: "tomorrow", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveExpiry(tt.requested, now, defaultExpiry, maxExpiry)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected an error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !got.Equal(tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsSHA256Hex(t *testing.T) {
+	tests := []struct {
+		value string
+		want  bool
+	}{
+		{value: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", want: true},
+		{value: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b85", want: false},
+		{value: "z3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855", want: false},
+		{value: "", want: false},
+	}
+
+	for _, tt := range tests {
+		if got := isSHA256Hex(tt.value); got != tt.want {
+			t.Errorf("isSHA256Hex(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,223 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"secure-document-transfer/internal/database"
+	"secure-document-transfer/internal/models"
+
+	"github.com/gorilla/mux"
+)
+
+// UpdateForwardPolicyHandler lets the sender choose whether recipients may forward a file
+func UpdateForwardPolicyHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fileID := mux.Vars(r)["file_id"]
+
+		access, ok := authorizeFileAccess(w, r, fileID)
+		if !ok {
+			return
+		}
+
+		if !access.IsSender {
+			RespondWithError(w, http.StatusForbidden, "Only the sender can change the forward policy of this file", "")
+			return
+		}
+
+		var req models.UpdateForwardPolicyRequest
+		if err := parseJSON(r, &req); err != nil {
+			RespondWithError(w, http.StatusBadRequest, "Invalid request body", err.Error())
+			return
+		}
+
+		if err := req.Validate(); err != nil {
+			RespondWithError(w, http.StatusBadRequest, err.Error(), "")
+			return
+		}
+
+		err := database.SetForwardPolicy(fileID, req.ForwardPolicy)
+		if errors.Is(err, database.ErrFileNotFound) {
+			RespondWithError(w, http.StatusNotFound, "File not found", "")
+			return
+		}
+		if err != nil {
+			log.Printf("Error updating forward policy of file %s: %v", fileID, err)
+			RespondWithError(w, http.StatusInternalServerError, "Failed to update forward policy", err.Error())
+			return
+		}
+
+		RespondWithJSON(w, http.StatusOK, map[string]interface{}{
+			"message":        "Forward policy updated successfully",
+			"file_id":        fileID,
+			"forward_policy": req.ForwardPolicy,
+		})
+	}
+}
+
+// ForwardFileHandler lets a recipient pass a file on to new recipients
+// The recipient unwraps the file key client-side and sends it wrapped for each new recipient, so no
+// chunks are uploaded again. The new rows record who forwarded the file; their download limits are
+// charged against the forwarding recipient's, see forwardedDownloadLimits
+func ForwardFileHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fileID := mux.Vars(r)["file_id"]
+
+		access, ok := authorizeFileAccess(w, r, fileID)
+		if !ok || !requireNotExpired(w, access) || !requireDownloadsRemaining(w, access) {
+			return
+		}
+
+		if !access.IsRecipient {
+			RespondWithError(w, http.StatusForbidden, "Only recipients can forward this file", "Senders add recipients with POST /api/files/{file_id}/recipients")
+			return
+		}
+		if !requireNotInTransfer(w, access) {
+			return
+		}
+
+		var req models.ForwardFileRequest
+		if err := parseJSON(r, &req); err != nil {
+			RespondWithError(w, http.StatusBadRequest, "Invalid request body", err.Error())
+			return
+		}
+
+		if err := req.Validate(); err != nil {
+			RespondWithError(w, http.StatusBadRequest, err.Error(), "")
+			return
+		}
+
+		forwarderID := r.Context().Value("user_id").(string)
+		forwarderEmail := r.Context().Value("user_email").(string)
+		for _, recipient := range req.Recipients {
+			if err := checkForwardPolicy(access.ForwardPolicy, forwarderEmail, recipient.Email); err != nil {
+				RespondWithError(w, http.StatusForbidden, "Forwarding not allowed", err.Error())
+				return
+			}
+		}
+
+		maxDownloads, err := forwardedDownloadLimits(access, req.Recipients)
+		if err != nil {
+			RespondWithError(w, http.StatusForbidden, "Not enough downloads left to forward", err.Error())
+			return
+		}
+
+		// Refuse removed recipients before prepareRecipients creates accounts and sends emails for them
+		emails := make([]string, len(req.Recipients))
+		for i, recipient := range req.Recipients {
+			emails[i] = recipient.Email
+		}
+		err = database.CheckRemovedRecipients(fileID, emails)
+		if respondForwardError(w, err) {
+			return
+		}
+		if err != nil {
+			log.Printf("Error checking recipient removals of file %s: %v", fileID, err)
+			RespondWithError(w, http.StatusInternalServerError, "Failed to check recipients", err.Error())
+			return
+		}
+
+		recipientRecords, _, err := prepareRecipients(req.Recipients)
+		if err != nil {
+			RespondWithError(w, http.StatusInternalServerError, "Failed to prepare recipients", err.Error())
+			return
+		}
+		for i := range recipientRecords {
+			recipientRecords[i].ForwardedBy = &forwarderID
+			recipientRecords[i].MaxDownloads = maxDownloads[i]
+		}
+
+		added, err := database.ForwardFileRecipients(fileID, access.RecipientRowID, recipientRecords)
+		if errors.Is(err, database.ErrFileNotFound) {
+			RespondWithError(w, http.StatusNotFound, "File not found", "")
+			return
+		}
+		if respondForwardError(w, err) {
+			return
+		}
+		if err != nil {
+			log.Printf("Error forwarding file %s: %v", fileID, err)
+			RespondWithError(w, http.StatusInternalServerError, "Failed to forward file", err.Error())
+			return
+		}
+
+		log.Printf("Recipient %s forwarded file %s to %d recipient(s)", forwarderEmail, fileID, len(added))
+
+		RespondWithJSON(w, http.StatusOK, models.AddRecipientsResponse{
+			Message:           "File forwarded successfully",
+			FileID:            fileID,
+			Added:             added,
+			AlreadyRecipients: alreadyRecipients(req.Recipients, added),
+		})
+	}
+}
+
+// respondForwardError writes the response for the errors that refuse a forward and reports whether err was one
+func respondForwardError(w http.ResponseWriter, err error) bool {
+	switch {
+	case errors.Is(err, database.ErrForwardToRemovedRecipient):
+		RespondWithError(w, http.StatusForbidden, "Forwarding not allowed", err.Error())
+	case errors.Is(err, database.ErrForwardAllowanceExceeded):
+		RespondWithError(w, http.StatusForbidden, "Not enough downloads left to forward", err.Error())
+	case errors.Is(err, database.ErrRecipientNotFound):
+		RespondWithError(w, http.StatusForbidden, "Only recipients can forward this file", "")
+	default:
+		return false
+	}
+	return true
+}
+
+// forwardedDownloadLimits returns the download limit of each forwarded recipient
+// Forwarded downloads are charged against the forwarding recipient's remaining downloads, so forwarding cannot
+// multiply the limit the sender chose: a limited forwarder gives each new recipient the requested max_downloads
+// (1 by default) out of their own allowance, and all of them together may not exceed it. Recipients forwarded by
+// someone without a limit get the requested max_downloads, or none
+func forwardedDownloadLimits(access *database.FileAccess, recipients []models.FileRecipientRequest) ([]*int, error) {
+	limits := make([]*int, len(recipients))
+	if !access.MaxDownloads.Valid {
+		for i, recipient := range recipients {
+			limits[i] = recipient.MaxDownloads
+		}
+		return limits, nil
+	}
+
+	remaining := access.MaxDownloads.Int64 - int64(access.DownloadCount)
+	var total int64
+	for i, recipient := range recipients {
+		limit := 1
+		if recipient.MaxDownloads != nil {
+			limit = *recipient.MaxDownloads
+		}
+		limits[i] = &limit
+		total += int64(limit)
+	}
+	if total > remaining {
+		return nil, fmt.Errorf("you have %d download(s) left and the new recipients would need %d", remaining, total)
+	}
+
+	return limits, nil
+}
+
+// checkForwardPolicy checks whether a recipient may forward a file to recipientEmail under the file's forward policy
+// With the same_domain policy the new recipient must share the forwarding recipient's email domain
+func checkForwardPolicy(policy, forwarderEmail, recipientEmail string) error {
+	switch policy {
+	case models.ForwardPolicyAllowed:
+		return nil
+	case models.ForwardPolicySameDomain:
+		if !strings.EqualFold(emailDomain(forwarderEmail), emailDomain(recipientEmail)) {
+			return fmt.Errorf("the sender only allows forwarding within @%s", strings.ToLower(emailDomain(forwarderEmail)))
+		}
+		return nil
+	default:
+		return fmt.Errorf("the sender does not allow this file to be forwarded")
+	}
+}
+
+// emailDomain returns the part of an email address after the last @
+func emailDomain(email string) string {
+	return email[strings.LastIndex(email, "@")+1:]
+}
@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"database/sql"
+	"testing"
+
+	"secure-document-transfer/internal/database"
+	"secure-document-transfer/internal/models"
+)
+
+func TestCheckForwardPolicy(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    string
+		recipient string
+		allowed   bool
+	}{
+		{"allowed to any domain", models.ForwardPolicyAllowed, "bob@elsewhere.org", true},
+		{"same domain", models.ForwardPolicySameDomain, "bob@example.com", true},
+		{"same domain ignores case", models.ForwardPolicySameDomain, "bob@Example.COM", true},
+		{"other domain", models.ForwardPolicySameDomain, "bob@elsewhere.org", false},
+		{"subdomain is another domain", models.ForwardPolicySameDomain, "bob@mail.example.com", false},
+		{"forbidden", models.ForwardPolicyForbidden, "bob@example.com", false},
+		{"unknown policy", "", "bob@example.com", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkForwardPolicy(tt.policy, "alice@example.com", tt.recipient)
+			if tt.allowed && err != nil {
+				t.Errorf("expected forwarding to be allowed, got %v", err)
+			}
+			if !tt.allowed && err == nil {
+				t.Error("expected forwarding to be refused")
+			}
+		})
+	}
+}
+
+func TestForwardedDownloadLimits(t *testing.T) {
+	two := 2
+	recipients := []models.FileRecipientRequest{{Email: "bob@example.com"}, {Email: "carol@example.com", MaxDownloads: &two}}
+
+	// A limited forwarder hands out their own remaining downloads, one per recipient unless asked otherwise
+	limited := &database.FileAccess{IsRecipient: true, MaxDownloads: sql.NullInt64{Int64: 5, Valid: true}, DownloadCount: 2}
+	limits, err := forwardedDownloadLimits(limited, recipients)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if limits[0] == nil || *limits[0] != 1 || limits[1] == nil || *limits[1] != 2 {
+		t.Errorf("expected limits 1 and 2, got %v and %v", limits[0], limits[1])
+	}
+
+	// Fanning out to more recipients than downloads left is refused
+	limited.DownloadCount = 3
+	if _, err := forwardedDownloadLimits(limited, recipients); err == nil {
+		t.Error("expected forwarding 3 downloads with 2 left to be refused")
+	}
+
+	// Recipients of an unlimited forwarder keep the requested limit, or none
+	unlimited := &database.FileAccess{IsRecipient: true}
+	limits, err = forwardedDownloadLimits(unlimited, recipients)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if limits[0] != nil || limits[1] == nil || *limits[1] != 2 {
+		t.Errorf("expected no limit and 2, got %v and %v", limits[0], limits[1])
+	}
+}
@@ -2,11 +2,22 @@ package handlers
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"strconv"
 
 	"secure-document-transfer/internal/models"
 )
 
+const (
+	// defaultPageLimit is the page size used when a list endpoint receives no limit
+	defaultPageLimit = 20
+	// maxPageLimit is the largest page size a list endpoint will return
+	maxPageLimit = 100
+	// maxIdempotencyKeyLength is the longest Idempotency-Key header accepted on uploads
+	maxIdempotencyKeyLength = 255
+)
+
 // RespondWithJSON sends a JSON response
 func RespondWithJSON(w http.ResponseWriter, status int, payload interface{}) {
 	response, err := json.Marshal(payload)
@@ -36,3 +47,30 @@ func parseJSON(r *http.Request, v interface{}) error {
 	return decoder.Decode(v)
 }
 
+// parsePagination reads the limit and offset query parameters
+// Missing values fall back to the defaults and limit is capped at maxPageLimit
+func parsePagination(r *http.Request) (int, int, error) {
+	limit := defaultPageLimit
+	offset := 0
+
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		value, err := strconv.Atoi(limitStr)
+		if err != nil || value < 1 {
+			return 0, 0, fmt.Errorf("limit must be a positive integer")
+		}
+		limit = value
+	}
+	if limit > maxPageLimit {
+		limit = maxPageLimit
+	}
+
+	if offsetStr := r.URL.Query().Get("offset"); offsetStr != "" {
+		value, err := strconv.Atoi(offsetStr)
+		if err != nil || value < 0 {
+			return 0, 0, fmt.Errorf("offset must be a non-negative integer")
+		}
+		offset = value
+	}
+
+	return limit, offset, nil
+}
@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+
+	"secure-document-transfer/internal/database"
+	"secure-document-transfer/internal/models"
+)
+
+// GetInboxHandler lists the files that have been shared with the authenticated user
+func GetInboxHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		// Extract user info from context (added by AuthMiddleware)
+		userID := r.Context().Value("user_id")
+		userEmail := r.Context().Value("user_email")
+		if userID == nil || userEmail == nil {
+			RespondWithError(w, http.StatusUnauthorized, "User not authenticated", "")
+			return
+		}
+
+		limit, offset, err := parsePagination(r)
+		if err != nil {
+			RespondWithError(w, http.StatusBadRequest, "Invalid pagination parameters", err.Error())
+			return
+		}
+
+		// Incomplete uploads are hidden unless explicitly requested
+		includeIncomplete := r.URL.Query().Get("include_incomplete") == "true"
+
+		files, total, err := database.GetInboxFiles(userID.(string), userEmail.(string), includeIncomplete, limit, offset)
+		if err != nil {
+			log.Printf("Error retrieving inbox files: %v", err)
+			RespondWithError(w, http.StatusInternalServerError, "Failed to retrieve inbox", err.Error())
+			return
+		}
+
+		RespondWithJSON(w, http.StatusOK, models.InboxResponse{
+			Files:  files,
+			Total:  total,
+			Limit:  limit,
+			Offset: offset,
+		})
+	}
+}
+
+// GetSentFilesHandler lists the files sent by the authenticated user with per-recipient delivery status
+func GetSentFilesHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.Context().Value("user_id")
+		if userID == nil {
+			RespondWithError(w, http.StatusUnauthorized, "User not authenticated", "")
+			return
+		}
+
+		limit, offset, err := parsePagination(r)
+		if err != nil {
+			RespondWithError(w, http.StatusBadRequest, "Invalid pagination parameters", err.Error())
+			return
+		}
+
+		files, total, err := database.GetSentFiles(userID.(string), limit, offset)
+		if err != nil {
+			log.Printf("Error retrieving sent files: %v", err)
+			RespondWithError(w, http.StatusInternalServerError, "Failed to retrieve sent files", err.Error())
+			return
+		}
+
+		RespondWithJSON(w, http.StatusOK, models.SentFilesResponse{
+			Files:  files,
+			Total:  total,
+			Limit:  limit,
+			Offset: offset,
+		})
+	}
+}
@@ -0,0 +1,266 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+
+	"secure-document-transfer/internal/database"
+	"secure-document-transfer/internal/storage"
+)
+
+// maxFieldBytes is the largest non-file multipart field accepted on uploads
+const maxFieldBytes = 4 << 10
+
+// chunkUpload describes one encrypted chunk a sender is uploading
+type chunkUpload struct {
+	FileID         string
+	ChunkIndex     int
+	IV             string
+	ClientSHA256   string // Optional hex SHA-256 the client computed over the ciphertext
+	IdempotencyKey string // Optional Idempotency-Key of the upload
+}
+
+// chunkResult is the outcome of ingesting one chunk
+// Status is http.StatusOK on success; otherwise Error and Details describe the failure
+type chunkResult struct {
+	Status        int
+	Error         string
+	Details       string
+	Chunk         *database.FileChunk
+	AlreadyStored bool // The chunk was stored by an earlier attempt and nothing was written
+}
+
+// failedChunk builds the result of a chunk that could not be stored
+func failedChunk(status int, message, details string) chunkResult {
+	return chunkResult{Status: status, Error: message, Details: details}
+}
+
+// ingestChunk streams one encrypted chunk straight from body to storage and records it
+// The caller must have checked that the authenticated user is the sender of the file
+func ingestChunk(metadata *database.FileMetadata, upload chunkUpload, body io.Reader) chunkResult {
+	chunk, result := stageChunk(metadata, upload, body)
+	if result != nil {
+		return *result
+	}
+
+	// Store chunk metadata in database
+	inserted, err := database.CreateFileChunk(*chunk)
+	if err != nil {
+		discardChunk(chunk.StoragePath)
+		return recordFailure(err)
+	}
+
+	return recordedChunkResult(*chunk, upload, inserted)
+}
+
+// stageChunk checks one chunk upload and streams its ciphertext to storage, hashing and counting it on the way
+// so it is never held in memory. A retry of a chunk that is already stored is recognised before anything is uploaded
+// Returns the chunk to record in file_chunks, or the final result if the upload was rejected or already stored
+func stageChunk(metadata *database.FileMetadata, upload chunkUpload, body io.Reader) (*database.FileChunk, *chunkResult) {
+	if upload.ChunkIndex < 0 || upload.ChunkIndex >= metadata.TotalChunks {
+		result := failedChunk(http.StatusBadRequest, "Invalid chunk_index",
+			fmt.Sprintf("chunk_index must be between 0 and %d", metadata.TotalChunks-1))
+		return nil, &result
+	}
+
+	// Chunks of an expired file may already have been reaped, so nothing is stored or matched against them
+	if metadata.HasExpired() {
+		result := failedChunk(http.StatusGone, "File has expired", "")
+		return nil, &result
+	}
+
+	stored, err := findStoredChunk(upload.FileID, upload.ChunkIndex, upload.IdempotencyKey)
+	if err != nil {
+		log.Printf("Error checking for stored chunk %d of file %s: %v", upload.ChunkIndex, upload.FileID, err)
+		result := failedChunk(http.StatusInternalServerError, "Failed to check for stored chunk", err.Error())
+		return nil, &result
+	}
+	if stored != nil {
+		// Without a client checksum the body has to be read to compare it with the stored chunk
+		contentSHA256 := upload.ClientSHA256
+		if contentSHA256 == "" {
+			hasher := sha256.New()
+			if _, err := io.Copy(hasher, body); err != nil {
+				result := readFailure(err)
+				return nil, &result
+			}
+			contentSHA256 = hex.EncodeToString(hasher.Sum(nil))
+		}
+		result := storedChunkResult(stored, upload, contentSHA256)
+		return nil, &result
+	}
+
+	if metadata.CompletedAt.Valid {
+		result := failedChunk(http.StatusConflict, "File upload is already complete", "")
+		return nil, &result
+	}
+
+	// Upload encrypted chunk to Supabase Storage
+	hasher := sha256.New()
+	counter := &countingReader{reader: io.TeeReader(body, hasher)}
+	storagePath, err := storage.UploadEncryptedChunk(upload.FileID, upload.ChunkIndex, counter)
+	if err != nil {
+		if isBodyTooLarge(err) {
+			result := readFailure(err)
+			return nil, &result
+		}
+		log.Printf("Error uploading chunk to storage: %v", err)
+		result := failedChunk(http.StatusInternalServerError, "Failed to upload chunk", err.Error())
+		return nil, &result
+	}
+
+	contentSHA256 := hex.EncodeToString(hasher.Sum(nil))
+	if upload.ClientSHA256 != "" && upload.ClientSHA256 != contentSHA256 {
+		discardChunk(storagePath)
+		result := failedChunk(http.StatusUnprocessableEntity, "Chunk checksum mismatch",
+			fmt.Sprintf("Received %d bytes with SHA-256 %s", counter.n, contentSHA256))
+		return nil, &result
+	}
+
+	return &database.FileChunk{
+		FileID:         upload.FileID,
+		ChunkIndex:     upload.ChunkIndex,
+		ChunkSize:      counter.n,
+		StoragePath:    storagePath,
+		EncryptionIV:   upload.IV,
+		ContentSHA256:  contentSHA256,
+		IdempotencyKey: upload.IdempotencyKey,
+	}, nil
+}
+
+// recordedChunkResult turns the outcome of recording a staged chunk into its result
+// If a concurrent upload stored the index (or used the idempotency key) first, the staged object is deleted
+// and the upload is compared with the chunk that won
+func recordedChunkResult(chunk database.FileChunk, upload chunkUpload, inserted bool) chunkResult {
+	if inserted {
+		return chunkResult{Status: http.StatusOK, Chunk: &chunk}
+	}
+
+	discardChunk(chunk.StoragePath)
+	stored, err := findStoredChunk(upload.FileID, upload.ChunkIndex, upload.IdempotencyKey)
+	if err != nil || stored == nil {
+		log.Printf("Error retrieving conflicting chunk %d of file %s: %v", upload.ChunkIndex, upload.FileID, err)
+		return failedChunk(http.StatusInternalServerError, "Failed to store chunk metadata", "")
+	}
+	return storedChunkResult(stored, upload, chunk.ContentSHA256)
+}
+
+// recordFailure maps an error recording staged chunks in the database to a chunk result
+func recordFailure(err error) chunkResult {
+	if errors.Is(err, database.ErrFileAlreadyComplete) {
+		return failedChunk(http.StatusConflict, "File upload is already complete", "")
+	}
+	if errors.Is(err, database.ErrFileExpired) {
+		return failedChunk(http.StatusGone, "File has expired", "")
+	}
+	if errors.Is(err, database.ErrStorageQuotaExceeded) {
+		return failedChunk(http.StatusForbidden, "Storage quota exceeded", err.Error())
+	}
+	log.Printf("Error creating chunk metadata: %v", err)
+	return failedChunk(http.StatusInternalServerError, "Failed to store chunk metadata", err.Error())
+}
+
+// findStoredChunk looks for a chunk already stored by an earlier attempt of the same upload
+// A chunk stored under the same idempotency key is preferred over one stored at the same index
+// Returns nil if neither exists
+func findStoredChunk(fileID string, chunkIndex int, idempotencyKey string) (*database.FileChunk, error) {
+	if idempotencyKey != "" {
+		chunk, err := database.GetFileChunkByIdempotencyKey(fileID, idempotencyKey)
+		if err == nil {
+			return chunk, nil
+		}
+		if !errors.Is(err, database.ErrChunkNotFound) {
+			return nil, err
+		}
+	}
+
+	chunk, err := database.GetFileChunk(fileID, chunkIndex)
+	if errors.Is(err, database.ErrChunkNotFound) {
+		return nil, nil
+	}
+	return chunk, err
+}
+
+// storedChunkResult compares an upload with the chunk that is already stored for it
+// An identical retry succeeds without changes; different content for the index is a conflict
+func storedChunkResult(stored *database.FileChunk, upload chunkUpload, contentSHA256 string) chunkResult {
+	if stored.ChunkIndex != upload.ChunkIndex {
+		return failedChunk(http.StatusUnprocessableEntity, "Idempotency-Key was already used for another chunk",
+			fmt.Sprintf("The key was used to upload chunk %d", stored.ChunkIndex))
+	}
+	if stored.ContentSHA256 != contentSHA256 || stored.EncryptionIV != upload.IV {
+		return failedChunk(http.StatusConflict, "A different chunk is already stored at this index", "")
+	}
+
+	return chunkResult{Status: http.StatusOK, Chunk: stored, AlreadyStored: true}
+}
+
+// discardChunk deletes a chunk object that was uploaded but not recorded
+// Failures are only logged; the object is left for the storage garbage collector
+func discardChunk(storagePath string) {
+	if err := storage.DeleteChunk(storagePath); err != nil {
+		log.Printf("Error deleting unrecorded chunk %s: %v", storagePath, err)
+	}
+}
+
+// readFailure maps an error reading the request body to a chunk result
+func readFailure(err error) chunkResult {
+	if isBodyTooLarge(err) {
+		return failedChunk(http.StatusRequestEntityTooLarge, "Request body too large", err.Error())
+	}
+	return failedChunk(http.StatusBadRequest, "Failed to read encrypted chunk", err.Error())
+}
+
+// isBodyTooLarge reports whether err was caused by the request body exceeding its http.MaxBytesReader limit
+func isBodyTooLarge(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr)
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	reader io.Reader
+	n      int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// readMultipartFields reads the form fields of a streamed multipart request up to the file part
+// Fields must come before the file part; the returned part is positioned at the start of the file data
+func readMultipartFields(reader *multipart.Reader, fileField string) (map[string]string, *multipart.Part, error) {
+	fields := make(map[string]string)
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, nil, fmt.Errorf("missing %s part", fileField)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		name := part.FormName()
+		if name == fileField {
+			return fields, part, nil
+		}
+
+		value, err := io.ReadAll(io.LimitReader(part, maxFieldBytes+1))
+		part.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(value) > maxFieldBytes {
+			return nil, nil, fmt.Errorf("field %s is too long", name)
+		}
+		fields[name] = string(value)
+	}
+}
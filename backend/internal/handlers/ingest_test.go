@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"bytes"
+	"database/sql"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"secure-document-transfer/internal/database"
+)
+
+// buildMultipart writes the given fields followed by an optional file part
+func buildMultipart(t *testing.T, fields [][2]string, fileField string, fileData []byte) *multipart.Reader {
+	t.Helper()
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for _, field := range fields {
+		if err := writer.WriteField(field[0], field[1]); err != nil {
+			t.Fatalf("failed to write field: %v", err)
+		}
+	}
+	if fileField != "" {
+		part, err := writer.CreateFormFile(fileField, "chunk.enc")
+		if err != nil {
+			t.Fatalf("failed to create file part: %v", err)
+		}
+		part.Write(fileData)
+	}
+	writer.Close()
+
+	return multipart.NewReader(&body, writer.Boundary())
+}
+
+func TestReadMultipartFields(t *testing.T) {
+	reader := buildMultipart(t, [][2]string{{"file_id", "abc"}, {"chunk_index", "3"}}, "encrypted_chunk", []byte("ciphertext"))
+
+	fields, part, err := readMultipartFields(reader, "encrypted_chunk")
+	if err != nil {
+		t.Fatalf("readMultipartFields failed: %v", err)
+	}
+	if fields["file_id"] != "abc" || fields["chunk_index"] != "3" {
+		t.Errorf("unexpected fields: %v", fields)
+	}
+
+	data, err := io.ReadAll(part)
+	if err != nil {
+		t.Fatalf("failed to read file part: %v", err)
+	}
+	if string(data) != "ciphertext" {
+		t.Errorf("file part = %q, want %q", data, "ciphertext")
+	}
+}
+
+func TestReadMultipartFieldsMissingFile(t *testing.T) {
+	reader := buildMultipart(t, [][2]string{{"file_id", "abc"}}, "", nil)
+
+	if _, _, err := readMultipartFields(reader, "encrypted_chunk"); err == nil {
+		t.Error("expected an error when the file part is missing")
+	}
+}
+
+func TestReadMultipartFieldsTooLong(t *testing.T) {
+	reader := buildMultipart(t, [][2]string{{"iv", strings.Repeat("a", maxFieldBytes+1)}}, "encrypted_chunk", []byte("x"))
+
+	if _, _, err := readMultipartFields(reader, "encrypted_chunk"); err == nil {
+		t.Error("expected an error for a field longer than maxFieldBytes")
+	}
+}
+
+func TestReadMultipartFieldsAfterFileAreIgnored(t *testing.T) {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	part, _ := writer.CreateFormFile("encrypted_chunk", "chunk.enc")
+	part.Write([]byte("x"))
+	writer.WriteField("file_id", "abc")
+	writer.Close()
+
+	fields, _, err := readMultipartFields(multipart.NewReader(&body, writer.Boundary()), "encrypted_chunk")
+	if err != nil {
+		t.Fatalf("readMultipartFields failed: %v", err)
+	}
+	if _, ok := fields["file_id"]; ok {
+		t.Error("fields after the file part should not be read")
+	}
+}
+
+func TestStageChunkRejectsExpiredFile(t *testing.T) {
+	metadata := &database.FileMetadata{FileID: "file", TotalChunks: 2, ExpiresAt: time.Now().Add(-time.Minute)}
+
+	chunk, result := stageChunk(metadata, chunkUpload{FileID: "file", ChunkIndex: 0, IV: "iv"}, strings.NewReader("ciphertext"))
+	if chunk != nil || result == nil || result.Status != http.StatusGone {
+		t.Fatalf("expected 410 for a chunk of an expired file, got %+v", result)
+	}
+
+	metadata = &database.FileMetadata{FileID: "file", TotalChunks: 2, ExpiresAt: time.Now().Add(time.Hour),
+		ExpiredAt: sql.NullTime{Time: time.Now(), Valid: true}}
+	chunk, result = stageChunk(metadata, chunkUpload{FileID: "file", ChunkIndex: 0, IV: "iv"}, strings.NewReader("ciphertext"))
+	if chunk != nil || result == nil || result.Status != http.StatusGone {
+		t.Fatalf("expected 410 for a chunk of a reaped file, got %+v", result)
+	}
+}
@@ -0,0 +1,189 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"secure-document-transfer/internal/database"
+	"secure-document-transfer/internal/models"
+	"secure-document-transfer/internal/storage"
+
+	"github.com/gorilla/mux"
+)
+
+// RevokeFileHandler lets the sender pull back a file
+// The encrypted chunks are deleted from storage, the database rows are removed and a tombstone
+// is left so that recipients are told the file was revoked
+func RevokeFileHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fileID := mux.Vars(r)["file_id"]
+
+		access, ok := authorizeFileAccess(w, r, fileID)
+		if !ok {
+			return
+		}
+
+		if !access.IsSender {
+			RespondWithError(w, http.StatusForbidden, "Only the sender can revoke this file", "")
+			return
+		}
+
+		// Delete the ciphertext first so that a storage failure leaves the file intact and retryable
+		if err := storage.DeleteFile(fileID); err != nil {
+			log.Printf("Error deleting storage objects for file %s: %v", fileID, err)
+			RespondWithError(w, http.StatusInternalServerError, "Failed to delete file from storage", err.Error())
+			return
+		}
+
+		revokedAt, err := database.RevokeFile(fileID)
+		if err != nil {
+			log.Printf("Error revoking file %s: %v", fileID, err)
+			RespondWithError(w, http.StatusInternalServerError, "Failed to revoke file", err.Error())
+			return
+		}
+
+		log.Printf("File %s revoked by sender %s", fileID, access.SenderID)
+
+		RespondWithJSON(w, http.StatusOK, map[string]interface{}{
+			"message":    "File revoked successfully",
+			"file_id":    fileID,
+			"revoked_at": revokedAt,
+		})
+	}
+}
+
+// AddRecipientsHandler lets the sender share a file that was already sent with more recipients
+// Each new recipient comes with the file key wrapped for them, so no chunks are uploaded again.
+// Unknown addresses get an account and a password reset email, as when the file was created
+func AddRecipientsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fileID := mux.Vars(r)["file_id"]
+
+		access, ok := authorizeFileAccess(w, r, fileID)
+		if !ok || !requireNotExpired(w, access) {
+			return
+		}
+
+		if !access.IsSender {
+			RespondWithError(w, http.StatusForbidden, "Only the sender can add recipients to this file", "")
+			return
+		}
+		if !requireNotInTransfer(w, access) {
+			return
+		}
+
+		var req models.AddRecipientsRequest
+		if err := parseJSON(r, &req); err != nil {
+			RespondWithError(w, http.StatusBadRequest, "Invalid request body", err.Error())
+			return
+		}
+
+		if err := req.Validate(); err != nil {
+			RespondWithError(w, http.StatusBadRequest, err.Error(), "")
+			return
+		}
+
+		recipientRecords, _, err := prepareRecipients(req.Recipients)
+		if err != nil {
+			RespondWithError(w, http.StatusInternalServerError, "Failed to prepare recipients", err.Error())
+			return
+		}
+
+		added, err := database.AddFileRecipients(fileID, recipientRecords)
+		if errors.Is(err, database.ErrFileNotFound) {
+			RespondWithError(w, http.StatusNotFound, "File not found", "")
+			return
+		}
+		if err != nil {
+			log.Printf("Error adding recipients to file %s: %v", fileID, err)
+			RespondWithError(w, http.StatusInternalServerError, "Failed to add recipients", err.Error())
+			return
+		}
+
+		log.Printf("Sender %s added %d recipient(s) to file %s", access.SenderID, len(added), fileID)
+
+		RespondWithJSON(w, http.StatusOK, models.AddRecipientsResponse{
+			Message:           "Recipients added successfully",
+			FileID:            fileID,
+			Added:             added,
+			AlreadyRecipients: alreadyRecipients(req.Recipients, added),
+		})
+	}
+}
+
+// requireNotInTransfer rejects recipient changes on a single file of a multi-file transfer, whose files share
+// one recipient list that is changed through the transfer
+// On failure it writes the error response and returns false
+func requireNotInTransfer(w http.ResponseWriter, access *database.FileAccess) bool {
+	if access.TransferID != "" {
+		RespondWithError(w, http.StatusConflict, "File is part of a transfer",
+			"Change the recipients of every file at once under /api/transfers/"+access.TransferID)
+		return false
+	}
+	return true
+}
+
+// alreadyRecipients lists the requested recipients that were not added because they already had access
+func alreadyRecipients(requested []models.FileRecipientRequest, added []string) []string {
+	addedEmails := make(map[string]bool, len(added))
+	for _, email := range added {
+		addedEmails[strings.ToLower(email)] = true
+	}
+
+	existing := []string{}
+	for _, recipient := range requested {
+		if !addedEmails[strings.ToLower(recipient.Email)] {
+			existing = append(existing, recipient.Email)
+		}
+	}
+	return existing
+}
+
+// RemoveRecipientHandler lets the sender cut off one recipient without revoking the whole file
+// The recipient's row and wrapped key are deleted and the removal is recorded for the sender
+func RemoveRecipientHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		fileID := vars["file_id"]
+		email := strings.TrimSpace(vars["email"])
+
+		access, ok := authorizeFileAccess(w, r, fileID)
+		if !ok {
+			return
+		}
+
+		if !access.IsSender {
+			RespondWithError(w, http.StatusForbidden, "Only the sender can remove recipients from this file", "")
+			return
+		}
+		if !requireNotInTransfer(w, access) {
+			return
+		}
+
+		if email == "" {
+			RespondWithError(w, http.StatusBadRequest, "Recipient email is required", "")
+			return
+		}
+
+		removal, err := database.RemoveFileRecipient(fileID, email)
+		if errors.Is(err, database.ErrRecipientNotFound) {
+			RespondWithError(w, http.StatusNotFound, "Recipient not found", "")
+			return
+		}
+		if err != nil {
+			log.Printf("Error removing recipient from file %s: %v", fileID, err)
+			RespondWithError(w, http.StatusInternalServerError, "Failed to remove recipient", err.Error())
+			return
+		}
+
+		log.Printf("Sender %s removed recipient %s from file %s", access.SenderID, removal.Email, fileID)
+
+		RespondWithJSON(w, http.StatusOK, models.RemoveRecipientResponse{
+			Message: "Recipient removed successfully",
+			FileID:  fileID,
+			Removal: *removal,
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"secure-document-transfer/internal/database"
+	"secure-document-transfer/internal/models"
+
+	"github.com/gorilla/mux"
+)
+
+// fileConversation resolves the conversation a file belongs to after checking the caller's access to the file
+// A file of a multi-file transfer shares the transfer's conversation; a file sent on its own is its own transfer
+// Returns whether the transfer has expired. On failure it writes the error response and returns false
+func fileConversation(w http.ResponseWriter, r *http.Request) (database.Conversation, bool, bool) {
+	fileID := mux.Vars(r)["file_id"]
+
+	access, ok := authorizeFileAccess(w, r, fileID)
+	if !ok {
+		return database.Conversation{}, false, false
+	}
+
+	metadata, err := database.GetFileMetadata(fileID)
+	if errors.Is(err, database.ErrFileNotFound) {
+		RespondWithError(w, http.StatusNotFound, "File not found", "")
+		return database.Conversation{}, false, false
+	}
+	if err != nil {
+		log.Printf("Error retrieving metadata for file %s: %v", fileID, err)
+		RespondWithError(w, http.StatusInternalServerError, "Failed to retrieve file metadata", err.Error())
+		return database.Conversation{}, false, false
+	}
+
+	if metadata.TransferID.Valid {
+		return database.Conversation{TransferID: metadata.TransferID.String}, access.Expired, true
+	}
+	return database.Conversation{FileID: fileID}, access.Expired, true
+}
+
+// transferConversation resolves the conversation of the transfer named in the request path after checking that
+// the caller is its sender or a recipient of one of its files
+// Returns whether the transfer has expired. On failure it writes the error response and returns false
+func transferConversation(w http.ResponseWriter, r *http.Request) (database.Conversation, bool, bool) {
+	transfer, _, ok := loadTransfer(w, r)
+	if !ok {
+		return database.Conversation{}, false, false
+	}
+
+	return database.Conversation{TransferID: transfer.ID}, !transfer.ExpiresAt.After(time.Now()), true
+}
+
+// PostMessageHandler posts an end-to-end encrypted message on the transfer of a file
+// Files of a multi-file transfer all lead to the transfer's conversation, see PostTransferMessageHandler
+func PostMessageHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		conversation, expired, ok := fileConversation(w, r)
+		if !ok {
+			return
+		}
+		postMessage(w, r, conversation, expired)
+	}
+}
+
+// PostTransferMessageHandler posts an end-to-end encrypted message on a transfer, as a new thread or a reply
+func PostTransferMessageHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		conversation, expired, ok := transferConversation(w, r)
+		if !ok {
+			return
+		}
+		postMessage(w, r, conversation, expired)
+	}
+}
+
+// postMessage stores a message posted by an authorized participant of the conversation
+// The server only stores the ciphertext, the IV and wrapped thread keys; it never sees a message in the clear
+func postMessage(w http.ResponseWriter, r *http.Request, conversation database.Conversation, expired bool) {
+	if expired {
+		RespondWithError(w, http.StatusGone, "Transfer has expired", "")
+		return
+	}
+
+	var req models.PostMessageRequest
+	if err := parseJSON(r, &req); err != nil {
+		RespondWithError(w, http.StatusBadRequest, "Invalid request body", err.Error())
+		return
+	}
+
+	if err := req.Validate(); err != nil {
+		RespondWithError(w, http.StatusBadRequest, err.Error(), "")
+		return
+	}
+
+	// Whoever starts a thread with its own key must be able to read the replies
+	userEmail := r.Context().Value("user_email").(string)
+	if req.ThreadID == "" && req.KeySource == models.MessageKeySourceThread {
+		if _, ok := req.ThreadKeys[strings.ToLower(userEmail)]; !ok {
+			RespondWithError(w, http.StatusBadRequest, "thread_keys must include a wrapped key for yourself", "")
+			return
+		}
+	}
+
+	userID := r.Context().Value("user_id").(string)
+	posted, err := database.CreateMessage(database.NewMessage{
+		Conversation: conversation,
+		SenderID:     userID,
+		ThreadID:     req.ThreadID,
+		KeySource:    req.KeySource,
+		KeyFileID:    req.KeyFileID,
+		ThreadKeys:   req.ThreadKeys,
+		Ciphertext:   req.Ciphertext,
+		IV:           req.IV,
+	})
+	switch {
+	case errors.Is(err, database.ErrFileNotFound):
+		RespondWithError(w, http.StatusNotFound, "Transfer not found", "")
+		return
+	case errors.Is(err, database.ErrThreadNotFound):
+		RespondWithError(w, http.StatusNotFound, "Message thread not found", "")
+		return
+	case errors.Is(err, database.ErrInvalidThreadKeys):
+		RespondWithError(w, http.StatusBadRequest, "Invalid thread_keys", err.Error())
+		return
+	case errors.Is(err, database.ErrInvalidKeyFile):
+		RespondWithError(w, http.StatusBadRequest, "Invalid key_file_id", err.Error())
+		return
+	case err != nil:
+		log.Printf("Error posting message on %s: %v", conversation, err)
+		RespondWithError(w, http.StatusInternalServerError, "Failed to post message", err.Error())
+		return
+	}
+	posted.Message.Sender.Email = userEmail
+	if posted.MissingKeys == nil {
+		posted.MissingKeys = []string{}
+	}
+
+	log.Printf("User %s posted message %s in thread %s on %s", userID, posted.Message.MessageID, posted.Message.ThreadID, conversation)
+
+	RespondWithJSON(w, http.StatusCreated, models.PostMessageResponse{
+		Message:     "Message posted successfully",
+		TransferID:  conversation.TransferID,
+		FileID:      conversation.FileID,
+		KeySource:   posted.KeySource,
+		KeyFileID:   posted.KeyFileID,
+		Posted:      posted.Message,
+		MissingKeys: posted.MissingKeys,
+	})
+}
+
+// GetMessagesHandler returns a page of the encrypted message threads on the transfer of a file
+func GetMessagesHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		conversation, _, ok := fileConversation(w, r)
+		if !ok {
+			return
+		}
+		listMessages(w, r, conversation)
+	}
+}
+
+// GetTransferMessagesHandler returns a page of the encrypted message threads on a transfer
+func GetTransferMessagesHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		conversation, _, ok := transferConversation(w, r)
+		if !ok {
+			return
+		}
+		listMessages(w, r, conversation)
+	}
+}
+
+// listMessages writes a page of the conversation's threads for an authorized participant
+// Both the sender and the recipients can read the conversation, also after the transfer expired
+func listMessages(w http.ResponseWriter, r *http.Request, conversation database.Conversation) {
+	limit, offset, err := parsePagination(r)
+	if err != nil {
+		RespondWithError(w, http.StatusBadRequest, "Invalid pagination parameters", err.Error())
+		return
+	}
+
+	userID := r.Context().Value("user_id").(string)
+	userEmail := r.Context().Value("user_email").(string)
+	threads, total, err := database.GetMessageThreads(conversation, userID, userEmail, limit, offset)
+	if err != nil {
+		log.Printf("Error retrieving messages for %s: %v", conversation, err)
+		RespondWithError(w, http.StatusInternalServerError, "Failed to retrieve messages", err.Error())
+		return
+	}
+
+	RespondWithJSON(w, http.StatusOK, models.MessagesResponse{
+		TransferID: conversation.TransferID,
+		FileID:     conversation.FileID,
+		Threads:    threads,
+		Total:      total,
+		Limit:      limit,
+		Offset:     offset,
+	})
+}
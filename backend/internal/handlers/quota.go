@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"secure-document-transfer/internal/database"
+	"secure-document-transfer/internal/models"
+)
+
+// getUsage returns a user's current usage together with the limits that apply to them
+// Per-user overrides from user_quotas take precedence over the configured defaults
+func getUsage(userID string) (*models.UsageResponse, error) {
+	usage, err := database.GetStorageUsage(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	maxStorageBytes, maxActiveTransfers := usage.Limits()
+	return &models.UsageResponse{
+		StoredBytes:        usage.StoredBytes,
+		MaxStorageBytes:    maxStorageBytes,
+		ActiveTransfers:    usage.ActiveTransfers,
+		MaxActiveTransfers: maxActiveTransfers,
+	}, nil
+}
+
+// requireQuota checks that a user can store additionalBytes more ciphertext and, if newTransfer is set,
+// start another transfer
+// This is only an early rejection before anything is uploaded; the limits are enforced again in the
+// transaction that records the write, so concurrent requests cannot overshoot them
+// On failure it writes the error response and returns false
+func requireQuota(w http.ResponseWriter, userID string, additionalBytes int64, newTransfer bool) bool {
+	usage, err := getUsage(userID)
+	if err != nil {
+		log.Printf("Error retrieving storage usage for user %s: %v", userID, err)
+		RespondWithError(w, http.StatusInternalServerError, "Failed to check storage quota", err.Error())
+		return false
+	}
+
+	if newTransfer && usage.ActiveTransfers >= usage.MaxActiveTransfers {
+		RespondWithError(w, http.StatusForbidden, "Active transfer quota exceeded",
+			fmt.Sprintf("You have %d active transfers, the limit is %d", usage.ActiveTransfers, usage.MaxActiveTransfers))
+		return false
+	}
+
+	if usage.StoredBytes+additionalBytes > usage.MaxStorageBytes {
+		RespondWithError(w, http.StatusForbidden, "Storage quota exceeded",
+			fmt.Sprintf("%d of %d bytes used, %d more requested", usage.StoredBytes, usage.MaxStorageBytes, additionalBytes))
+		return false
+	}
+
+	return true
+}
+
+// respondQuotaError writes the response for a write the database rejected because of a quota
+// Returns false if err is not a quota error, leaving the response to the caller
+func respondQuotaError(w http.ResponseWriter, err error) bool {
+	switch {
+	case errors.Is(err, database.ErrTransferQuotaExceeded):
+		RespondWithError(w, http.StatusForbidden, "Active transfer quota exceeded", err.Error())
+	case errors.Is(err, database.ErrStorageQuotaExceeded):
+		RespondWithError(w, http.StatusForbidden, "Storage quota exceeded", err.Error())
+	default:
+		return false
+	}
+	return true
+}
+
+// GetUsageHandler returns the authenticated user's storage usage and quotas
+func GetUsageHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.Context().Value("user_id")
+		if userID == nil {
+			RespondWithError(w, http.StatusUnauthorized, "User not authenticated", "")
+			return
+		}
+
+		usage, err := getUsage(userID.(string))
+		if err != nil {
+			log.Printf("Error retrieving storage usage: %v", err)
+			RespondWithError(w, http.StatusInternalServerError, "Failed to retrieve storage usage", err.Error())
+			return
+		}
+
+		RespondWithJSON(w, http.StatusOK, usage)
+	}
+}
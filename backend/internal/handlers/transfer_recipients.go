@@ -0,0 +1,304 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"secure-document-transfer/internal/database"
+	"secure-document-transfer/internal/models"
+
+	"github.com/gorilla/mux"
+)
+
+// AddTransferRecipientsHandler lets the sender share every file of a transfer with more recipients
+// The files of a transfer share one recipient list, so recipients are added to all of them in one transaction.
+// Each file's key comes wrapped for every new recipient, so no chunks are uploaded again
+func AddTransferRecipientsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		transfer, files, ok := loadTransfer(w, r)
+		if !ok {
+			return
+		}
+
+		if transfer.SenderID != r.Context().Value("user_id").(string) {
+			RespondWithError(w, http.StatusForbidden, "Only the sender can add recipients to this transfer", "")
+			return
+		}
+		if !transfer.ExpiresAt.After(time.Now()) {
+			RespondWithError(w, http.StatusGone, "Transfer has expired", "")
+			return
+		}
+
+		var req models.TransferRecipientsRequest
+		if err := parseJSON(r, &req); err != nil {
+			RespondWithError(w, http.StatusBadRequest, "Invalid request body", err.Error())
+			return
+		}
+
+		if err := req.Validate(); err != nil {
+			RespondWithError(w, http.StatusBadRequest, err.Error(), "")
+			return
+		}
+
+		recipients := req.FileRecipients()
+		if err := checkTransferKeys(files, recipients, req.EncryptedKeys); err != nil {
+			RespondWithError(w, http.StatusBadRequest, "Missing wrapped keys", err.Error())
+			return
+		}
+
+		recipientRecords, _, err := prepareRecipients(recipients)
+		if err != nil {
+			RespondWithError(w, http.StatusInternalServerError, "Failed to prepare recipients", err.Error())
+			return
+		}
+
+		fileRecipients := make([]database.TransferFileRecipients, len(files))
+		for i, file := range files {
+			fileRecipients[i] = database.TransferFileRecipients{
+				FileID:     file.Metadata.FileID,
+				Recipients: withFileKeys(recipientRecords, req.EncryptedKeys[file.Metadata.FileID]),
+			}
+		}
+
+		added, err := database.AddTransferRecipients(transfer.ID, fileRecipients)
+		if respondTransferChangeError(w, err) {
+			return
+		}
+		if err != nil {
+			log.Printf("Error adding recipients to transfer %s: %v", transfer.ID, err)
+			RespondWithError(w, http.StatusInternalServerError, "Failed to add recipients", err.Error())
+			return
+		}
+
+		log.Printf("Sender %s added %d recipient(s) to transfer %s", transfer.SenderID, len(added), transfer.ID)
+
+		RespondWithJSON(w, http.StatusOK, models.TransferRecipientsResponse{
+			Message:           "Recipients added successfully",
+			TransferID:        transfer.ID,
+			Added:             added,
+			AlreadyRecipients: alreadyRecipients(recipients, added),
+		})
+	}
+}
+
+// RemoveTransferRecipientHandler lets the sender cut off one recipient from every file of a transfer
+// The recipient's rows and wrapped keys are deleted and a removal is recorded for each file
+func RemoveTransferRecipientHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		transfer, _, ok := loadTransfer(w, r)
+		if !ok {
+			return
+		}
+
+		if transfer.SenderID != r.Context().Value("user_id").(string) {
+			RespondWithError(w, http.StatusForbidden, "Only the sender can remove recipients from this transfer", "")
+			return
+		}
+
+		email := strings.TrimSpace(mux.Vars(r)["email"])
+		if email == "" {
+			RespondWithError(w, http.StatusBadRequest, "Recipient email is required", "")
+			return
+		}
+
+		removals, err := database.RemoveTransferRecipient(transfer.ID, email)
+		if errors.Is(err, database.ErrRecipientNotFound) {
+			RespondWithError(w, http.StatusNotFound, "Recipient not found", "")
+			return
+		}
+		if errors.Is(err, database.ErrTransferNotFound) {
+			RespondWithError(w, http.StatusNotFound, "Transfer not found", "")
+			return
+		}
+		if err != nil {
+			log.Printf("Error removing recipient from transfer %s: %v", transfer.ID, err)
+			RespondWithError(w, http.StatusInternalServerError, "Failed to remove recipient", err.Error())
+			return
+		}
+
+		log.Printf("Sender %s removed recipient %s from %d file(s) of transfer %s", transfer.SenderID, email, len(removals), transfer.ID)
+
+		RespondWithJSON(w, http.StatusOK, models.RemoveTransferRecipientResponse{
+			Message:    "Recipient removed successfully",
+			TransferID: transfer.ID,
+			Removals:   removals,
+		})
+	}
+}
+
+// ForwardTransferHandler lets a recipient pass every file of a transfer on to new recipients
+// As with ForwardFileHandler, each file's key is unwrapped client-side and sent wrapped for each new recipient,
+// and the forwarded download limits of each file are charged against the forwarding recipient's
+func ForwardTransferHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		transfer, files, ok := loadTransfer(w, r)
+		if !ok {
+			return
+		}
+
+		forwarderID := r.Context().Value("user_id").(string)
+		forwarderEmail := r.Context().Value("user_email").(string)
+		if transfer.SenderID == forwarderID {
+			RespondWithError(w, http.StatusForbidden, "Only recipients can forward this transfer", "Senders add recipients with POST /api/transfers/{transfer_id}/recipients")
+			return
+		}
+		if !transfer.ExpiresAt.After(time.Now()) {
+			RespondWithError(w, http.StatusGone, "Transfer has expired", "")
+			return
+		}
+
+		// The whole transfer is forwarded, so the caller must be able to download every file of it
+		for _, file := range files {
+			if !file.Metadata.CompletedAt.Valid {
+				RespondWithError(w, http.StatusConflict, "Transfer upload is not complete", "")
+				return
+			}
+			if file.Access == nil || !file.Access.IsRecipient {
+				RespondWithError(w, http.StatusForbidden, "Only recipients of every file can forward this transfer", "")
+				return
+			}
+			if !requireNotExpired(w, file.Access) || !requireDownloadsRemaining(w, file.Access) {
+				return
+			}
+		}
+
+		var req models.TransferRecipientsRequest
+		if err := parseJSON(r, &req); err != nil {
+			RespondWithError(w, http.StatusBadRequest, "Invalid request body", err.Error())
+			return
+		}
+
+		if err := req.Validate(); err != nil {
+			RespondWithError(w, http.StatusBadRequest, err.Error(), "")
+			return
+		}
+
+		recipients := req.FileRecipients()
+		if err := checkTransferKeys(files, recipients, req.EncryptedKeys); err != nil {
+			RespondWithError(w, http.StatusBadRequest, "Missing wrapped keys", err.Error())
+			return
+		}
+
+		emails := make([]string, len(recipients))
+		for i, recipient := range recipients {
+			emails[i] = recipient.Email
+		}
+		maxDownloads := make([][]*int, len(files))
+		for i, file := range files {
+			for _, email := range emails {
+				if err := checkForwardPolicy(file.Access.ForwardPolicy, forwarderEmail, email); err != nil {
+					RespondWithError(w, http.StatusForbidden, "Forwarding not allowed", err.Error())
+					return
+				}
+			}
+
+			limits, err := forwardedDownloadLimits(file.Access, recipients)
+			if err != nil {
+				RespondWithError(w, http.StatusForbidden, "Not enough downloads left to forward", err.Error())
+				return
+			}
+			maxDownloads[i] = limits
+
+			// Refuse removed recipients before prepareRecipients creates accounts and sends emails for them
+			err = database.CheckRemovedRecipients(file.Metadata.FileID, emails)
+			if respondForwardError(w, err) {
+				return
+			}
+			if err != nil {
+				log.Printf("Error checking recipient removals of file %s: %v", file.Metadata.FileID, err)
+				RespondWithError(w, http.StatusInternalServerError, "Failed to check recipients", err.Error())
+				return
+			}
+		}
+
+		recipientRecords, _, err := prepareRecipients(recipients)
+		if err != nil {
+			RespondWithError(w, http.StatusInternalServerError, "Failed to prepare recipients", err.Error())
+			return
+		}
+
+		fileRecipients := make([]database.TransferFileRecipients, len(files))
+		for i, file := range files {
+			records := withFileKeys(recipientRecords, req.EncryptedKeys[file.Metadata.FileID])
+			for j := range records {
+				records[j].ForwardedBy = &forwarderID
+				records[j].MaxDownloads = maxDownloads[i][j]
+			}
+			fileRecipients[i] = database.TransferFileRecipients{
+				FileID:         file.Metadata.FileID,
+				ForwarderRowID: file.Access.RecipientRowID,
+				Recipients:     records,
+			}
+		}
+
+		added, err := database.AddTransferRecipients(transfer.ID, fileRecipients)
+		if respondTransferChangeError(w, err) || respondForwardError(w, err) {
+			return
+		}
+		if err != nil {
+			log.Printf("Error forwarding transfer %s: %v", transfer.ID, err)
+			RespondWithError(w, http.StatusInternalServerError, "Failed to forward transfer", err.Error())
+			return
+		}
+
+		log.Printf("Recipient %s forwarded transfer %s to %d recipient(s)", forwarderEmail, transfer.ID, len(added))
+
+		RespondWithJSON(w, http.StatusOK, models.TransferRecipientsResponse{
+			Message:           "Transfer forwarded successfully",
+			TransferID:        transfer.ID,
+			Added:             added,
+			AlreadyRecipients: alreadyRecipients(recipients, added),
+		})
+	}
+}
+
+// checkTransferKeys checks that the wrapped keys cover every file of the transfer for every recipient, and no
+// other files, so the new recipients are added to all files alike
+func checkTransferKeys(files []transferFile, recipients []models.FileRecipientRequest, encryptedKeys map[string]map[string]string) error {
+	fileIDs := make(map[string]bool, len(files))
+	for _, file := range files {
+		fileID := file.Metadata.FileID
+		fileIDs[fileID] = true
+		for _, recipient := range recipients {
+			if encryptedKeys[fileID][recipient.Email] == "" {
+				return fmt.Errorf("no wrapped key of file %s for %s", fileID, recipient.Email)
+			}
+		}
+	}
+
+	for fileID := range encryptedKeys {
+		if !fileIDs[fileID] {
+			return fmt.Errorf("file %s is not part of the transfer", fileID)
+		}
+	}
+
+	return nil
+}
+
+// withFileKeys returns a copy of the recipient records with the wrapped keys of one file (email -> wrapped key)
+func withFileKeys(records []database.RecipientRecord, keys map[string]string) []database.RecipientRecord {
+	fileRecords := make([]database.RecipientRecord, len(records))
+	for i, record := range records {
+		record.EncryptedKey = keys[record.Email]
+		fileRecords[i] = record
+	}
+	return fileRecords
+}
+
+// respondTransferChangeError writes the response for the errors that refuse a change to a transfer's recipients
+// and reports whether err was one
+func respondTransferChangeError(w http.ResponseWriter, err error) bool {
+	switch {
+	case errors.Is(err, database.ErrTransferNotFound), errors.Is(err, database.ErrFileNotFound):
+		RespondWithError(w, http.StatusNotFound, "Transfer not found", "")
+	case errors.Is(err, database.ErrTransferFilesChanged):
+		RespondWithError(w, http.StatusConflict, "The files of the transfer have changed", "Reload the transfer and try again")
+	default:
+		return false
+	}
+	return true
+}
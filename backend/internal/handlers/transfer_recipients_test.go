@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"testing"
+
+	"secure-document-transfer/internal/database"
+	"secure-document-transfer/internal/models"
+)
+
+func TestCheckTransferKeys(t *testing.T) {
+	files := []transferFile{
+		{Metadata: &database.FileMetadata{FileID: "file-a"}},
+		{Metadata: &database.FileMetadata{FileID: "file-b"}},
+	}
+	recipients := []models.FileRecipientRequest{{Email: "bob@example.com"}, {Email: "carol@example.com"}}
+
+	tests := []struct {
+		name  string
+		keys  map[string]map[string]string
+		valid bool
+	}{
+		{"every file for every recipient", map[string]map[string]string{
+			"file-a": {"bob@example.com": "ka1", "carol@example.com": "ka2"},
+			"file-b": {"bob@example.com": "kb1", "carol@example.com": "kb2"},
+		}, true},
+		{"missing file", map[string]map[string]string{
+			"file-a": {"bob@example.com": "ka1", "carol@example.com": "ka2"},
+		}, false},
+		{"missing recipient", map[string]map[string]string{
+			"file-a": {"bob@example.com": "ka1", "carol@example.com": "ka2"},
+			"file-b": {"bob@example.com": "kb1"},
+		}, false},
+		{"file outside the transfer", map[string]map[string]string{
+			"file-a": {"bob@example.com": "ka1", "carol@example.com": "ka2"},
+			"file-b": {"bob@example.com": "kb1", "carol@example.com": "kb2"},
+			"file-c": {"bob@example.com": "kc1", "carol@example.com": "kc2"},
+		}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkTransferKeys(files, recipients, tt.keys)
+			if tt.valid && err != nil {
+				t.Errorf("checkTransferKeys() error = %v, want nil", err)
+			}
+			if !tt.valid && err == nil {
+				t.Error("checkTransferKeys() error = nil, want an error")
+			}
+		})
+	}
+}
+
+func TestWithFileKeys(t *testing.T) {
+	records := []database.RecipientRecord{{Email: "bob@example.com"}, {Email: "carol@example.com"}}
+
+	fileRecords := withFileKeys(records, map[string]string{"bob@example.com": "kb", "carol@example.com": "kc"})
+	if fileRecords[0].EncryptedKey != "kb" || fileRecords[1].EncryptedKey != "kc" {
+		t.Errorf("withFileKeys() keys = %q, %q, want kb, kc", fileRecords[0].EncryptedKey, fileRecords[1].EncryptedKey)
+	}
+	if records[0].EncryptedKey != "" {
+		t.Error("withFileKeys() modified the shared records")
+	}
+}
@@ -0,0 +1,313 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"secure-document-transfer/internal/config"
+	"secure-document-transfer/internal/database"
+	"secure-document-transfer/internal/models"
+
+	"github.com/gorilla/mux"
+)
+
+// CreateTransferHandler starts a multi-file transfer
+// The transfer, its files and every file's recipients are created in a single transaction. All files
+// share one recipient list and one expiry, and unknown recipients get a single account creation email
+// for the whole transfer. Each file is then uploaded and finalized like a file sent on its own
+func CreateTransferHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.Context().Value("user_id")
+		if userID == nil {
+			RespondWithError(w, http.StatusUnauthorized, "User not authenticated", "")
+			return
+		}
+		senderID := userID.(string)
+
+		var req models.CreateTransferRequest
+		if err := parseJSON(r, &req); err != nil {
+			RespondWithError(w, http.StatusBadRequest, "Invalid request body", err.Error())
+			return
+		}
+
+		if err := req.Validate(); err != nil {
+			RespondWithError(w, http.StatusBadRequest, err.Error(), "")
+			return
+		}
+
+		expiresAt, err := resolveExpiry(req.ExpiresAt, time.Now(), config.DefaultTransferExpiry(), config.MaxTransferExpiry())
+		if err != nil {
+			RespondWithError(w, http.StatusBadRequest, "Invalid expires_at", err.Error())
+			return
+		}
+
+		// Every file must fit in the sender's remaining storage quota; the transfer counts as one
+		var expectedBytes int64
+		for _, file := range req.Files {
+			expectedBytes += database.ExpectedCiphertextSize(file.FileSize, file.TotalChunks)
+		}
+		if !requireQuota(w, senderID, expectedBytes, true) {
+			return
+		}
+
+		// Recipients are resolved (and created) once for the whole transfer
+		recipientRecords, _, err := prepareRecipients(req.FileRecipients())
+		if err != nil {
+			RespondWithError(w, http.StatusInternalServerError, "Failed to prepare recipients", err.Error())
+			return
+		}
+
+		files := make([]database.TransferFileRecord, len(req.Files))
+		created := make([]models.CreatedTransferFile, len(req.Files))
+		for i, file := range req.Files {
+			records := make([]database.RecipientRecord, len(recipientRecords))
+			missingKeys := []string{}
+			for j, record := range recipientRecords {
+				record.EncryptedKey = file.EncryptedKeys[record.Email]
+				if record.EncryptedKey == "" {
+					missingKeys = append(missingKeys, record.Email)
+				}
+				records[j] = record
+			}
+
+			files[i] = database.TransferFileRecord{
+				RelativePath:     file.RelativePath,
+				OriginalFilename: file.FileName(),
+				FileSize:         file.FileSize,
+				TotalChunks:      file.TotalChunks,
+				MimeType:         file.MimeType,
+				Recipients:       records,
+			}
+			created[i] = models.CreatedTransferFile{
+				RelativePath: file.RelativePath,
+				TotalChunks:  file.TotalChunks,
+				MissingKeys:  missingKeys,
+			}
+		}
+
+		transferID, fileIDs, err := database.CreateTransfer(senderID, expiresAt, req.ForwardPolicy, files)
+		if respondQuotaError(w, err) {
+			return
+		}
+		if err != nil {
+			log.Printf("Error creating transfer: %v", err)
+			RespondWithError(w, http.StatusInternalServerError, "Failed to create transfer", err.Error())
+			return
+		}
+		for i := range created {
+			created[i].FileID = fileIDs[i]
+		}
+
+		log.Printf("Created transfer %s with %d file(s) for %d recipient(s)", transferID, len(files), len(recipientRecords))
+
+		RespondWithJSON(w, http.StatusCreated, models.CreateTransferResponse{
+			Message:       "Transfer created successfully",
+			TransferID:    transferID,
+			ExpiresAt:     expiresAt,
+			ForwardPolicy: req.ForwardPolicy,
+			Files:         created,
+		})
+	}
+}
+
+// GetTransfersHandler returns a page of transfers sent by the authenticated user or shared with them
+func GetTransfersHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.Context().Value("user_id")
+		userEmail := r.Context().Value("user_email")
+		if userID == nil || userEmail == nil {
+			RespondWithError(w, http.StatusUnauthorized, "User not authenticated", "")
+			return
+		}
+
+		limit, offset, err := parsePagination(r)
+		if err != nil {
+			RespondWithError(w, http.StatusBadRequest, "Invalid pagination parameters", err.Error())
+			return
+		}
+
+		transfers, total, err := database.GetTransfers(userID.(string), userEmail.(string), limit, offset)
+		if err != nil {
+			log.Printf("Error retrieving transfers: %v", err)
+			RespondWithError(w, http.StatusInternalServerError, "Failed to retrieve transfers", err.Error())
+			return
+		}
+
+		RespondWithJSON(w, http.StatusOK, models.TransfersResponse{
+			Transfers: transfers,
+			Total:     total,
+			Limit:     limit,
+			Offset:    offset,
+		})
+	}
+}
+
+// transferFile is one file of a transfer together with the caller's access to it
+// Access is nil when the caller cannot see the file (not a recipient, or the upload is not complete yet)
+type transferFile struct {
+	Metadata *database.FileMetadata
+	Access   *database.FileAccess
+}
+
+// loadTransfer looks up the transfer named in the request path and the caller's access to each of its files
+// The sender sees every file; recipients see the completed files they are a recipient of
+// On failure it writes the error response and returns false
+func loadTransfer(w http.ResponseWriter, r *http.Request) (*database.TransferRecord, []transferFile, bool) {
+	userID := r.Context().Value("user_id")
+	userEmail := r.Context().Value("user_email")
+	if userID == nil || userEmail == nil {
+		RespondWithError(w, http.StatusUnauthorized, "User not authenticated", "")
+		return nil, nil, false
+	}
+
+	transferID := mux.Vars(r)["transfer_id"]
+	if !models.IsValidTransferID(transferID) {
+		RespondWithError(w, http.StatusBadRequest, "Invalid transfer ID", "")
+		return nil, nil, false
+	}
+
+	transfer, fileIDs, err := database.GetTransfer(transferID)
+	if errors.Is(err, database.ErrTransferNotFound) {
+		RespondWithError(w, http.StatusNotFound, "Transfer not found", "")
+		return nil, nil, false
+	}
+	if err != nil {
+		log.Printf("Error retrieving transfer %s: %v", transferID, err)
+		RespondWithError(w, http.StatusInternalServerError, "Failed to retrieve transfer", err.Error())
+		return nil, nil, false
+	}
+
+	files := make([]transferFile, 0, len(fileIDs))
+	visible := 0
+	for _, fileID := range fileIDs {
+		metadata, err := database.GetFileMetadata(fileID)
+		if errors.Is(err, database.ErrFileNotFound) {
+			// Revoked since the transfer was loaded
+			continue
+		}
+		if err != nil {
+			log.Printf("Error retrieving metadata for file %s: %v", fileID, err)
+			RespondWithError(w, http.StatusInternalServerError, "Failed to retrieve file metadata", err.Error())
+			return nil, nil, false
+		}
+
+		access, err := database.GetFileAccess(fileID, userID.(string), userEmail.(string))
+		switch {
+		case errors.Is(err, database.ErrFileNotFound), errors.Is(err, database.ErrFileRevoked),
+			errors.Is(err, database.ErrFileAccessDenied), errors.Is(err, database.ErrRecipientRemoved):
+			access = nil
+		case err != nil:
+			log.Printf("Error checking access to file %s: %v", fileID, err)
+			RespondWithError(w, http.StatusInternalServerError, "Failed to check file access", err.Error())
+			return nil, nil, false
+		case !access.IsSender && !access.Completed:
+			access = nil
+		}
+
+		if access != nil {
+			visible++
+		}
+		files = append(files, transferFile{Metadata: metadata, Access: access})
+	}
+
+	if transfer.SenderID != userID.(string) && visible == 0 {
+		RespondWithError(w, http.StatusForbidden, "You do not have access to this transfer", "")
+		return nil, nil, false
+	}
+
+	return transfer, files, true
+}
+
+// GetTransferHandler returns a transfer and the files of it the caller can see
+func GetTransferHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		transfer, files, ok := loadTransfer(w, r)
+		if !ok {
+			return
+		}
+
+		response := models.Transfer{
+			TransferID: transfer.ID,
+			Sender:     models.User{ID: transfer.SenderID, Email: transfer.SenderEmail},
+			IsSender:   transfer.SenderID == r.Context().Value("user_id").(string),
+			CreatedAt:  transfer.CreatedAt,
+			ExpiresAt:  transfer.ExpiresAt,
+			Expired:    !transfer.ExpiresAt.After(time.Now()),
+			FileCount:  len(files),
+			Completed:  len(files) > 0,
+			Files:      []models.TransferFile{},
+		}
+		for _, file := range files {
+			metadata := file.Metadata
+			response.TotalSize += metadata.FileSize
+			response.Completed = response.Completed && metadata.CompletedAt.Valid
+			if metadata.ExpiredAt.Valid {
+				response.Expired = true
+			}
+			if file.Access == nil {
+				continue
+			}
+
+			transferFile := models.TransferFile{
+				FileID:       metadata.FileID,
+				RelativePath: metadata.RelativePath.String,
+				FileSize:     metadata.FileSize,
+				MimeType:     metadata.MimeType.String,
+				TotalChunks:  metadata.TotalChunks,
+			}
+			if metadata.CompletedAt.Valid {
+				transferFile.CompletedAt = &metadata.CompletedAt.Time
+			}
+			response.Files = append(response.Files, transferFile)
+		}
+
+		RespondWithJSON(w, http.StatusOK, response)
+	}
+}
+
+// GetTransferManifestHandler returns the manifest of every file of a transfer the caller can download,
+// so the whole transfer can be downloaded as one unit
+// Files whose download limit the caller has reached are left out
+func GetTransferManifestHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		transfer, files, ok := loadTransfer(w, r)
+		if !ok {
+			return
+		}
+
+		if !transfer.ExpiresAt.After(time.Now()) {
+			RespondWithError(w, http.StatusGone, "Transfer has expired", "")
+			return
+		}
+
+		manifest := models.TransferManifest{
+			TransferID: transfer.ID,
+			ExpiresAt:  transfer.ExpiresAt,
+			Completed:  len(files) > 0,
+			Files:      []models.FileManifest{},
+		}
+		for _, file := range files {
+			manifest.Completed = manifest.Completed && file.Metadata.CompletedAt.Valid
+			if file.Access == nil || file.Access.Expired || file.Access.DownloadLimitReached() {
+				continue
+			}
+
+			fileManifest, err := buildFileManifest(file.Metadata, file.Access)
+			if err != nil {
+				log.Printf("Error building manifest for file %s: %v", file.Metadata.FileID, err)
+				RespondWithError(w, http.StatusInternalServerError, "Failed to build file manifest", err.Error())
+				return
+			}
+			manifest.Files = append(manifest.Files, *fileManifest)
+		}
+
+		if len(manifest.Files) == 0 && transfer.SenderID != r.Context().Value("user_id").(string) {
+			RespondWithError(w, http.StatusForbidden, "Download limit reached", "")
+			return
+		}
+
+		RespondWithJSON(w, http.StatusOK, manifest)
+	}
+}
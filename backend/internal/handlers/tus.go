@@ -0,0 +1,460 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"secure-document-transfer/internal/config"
+	"secure-document-transfer/internal/database"
+	"secure-document-transfer/internal/models"
+	"secure-document-transfer/internal/storage"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	// tusVersion is the only tus protocol version the server speaks
+	tusVersion = "1.0.0"
+	// tusExtensions lists the tus extensions the server supports
+	tusExtensions = "creation,termination"
+	// tusContentType is the content type tus clients must use for PATCH requests
+	tusContentType = "application/offset+octet-stream"
+)
+
+// SetTusCapabilities writes the headers a tus client reads from an OPTIONS request
+func SetTusCapabilities(w http.ResponseWriter) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	w.Header().Set("Tus-Max-Size", strconv.FormatInt(config.MaxChunkUploadBytes(), 10))
+}
+
+// requireTusResumable checks the Tus-Resumable header of a tus request and sets it on the response
+// On failure it writes the error response and returns false
+func requireTusResumable(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		RespondWithError(w, http.StatusPreconditionFailed, "Unsupported tus version", "Tus-Resumable must be "+tusVersion)
+		return false
+	}
+	return true
+}
+
+// parseUploadMetadata decodes a tus Upload-Metadata header
+// The header is a comma-separated list of keys, each optionally followed by a space and a base64 value
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, fmt.Errorf("empty metadata key")
+		}
+		if _, ok := metadata[key]; ok {
+			return nil, fmt.Errorf("duplicate metadata key %s", key)
+		}
+
+		value, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("invalid base64 value for metadata key %s", key)
+		}
+		metadata[key] = string(value)
+	}
+
+	return metadata, nil
+}
+
+// CreateTusUploadHandler handles tus creation requests
+// Each tus upload carries one encrypted chunk of an existing file, described by the Upload-Metadata
+// keys file_id, chunk_index, iv and optional sha256
+func CreateTusUploadHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requireTusResumable(w, r) {
+			return
+		}
+
+		userID := r.Context().Value("user_id")
+		if userID == nil {
+			RespondWithError(w, http.StatusUnauthorized, "User not authenticated", "")
+			return
+		}
+		senderID := userID.(string)
+
+		if r.Header.Get("Upload-Defer-Length") != "" {
+			RespondWithError(w, http.StatusBadRequest, "Upload-Defer-Length is not supported", "")
+			return
+		}
+		uploadLength, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+		if err != nil || uploadLength < 0 {
+			RespondWithError(w, http.StatusBadRequest, "Invalid Upload-Length", "")
+			return
+		}
+		if uploadLength > config.MaxChunkUploadBytes() {
+			RespondWithError(w, http.StatusRequestEntityTooLarge, "Upload-Length exceeds Tus-Max-Size", "")
+			return
+		}
+
+		fields, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+		if err != nil {
+			RespondWithError(w, http.StatusBadRequest, "Invalid Upload-Metadata", err.Error())
+			return
+		}
+
+		fileID := fields["file_id"]
+		iv := fields["iv"]
+		clientSHA256 := strings.ToLower(strings.TrimSpace(fields["sha256"]))
+
+		var missingFields []string
+		if fileID == "" {
+			missingFields = append(missingFields, "file_id")
+		}
+		if fields["chunk_index"] == "" {
+			missingFields = append(missingFields, "chunk_index")
+		}
+		if iv == "" {
+			missingFields = append(missingFields, "iv")
+		}
+		if len(missingFields) > 0 {
+			RespondWithError(w, http.StatusBadRequest, "Missing Upload-Metadata keys: "+strings.Join(missingFields, ", "), "")
+			return
+		}
+
+		if !models.IsValidFileID(fileID) {
+			RespondWithError(w, http.StatusBadRequest, "Invalid file_id", "")
+			return
+		}
+		if clientSHA256 != "" && !isSHA256Hex(clientSHA256) {
+			RespondWithError(w, http.StatusBadRequest, "Invalid sha256", "sha256 must be the hex-encoded SHA-256 of the encrypted chunk")
+			return
+		}
+		chunkIndex, err := strconv.Atoi(fields["chunk_index"])
+		if err != nil {
+			RespondWithError(w, http.StatusBadRequest, "Invalid chunk_index", err.Error())
+			return
+		}
+
+		metadata, err := database.GetFileMetadata(fileID)
+		if errors.Is(err, database.ErrFileNotFound) {
+			RespondWithError(w, http.StatusNotFound, "File not found", "Create the file with POST /api/files before uploading chunks")
+			return
+		}
+		if err != nil {
+			log.Printf("Error retrieving metadata for file %s: %v", fileID, err)
+			RespondWithError(w, http.StatusInternalServerError, "Failed to retrieve file metadata", err.Error())
+			return
+		}
+
+		if metadata.SenderID != senderID {
+			RespondWithError(w, http.StatusForbidden, "Only the sender can upload chunks to this file", "")
+			return
+		}
+		if metadata.HasExpired() {
+			RespondWithError(w, http.StatusGone, "File has expired", "")
+			return
+		}
+		if metadata.CompletedAt.Valid {
+			RespondWithError(w, http.StatusConflict, "File upload is already complete", "")
+			return
+		}
+		if chunkIndex < 0 || chunkIndex >= metadata.TotalChunks {
+			RespondWithError(w, http.StatusBadRequest, "Invalid chunk_index",
+				fmt.Sprintf("chunk_index must be between 0 and %d", metadata.TotalChunks-1))
+			return
+		}
+
+		// The file's space was reserved when it was created; pending uploads beyond it are checked when the
+		// upload is created and the chunk again when it is assembled
+		if !requireQuota(w, senderID, 0, false) {
+			return
+		}
+
+		uploadID, err := database.CreateTusUpload(database.TusUpload{
+			FileID:        fileID,
+			SenderID:      senderID,
+			ChunkIndex:    chunkIndex,
+			EncryptionIV:  iv,
+			ContentSHA256: clientSHA256,
+			UploadLength:  uploadLength,
+		})
+		if errors.Is(err, database.ErrFileExpired) {
+			RespondWithError(w, http.StatusGone, "File has expired", "")
+			return
+		}
+		if respondQuotaError(w, err) {
+			return
+		}
+		if err != nil {
+			log.Printf("Error creating tus upload for chunk %d of file %s: %v", chunkIndex, fileID, err)
+			RespondWithError(w, http.StatusInternalServerError, "Failed to create upload", err.Error())
+			return
+		}
+
+		w.Header().Set("Location", "/api/tus/"+uploadID)
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+// loadTusUpload looks up the tus upload named in the request path and checks that the caller created it
+// Uploads of other users are reported as not found. On failure it writes the error response and returns false
+func loadTusUpload(w http.ResponseWriter, r *http.Request) (*database.TusUpload, bool) {
+	userID := r.Context().Value("user_id")
+	if userID == nil {
+		RespondWithError(w, http.StatusUnauthorized, "User not authenticated", "")
+		return nil, false
+	}
+
+	uploadID := mux.Vars(r)["upload_id"]
+	if !models.IsValidUploadID(uploadID) {
+		RespondWithError(w, http.StatusNotFound, "Upload not found", "")
+		return nil, false
+	}
+
+	upload, err := database.GetTusUpload(uploadID)
+	if errors.Is(err, database.ErrTusUploadNotFound) || (err == nil && upload.SenderID != userID.(string)) {
+		RespondWithError(w, http.StatusNotFound, "Upload not found", "")
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("Error retrieving tus upload %s: %v", uploadID, err)
+		RespondWithError(w, http.StatusInternalServerError, "Failed to retrieve upload", err.Error())
+		return nil, false
+	}
+
+	return upload, true
+}
+
+// GetTusUploadOffsetHandler handles tus HEAD requests, reporting how many bytes of an upload have been received
+func GetTusUploadOffsetHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requireTusResumable(w, r) {
+			return
+		}
+
+		upload, ok := loadTusUpload(w, r)
+		if !ok {
+			return
+		}
+
+		writeTusOffset(w, upload, completeTusUpload)
+	}
+}
+
+// writeTusOffset answers a tus HEAD request for an upload
+// The upload record is deleted once its chunk is stored, so a record with every byte received means the final
+// PATCH failed or the server stopped before storing the chunk. tus clients take an Upload-Offset equal to the
+// Upload-Length as success and would never retry, so the chunk is stored first; if that fails the error is
+// returned instead of the offset and the client retries the HEAD
+func writeTusOffset(w http.ResponseWriter, upload *database.TusUpload, complete func(*database.TusUpload) chunkResult) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	if upload.UploadOffset == upload.UploadLength {
+		result := complete(upload)
+		if result.Status != http.StatusOK {
+			RespondWithError(w, result.Status, result.Error, result.Details)
+			return
+		}
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.UploadOffset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.UploadLength, 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+// PatchTusUploadHandler handles tus PATCH requests
+// Each request body is streamed to storage as one segment. Once every byte has been received the segments
+// are streamed back through the regular chunk ingestion, which verifies and records the chunk
+func PatchTusUploadHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requireTusResumable(w, r) {
+			return
+		}
+
+		if r.Header.Get("Content-Type") != tusContentType {
+			RespondWithError(w, http.StatusUnsupportedMediaType, "Content-Type must be "+tusContentType, "")
+			return
+		}
+		offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+		if err != nil || offset < 0 {
+			RespondWithError(w, http.StatusBadRequest, "Invalid Upload-Offset", "")
+			return
+		}
+
+		upload, ok := loadTusUpload(w, r)
+		if !ok {
+			return
+		}
+		if offset != upload.UploadOffset {
+			RespondWithError(w, http.StatusConflict, "Upload-Offset does not match the current offset",
+				fmt.Sprintf("The upload is at offset %d", upload.UploadOffset))
+			return
+		}
+
+		if offset < upload.UploadLength {
+			r.Body = http.MaxBytesReader(w, r.Body, upload.UploadLength-offset)
+			counter := &countingReader{reader: r.Body}
+			segmentPath, err := storage.UploadTusSegment(upload.FileID, upload.ID, offset, counter)
+			if err != nil {
+				if isBodyTooLarge(err) {
+					RespondWithError(w, http.StatusRequestEntityTooLarge, "Request body exceeds the remaining Upload-Length", "")
+					return
+				}
+				log.Printf("Error uploading tus segment of upload %s: %v", upload.ID, err)
+				RespondWithError(w, http.StatusInternalServerError, "Failed to store upload data", err.Error())
+				return
+			}
+
+			if counter.n == 0 {
+				discardChunk(segmentPath)
+			} else {
+				upload.UploadOffset, err = database.AppendTusSegment(upload.FileID, upload.ID, offset, counter.n, segmentPath)
+				if err != nil {
+					discardChunk(segmentPath)
+					if errors.Is(err, database.ErrTusOffsetMismatch) {
+						RespondWithError(w, http.StatusConflict, "Upload-Offset does not match the current offset", "")
+						return
+					}
+					if errors.Is(err, database.ErrFileExpired) {
+						RespondWithError(w, http.StatusGone, "File has expired", "")
+						return
+					}
+					log.Printf("Error recording tus segment of upload %s: %v", upload.ID, err)
+					RespondWithError(w, http.StatusInternalServerError, "Failed to record upload data", err.Error())
+					return
+				}
+				upload.SegmentPaths = append(upload.SegmentPaths, segmentPath)
+			}
+		}
+
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.UploadOffset, 10))
+
+		// A PATCH that completes the upload (or an empty PATCH once it is complete) stores the chunk; if that fails
+		// the next HEAD stores it, see writeTusOffset
+		if upload.UploadOffset == upload.UploadLength {
+			result := completeTusUpload(upload)
+			if result.Status != http.StatusOK {
+				RespondWithError(w, result.Status, result.Error, result.Details)
+				return
+			}
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// completeTusUpload streams the segments of a fully received tus upload into the upload's chunk
+// On success, or when the chunk is rejected, the segments and the upload are deleted. Server errors
+// keep them so the client can retry with a HEAD or the final PATCH
+func completeTusUpload(upload *database.TusUpload) chunkResult {
+	metadata, err := database.GetFileMetadata(upload.FileID)
+	if err != nil {
+		log.Printf("Error retrieving metadata for file %s: %v", upload.FileID, err)
+		return failedChunk(http.StatusInternalServerError, "Failed to retrieve file metadata", err.Error())
+	}
+
+	segments := &segmentReader{paths: upload.SegmentPaths}
+	result := ingestChunk(metadata, chunkUpload{
+		FileID:       upload.FileID,
+		ChunkIndex:   upload.ChunkIndex,
+		IV:           upload.EncryptionIV,
+		ClientSHA256: upload.ContentSHA256,
+	}, segments)
+	segments.Close()
+
+	if result.Status >= http.StatusInternalServerError {
+		return result
+	}
+
+	terminateTusUpload(upload)
+	if result.Status == http.StatusOK && !result.AlreadyStored {
+		log.Printf("Stored encrypted chunk from tus upload %s - File ID: %s, Chunk: %d/%d, Storage: %s",
+			upload.ID, upload.FileID, upload.ChunkIndex+1, metadata.TotalChunks, result.Chunk.StoragePath)
+	}
+	return result
+}
+
+// terminateTusUpload deletes the segments and the record of a tus upload
+func terminateTusUpload(upload *database.TusUpload) error {
+	for _, segmentPath := range upload.SegmentPaths {
+		discardChunk(segmentPath)
+	}
+	if err := database.DeleteTusUpload(upload.ID); err != nil {
+		log.Printf("Error deleting tus upload %s: %v", upload.ID, err)
+		return err
+	}
+	return nil
+}
+
+// TerminateTusUploadHandler handles tus termination requests, discarding an unfinished upload
+func TerminateTusUploadHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !requireTusResumable(w, r) {
+			return
+		}
+
+		upload, ok := loadTusUpload(w, r)
+		if !ok {
+			return
+		}
+
+		if err := terminateTusUpload(upload); err != nil {
+			RespondWithError(w, http.StatusInternalServerError, "Failed to terminate upload", err.Error())
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// segmentReader reads the segments of a tus upload from storage one after another
+// Each segment is only opened once the previous one has been read to the end
+type segmentReader struct {
+	paths   []string
+	current io.ReadCloser
+}
+
+func (s *segmentReader) Read(p []byte) (int, error) {
+	for {
+		if s.current == nil {
+			if len(s.paths) == 0 {
+				return 0, io.EOF
+			}
+			body, _, err := storage.DownloadEncryptedChunk(s.paths[0])
+			if err != nil {
+				return 0, fmt.Errorf("failed to read upload segment: %w", err)
+			}
+			s.current = body
+			s.paths = s.paths[1:]
+		}
+
+		n, err := s.current.Read(p)
+		if err == io.EOF {
+			s.current.Close()
+			s.current = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+// Close closes the segment currently being read
+func (s *segmentReader) Close() error {
+	if s.current == nil {
+		return nil
+	}
+	err := s.current.Close()
+	s.current = nil
+	return err
+}
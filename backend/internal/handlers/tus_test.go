@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"secure-document-transfer/internal/database"
+)
+
+func TestParseUploadMetadata(t *testing.T) {
+	metadata, err := parseUploadMetadata("file_id ZmlsZQ==, chunk_index Mw==,iv aXY=,is_confidential")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := map[string]string{"file_id": "file", "chunk_index": "3", "iv": "iv", "is_confidential": ""}
+	if len(metadata) != len(expected) {
+		t.Fatalf("expected %d keys, got %v", len(expected), metadata)
+	}
+	for key, value := range expected {
+		if metadata[key] != value {
+			t.Errorf("expected %s=%q, got %q", key, value, metadata[key])
+		}
+	}
+}
+
+func TestParseUploadMetadata_Empty(t *testing.T) {
+	metadata, err := parseUploadMetadata("")
+	if err != nil || len(metadata) != 0 {
+		t.Errorf("expected no metadata, got %v (err %v)", metadata, err)
+	}
+}
+
+func TestParseUploadMetadata_Invalid(t *testing.T) {
+	for _, header := range []string{"file_id not-base64!", "iv aXY=,iv aXY=", "iv aXY=,,"} {
+		if _, err := parseUploadMetadata(header); err == nil {
+			t.Errorf("expected error for %q", header)
+		}
+	}
+}
+
+func TestWriteTusOffset_RetriesUnrecordedChunk(t *testing.T) {
+	upload := &database.TusUpload{ID: "upload", UploadOffset: 10, UploadLength: 10}
+
+	// The final PATCH failed to store the chunk; a HEAD must not report the upload as finished
+	calls := 0
+	failing := func(*database.TusUpload) chunkResult {
+		calls++
+		return failedChunk(http.StatusInternalServerError, "Failed to store chunk metadata", "")
+	}
+	rec := httptest.NewRecorder()
+	writeTusOffset(rec, upload, failing)
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("expected 500 while the chunk cannot be stored, got %d", rec.Code)
+	}
+	if offset := rec.Header().Get("Upload-Offset"); offset != "" {
+		t.Errorf("expected no Upload-Offset while the chunk is not stored, got %q", offset)
+	}
+
+	// A retried HEAD stores the chunk and only then reports the full offset
+	succeeding := func(*database.TusUpload) chunkResult {
+		calls++
+		return chunkResult{Status: http.StatusOK}
+	}
+	rec = httptest.NewRecorder()
+	writeTusOffset(rec, upload, succeeding)
+	if rec.Code != http.StatusOK || rec.Header().Get("Upload-Offset") != "10" {
+		t.Errorf("expected 200 with Upload-Offset 10, got %d with %q", rec.Code, rec.Header().Get("Upload-Offset"))
+	}
+	if calls != 2 {
+		t.Errorf("expected the chunk to be stored on each HEAD, got %d attempts", calls)
+	}
+}
+
+func TestWriteTusOffset_PartialUpload(t *testing.T) {
+	upload := &database.TusUpload{ID: "upload", UploadOffset: 4, UploadLength: 10}
+
+	rec := httptest.NewRecorder()
+	writeTusOffset(rec, upload, func(*database.TusUpload) chunkResult {
+		t.Error("expected a partial upload not to be completed")
+		return chunkResult{Status: http.StatusOK}
+	})
+	if rec.Code != http.StatusOK || rec.Header().Get("Upload-Offset") != "4" || rec.Header().Get("Upload-Length") != "10" {
+		t.Errorf("expected 200 with offset 4 of 10, got %d with %q of %q",
+			rec.Code, rec.Header().Get("Upload-Offset"), rec.Header().Get("Upload-Length"))
+	}
+}
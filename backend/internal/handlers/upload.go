@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"secure-document-transfer/internal/database"
+	"secure-document-transfer/internal/models"
+
+	"github.com/gorilla/mux"
+)
+
+// UploadStatusHandler reports which chunks of a file have been received
+// Senders use it to resume an interrupted upload by sending only the missing chunks
+func UploadStatusHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fileID := mux.Vars(r)["file_id"]
+
+		access, ok := authorizeFileAccess(w, r, fileID)
+		if !ok {
+			return
+		}
+
+		if !access.IsSender {
+			RespondWithError(w, http.StatusForbidden, "Only the sender can view the upload status", "")
+			return
+		}
+
+		metadata, err := database.GetFileMetadata(fileID)
+		if err != nil {
+			log.Printf("Error retrieving metadata for file %s: %v", fileID, err)
+			RespondWithError(w, http.StatusInternalServerError, "Failed to retrieve file metadata", err.Error())
+			return
+		}
+
+		indices, bytesReceived, err := database.GetUploadedChunks(fileID)
+		if err != nil {
+			log.Printf("Error retrieving uploaded chunks for file %s: %v", fileID, err)
+			RespondWithError(w, http.StatusInternalServerError, "Failed to retrieve uploaded chunks", err.Error())
+			return
+		}
+
+		RespondWithJSON(w, http.StatusOK, models.UploadStatusResponse{
+			FileID:         fileID,
+			TotalChunks:    metadata.TotalChunks,
+			ReceivedChunks: indices,
+			MissingRanges:  missingChunkRanges(indices, metadata.TotalChunks),
+			BytesReceived:  bytesReceived,
+			Completed:      metadata.CompletedAt.Valid,
+		})
+	}
+}
+
+// missingChunkRanges returns the inclusive ranges of indices in [0, totalChunks) that are not in present
+// present must be sorted in ascending order
+func missingChunkRanges(present []int, totalChunks int) []models.ChunkRange {
+	ranges := []models.ChunkRange{}
+	next := 0
+	for _, index := range present {
+		if index < next || index >= totalChunks {
+			continue
+		}
+		if index > next {
+			ranges = append(ranges, models.ChunkRange{Start: next, End: index - 1})
+		}
+		next = index + 1
+	}
+	if next < totalChunks {
+		ranges = append(ranges, models.ChunkRange{Start: next, End: totalChunks - 1})
+	}
+	return ranges
+}
+
+// FinalizeFileHandler marks a file upload as complete once every chunk and recipient key is in place
+// Recipients can only download a file after it has been finalized
+// If the upload is not complete the response lists every problem that was found
+func FinalizeFileHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fileID := mux.Vars(r)["file_id"]
+
+		access, ok := authorizeFileAccess(w, r, fileID)
+		if !ok || !requireNotExpired(w, access) {
+			return
+		}
+
+		if !access.IsSender {
+			RespondWithError(w, http.StatusForbidden, "Only the sender can finalize a file", "")
+			return
+		}
+
+		// The body is optional and only needed to supply missing recipient keys
+		var req models.FinalizeFileRequest
+		if err := parseJSON(r, &req); err != nil && !errors.Is(err, io.EOF) {
+			RespondWithError(w, http.StatusBadRequest, "Invalid request body", err.Error())
+			return
+		}
+
+		result, err := database.FinalizeFile(fileID, req.EncryptedKeys)
+		if errors.Is(err, database.ErrFileNotFound) {
+			RespondWithError(w, http.StatusNotFound, "File not found", "")
+			return
+		}
+		if err != nil {
+			log.Printf("Error finalizing file %s: %v", fileID, err)
+			RespondWithError(w, http.StatusInternalServerError, "Failed to finalize file", err.Error())
+			return
+		}
+
+		if !result.Complete() {
+			RespondWithJSON(w, http.StatusUnprocessableEntity, models.FinalizeProblemsResponse{
+				Error:    "File upload is not complete",
+				Problems: finalizeProblems(result),
+			})
+			return
+		}
+
+		log.Printf("File %s finalized with Merkle root %s", fileID, result.MerkleRoot)
+
+		RespondWithJSON(w, http.StatusOK, models.FinalizeFileResponse{
+			Message:     "File finalized successfully",
+			FileID:      fileID,
+			CompletedAt: result.CompletedAt,
+			MerkleRoot:  result.MerkleRoot,
+		})
+	}
+}
+
+// finalizeProblems describes every check a file upload failed during finalization
+func finalizeProblems(result *database.FinalizeResult) []string {
+	problems := []string{}
+
+	if len(result.MissingChunks) > 0 {
+		problems = append(problems, "Missing chunks: "+formatChunkIndices(result.MissingChunks))
+	}
+	if result.ReceivedSize != result.ExpectedSize {
+		problems = append(problems, fmt.Sprintf("Received %d bytes of ciphertext, expected %d", result.ReceivedSize, result.ExpectedSize))
+	}
+	if len(result.RecipientsWithoutKeys) > 0 {
+		problems = append(problems, "No wrapped file key for recipients: "+strings.Join(result.RecipientsWithoutKeys, ", "))
+	}
+
+	return problems
+}
+
+// formatChunkIndices formats sorted chunk indices as a compact list of ranges, e.g. "0-2, 5"
+func formatChunkIndices(indices []int) string {
+	var parts []string
+	for i := 0; i < len(indices); {
+		j := i
+		for j+1 < len(indices) && indices[j+1] == indices[j]+1 {
+			j++
+		}
+		if i == j {
+			parts = append(parts, fmt.Sprintf("%d", indices[i]))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", indices[i], indices[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,51 @@
+package handlers
+
+import (
+	"reflect"
+	"testing"
+
+	"secure-document-transfer/internal/models"
+)
+
+func TestMissingChunkRanges(t *testing.T) {
+	tests := []struct {
+		name        string
+		present     []int
+		totalChunks int
+		want        []models.ChunkRange
+	}{
+		{name: "nothing received", present: nil, totalChunks: 4, want: []models.ChunkRange{{Start: 0, End: 3}}},
+		{name: "all received", present: []int{0, 1, 2}, totalChunks: 3, want: []models.ChunkRange{}},
+		{name: "gap in the middle", present: []int{0, 3}, totalChunks: 4, want: []models.ChunkRange{{Start: 1, End: 2}}},
+		{name: "leading and trailing gaps", present: []int{2}, totalChunks: 5, want: []models.ChunkRange{{Start: 0, End: 1}, {Start: 3, End: 4}}},
+		{name: "several gaps", present: []int{1, 3, 5}, totalChunks: 6, want: []models.ChunkRange{{Start: 0, End: 0}, {Start: 2, End: 2}, {Start: 4, End: 4}}},
+		{name: "out of range indices ignored", present: []int{0, 1, 7}, totalChunks: 3, want: []models.ChunkRange{{Start: 2, End: 2}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := missingChunkRanges(tt.present, tt.totalChunks)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("missingChunkRanges(%v, %d) = %v, want %v", tt.present, tt.totalChunks, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatChunkIndices(t *testing.T) {
+	tests := []struct {
+		indices []int
+		want    string
+	}{
+		{indices: []int{4}, want: "4"},
+		{indices: []int{0, 1, 2}, want: "0-2"},
+		{indices: []int{0, 1, 2, 5, 7, 8}, want: "0-2, 5, 7-8"},
+		{indices: []int{}, want: ""},
+	}
+
+	for _, tt := range tests {
+		if got := formatChunkIndices(tt.indices); got != tt.want {
+			t.Errorf("formatChunkIndices(%v) = %q, want %q", tt.indices, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,403 @@
+package models
+
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+// fileIDPattern matches the server-issued file IDs (lowercase UUIDs from gen_random_uuid())
+var fileIDPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}$`)
+
+// IsValidFileID reports whether fileID has the format of a server-issued file ID
+// File IDs are used in storage paths, so anything else must be rejected before it reaches storage
+func IsValidFileID(fileID string) bool {
+	return fileIDPattern.MatchString(fileID)
+}
+
+// IsValidUploadID reports whether uploadID has the format of a server-issued tus upload ID
+func IsValidUploadID(uploadID string) bool {
+	return fileIDPattern.MatchString(uploadID)
+}
+
+// Forward policies chosen by the sender of a file
+const (
+	ForwardPolicyAllowed    = "allowed"     // Recipients may forward the file to anyone
+	ForwardPolicySameDomain = "same_domain" // Recipients may forward the file within their own email domain
+	ForwardPolicyForbidden  = "forbidden"   // Recipients may not forward the file
+)
+
+// IsValidForwardPolicy reports whether policy is one of the forward policies
+func IsValidForwardPolicy(policy string) bool {
+	switch policy {
+	case ForwardPolicyAllowed, ForwardPolicySameDomain, ForwardPolicyForbidden:
+		return true
+	}
+	return false
+}
+
+// InboxFile represents a file that has been shared with the authenticated user
+type InboxFile struct {
+	FileID           string     `json:"file_id"`
+	OriginalFilename string     `json:"original_filename"`
+	FileSize         int64      `json:"file_size"`
+	MimeType         string     `json:"mime_type"`
+	Sender           User       `json:"sender"`
+	CreatedAt        time.Time  `json:"created_at"`
+	CompletedAt      *time.Time `json:"completed_at"`
+	ExpiresAt        time.Time  `json:"expires_at"`
+	Expired          bool       `json:"expired"`
+	DownloadedAt     *time.Time `json:"downloaded_at"`
+	MaxDownloads     *int       `json:"max_downloads"`
+	DownloadCount    int        `json:"download_count"`
+}
+
+// InboxResponse represents a page of files shared with the authenticated user
+type InboxResponse struct {
+	Files  []InboxFile `json:"files"`
+	Total  int         `json:"total"`
+	Limit  int         `json:"limit"`
+	Offset int         `json:"offset"`
+}
+
+// SentFileRecipient represents the delivery status of one recipient of a sent file
+type SentFileRecipient struct {
+	Email            string     `json:"email"`
+	RecipientID      string     `json:"recipient_id,omitempty"`
+	HasKey           bool       `json:"has_key"`
+	DownloadedAt     *time.Time `json:"downloaded_at"`
+	LastDownloadedAt *time.Time `json:"last_downloaded_at"`
+	MaxDownloads     *int       `json:"max_downloads"`
+	DownloadCount    int        `json:"download_count"`
+	ForwardedBy      string     `json:"forwarded_by,omitempty"` // Email of the recipient who forwarded the file
+}
+
+// RecipientRemoval records a recipient whose access to a file was removed by the sender
+type RecipientRemoval struct {
+	Email         string    `json:"email"`
+	RecipientID   string    `json:"recipient_id,omitempty"`
+	DownloadCount int       `json:"download_count"` // Completed downloads before access was removed
+	RemovedAt     time.Time `json:"removed_at"`
+}
+
+// SentFile represents a file sent by the authenticated user along with its upload progress
+type SentFile struct {
+	FileID            string              `json:"file_id"`
+	OriginalFilename  string              `json:"original_filename"`
+	FileSize          int64               `json:"file_size"`
+	MimeType          string              `json:"mime_type"`
+	TotalChunks       int                 `json:"total_chunks"`
+	ChunksStored      int                 `json:"chunks_stored"`
+	CreatedAt         time.Time           `json:"created_at"`
+	CompletedAt       *time.Time          `json:"completed_at"`
+	ExpiresAt         time.Time           `json:"expires_at"`
+	Expired           bool                `json:"expired"`
+	ForwardPolicy     string              `json:"forward_policy"`
+	Recipients        []SentFileRecipient `json:"recipients"`
+	RemovedRecipients []RecipientRemoval  `json:"removed_recipients"`
+}
+
+// SentFilesResponse represents a page of files sent by the authenticated user
+type SentFilesResponse struct {
+	Files  []SentFile `json:"files"`
+	Total  int        `json:"total"`
+	Limit  int        `json:"limit"`
+	Offset int        `json:"offset"`
+}
+
+// ManifestChunk describes one encrypted chunk of a file and the IV needed to decrypt it
+type ManifestChunk struct {
+	ChunkIndex   int      `json:"chunk_index"`
+	ChunkSize    int64    `json:"chunk_size"`
+	StoragePath  string   `json:"storage_path"`
+	EncryptionIV string   `json:"iv"`
+	SHA256       string   `json:"sha256"`          // Hex SHA-256 of the encrypted chunk
+	Proof        []string `json:"proof,omitempty"` // Hex Merkle inclusion proof of the chunk, leaf to root
+}
+
+// FileManifest contains everything a client needs to download and decrypt a file
+// EncryptedFileKey is the caller's own wrapped AES key and is empty if the caller is not a recipient
+type FileManifest struct {
+	FileID           string          `json:"file_id"`
+	OriginalFilename string          `json:"original_filename"`
+	RelativePath     string          `json:"relative_path,omitempty"` // Path within the transfer, for files sent as part of one
+	TransferID       string          `json:"transfer_id,omitempty"`
+	FileSize         int64           `json:"file_size"`
+	MimeType         string          `json:"mime_type"`
+	TotalChunks      int             `json:"total_chunks"`
+	SenderID         string          `json:"sender_id"`
+	CreatedAt        time.Time       `json:"created_at"`
+	CompletedAt      *time.Time      `json:"completed_at"`
+	ExpiresAt        time.Time       `json:"expires_at"`
+	MerkleRoot       string          `json:"merkle_root,omitempty"`
+	ForwardPolicy    string          `json:"forward_policy"`
+	EncryptedFileKey string          `json:"encrypted_file_key,omitempty"`
+	Chunks           []ManifestChunk `json:"chunks"`
+}
+
+// DownloadReceiptResponse reports when a recipient first and most recently downloaded a file
+type DownloadReceiptResponse struct {
+	FileID           string    `json:"file_id"`
+	DownloadedAt     time.Time `json:"downloaded_at"`
+	LastDownloadedAt time.Time `json:"last_downloaded_at"`
+}
+
+// FileRecipientRequest describes one recipient of a new file and their wrapped file key
+type FileRecipientRequest struct {
+	Email        string `json:"email"`
+	EncryptedKey string `json:"encrypted_key"`
+	MaxDownloads *int   `json:"max_downloads,omitempty"`
+}
+
+// CreateFileRequest represents the request body for starting a file upload
+type CreateFileRequest struct {
+	OriginalFilename string                 `json:"original_filename"`
+	FileSize         int64                  `json:"file_size"`
+	TotalChunks      int                    `json:"total_chunks"`
+	MimeType         string                 `json:"mime_type"`
+	ExpiresAt        string                 `json:"expires_at,omitempty"`
+	ForwardPolicy    string                 `json:"forward_policy,omitempty"`
+	Recipients       []FileRecipientRequest `json:"recipients"`
+}
+
+// CreateFileResponse represents the response after a file upload has been started
+// MissingKeys lists recipients for whom no wrapped file key was supplied
+type CreateFileResponse struct {
+	Message       string    `json:"message"`
+	FileID        string    `json:"file_id"`
+	TotalChunks   int       `json:"total_chunks"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	ForwardPolicy string    `json:"forward_policy"`
+	MissingKeys   []string  `json:"missing_keys"`
+}
+
+// Validate validates the create file request
+func (req *CreateFileRequest) Validate() error {
+	req.OriginalFilename = strings.TrimSpace(req.OriginalFilename)
+	req.MimeType = strings.TrimSpace(req.MimeType)
+
+	if req.OriginalFilename == "" {
+		return &ValidationError{Field: "original_filename", Message: "Original filename is required"}
+	}
+	if len(req.OriginalFilename) > 255 {
+		return &ValidationError{Field: "original_filename", Message: "Original filename is too long"}
+	}
+	if req.FileSize < 0 {
+		return &ValidationError{Field: "file_size", Message: "File size must not be negative"}
+	}
+	if req.TotalChunks < 1 {
+		return &ValidationError{Field: "total_chunks", Message: "File must have at least one chunk"}
+	}
+
+	req.ForwardPolicy = strings.TrimSpace(req.ForwardPolicy)
+	if req.ForwardPolicy == "" {
+		req.ForwardPolicy = ForwardPolicyForbidden
+	}
+	if !IsValidForwardPolicy(req.ForwardPolicy) {
+		return &ValidationError{Field: "forward_policy", Message: "forward_policy must be allowed, same_domain or forbidden"}
+	}
+
+	return validateRecipients(req.Recipients)
+}
+
+// validateRecipients checks a list of recipients for missing, malformed or duplicate emails
+func validateRecipients(recipients []FileRecipientRequest) error {
+	if len(recipients) == 0 {
+		return &ValidationError{Field: "recipients", Message: "At least one recipient is required"}
+	}
+
+	seen := make(map[string]bool)
+	for i := range recipients {
+		recipients[i].Email = strings.TrimSpace(recipients[i].Email)
+		email := recipients[i].Email
+
+		if !isValidEmail(email) {
+			return &ValidationError{Field: "recipients", Message: "Invalid recipient email: " + email}
+		}
+		if seen[strings.ToLower(email)] {
+			return &ValidationError{Field: "recipients", Message: "Duplicate recipient email: " + email}
+		}
+		seen[strings.ToLower(email)] = true
+
+		if recipients[i].MaxDownloads != nil && *recipients[i].MaxDownloads < 1 {
+			return &ValidationError{Field: "recipients", Message: "max_downloads must be a positive integer"}
+		}
+	}
+
+	return nil
+}
+
+// AddRecipientsRequest represents the request body for adding recipients to a file that was already sent
+// Every recipient needs the file key freshly wrapped with their public key
+type AddRecipientsRequest struct {
+	Recipients []FileRecipientRequest `json:"recipients"`
+}
+
+// AddRecipientsResponse reports which recipients were added to a file
+// AlreadyRecipients lists requested emails that already had access and were left unchanged
+type AddRecipientsResponse struct {
+	Message           string   `json:"message"`
+	FileID            string   `json:"file_id"`
+	Added             []string `json:"added"`
+	AlreadyRecipients []string `json:"already_recipients"`
+}
+
+// Validate validates the add recipients request
+func (req *AddRecipientsRequest) Validate() error {
+	if err := validateRecipients(req.Recipients); err != nil {
+		return err
+	}
+	return requireWrappedKeys(req.Recipients)
+}
+
+// requireWrappedKeys checks that every recipient comes with a wrapped file key
+func requireWrappedKeys(recipients []FileRecipientRequest) error {
+	for i := range recipients {
+		recipients[i].EncryptedKey = strings.TrimSpace(recipients[i].EncryptedKey)
+		if recipients[i].EncryptedKey == "" {
+			return &ValidationError{Field: "recipients", Message: "Missing encrypted_key for recipient: " + recipients[i].Email}
+		}
+	}
+	return nil
+}
+
+// ForwardFileRequest represents the request body for a recipient forwarding a file
+// The recipient unwraps the file key client-side and wraps it again for every new recipient
+type ForwardFileRequest struct {
+	Recipients []FileRecipientRequest `json:"recipients"`
+}
+
+// Validate validates the forward file request
+// A recipient's max_downloads is taken out of the forwarding recipient's own remaining downloads, if they are limited
+func (req *ForwardFileRequest) Validate() error {
+	if err := validateRecipients(req.Recipients); err != nil {
+		return err
+	}
+	return requireWrappedKeys(req.Recipients)
+}
+
+// UpdateForwardPolicyRequest represents the request body for changing a file's forward policy
+type UpdateForwardPolicyRequest struct {
+	ForwardPolicy string `json:"forward_policy"`
+}
+
+// Validate validates the update forward policy request
+func (req *UpdateForwardPolicyRequest) Validate() error {
+	req.ForwardPolicy = strings.TrimSpace(req.ForwardPolicy)
+	if !IsValidForwardPolicy(req.ForwardPolicy) {
+		return &ValidationError{Field: "forward_policy", Message: "forward_policy must be allowed, same_domain or forbidden"}
+	}
+	return nil
+}
+
+// RemoveRecipientResponse represents the response after a recipient's access to a file was removed
+type RemoveRecipientResponse struct {
+	Message string           `json:"message"`
+	FileID  string           `json:"file_id"`
+	Removal RecipientRemoval `json:"removal"`
+}
+
+// ChunkRange is an inclusive range of chunk indices
+type ChunkRange struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// UploadStatusResponse reports which chunks of a file have been received so an upload can be resumed
+type UploadStatusResponse struct {
+	FileID         string       `json:"file_id"`
+	TotalChunks    int          `json:"total_chunks"`
+	ReceivedChunks []int        `json:"received_chunks"`
+	MissingRanges  []ChunkRange `json:"missing_ranges"`
+	BytesReceived  int64        `json:"bytes_received"`
+	Completed      bool         `json:"completed"`
+}
+
+// FinalizeFileRequest represents the optional request body for finalizing a file upload
+// EncryptedKeys maps recipient emails to wrapped file keys that were not supplied when the file was created
+type FinalizeFileRequest struct {
+	EncryptedKeys map[string]string `json:"encrypted_keys,omitempty"`
+}
+
+// FinalizeFileResponse represents the response after a file upload has been finalized
+type FinalizeFileResponse struct {
+	Message     string    `json:"message"`
+	FileID      string    `json:"file_id"`
+	CompletedAt time.Time `json:"completed_at"`
+	MerkleRoot  string    `json:"merkle_root"`
+}
+
+// FinalizeProblemsResponse lists why a file upload could not be finalized
+type FinalizeProblemsResponse struct {
+	Error    string   `json:"error"`
+	Problems []string `json:"problems"`
+}
+
+// UsageResponse reports a user's current storage usage and the limits that apply to them
+type UsageResponse struct {
+	StoredBytes        int64 `json:"stored_bytes"`
+	MaxStorageBytes    int64 `json:"max_storage_bytes"`
+	ActiveTransfers    int64 `json:"active_transfers"`
+	MaxActiveTransfers int64 `json:"max_active_transfers"`
+}
+
+// BatchChunkEntry describes one chunk of a batch upload
+type BatchChunkEntry struct {
+	ChunkIndex     int    `json:"chunk_index"`
+	IV             string `json:"iv"`
+	SHA256         string `json:"sha256,omitempty"`
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+}
+
+// BatchUploadManifest is the manifest part of a batch chunk upload
+// It lists the chunks in the order their parts follow in the request
+type BatchUploadManifest struct {
+	Chunks []BatchChunkEntry `json:"chunks"`
+}
+
+// Validate validates the batch upload manifest
+func (m *BatchUploadManifest) Validate(maxChunks int) error {
+	if len(m.Chunks) == 0 {
+		return &ValidationError{Field: "chunks", Message: "At least one chunk is required"}
+	}
+	if len(m.Chunks) > maxChunks {
+		return &ValidationError{Field: "chunks", Message: "Too many chunks in one batch"}
+	}
+
+	seen := make(map[int]bool)
+	for i := range m.Chunks {
+		entry := &m.Chunks[i]
+		entry.IV = strings.TrimSpace(entry.IV)
+		entry.SHA256 = strings.ToLower(strings.TrimSpace(entry.SHA256))
+		entry.IdempotencyKey = strings.TrimSpace(entry.IdempotencyKey)
+
+		if entry.IV == "" {
+			return &ValidationError{Field: "chunks", Message: "Every chunk needs an iv"}
+		}
+		if seen[entry.ChunkIndex] {
+			return &ValidationError{Field: "chunks", Message: "Duplicate chunk_index in batch"}
+		}
+		seen[entry.ChunkIndex] = true
+	}
+
+	return nil
+}
+
+// BatchChunkStatus reports the outcome of one chunk of a batch upload
+type BatchChunkStatus struct {
+	ChunkIndex    int    `json:"chunk_index"`
+	Status        int    `json:"status"`
+	Error         string `json:"error,omitempty"`
+	Details       string `json:"details,omitempty"`
+	AlreadyStored bool   `json:"already_stored,omitempty"`
+	StoragePath   string `json:"storage_path,omitempty"`
+}
+
+// BatchUploadResponse reports the outcome of every chunk of a batch upload
+type BatchUploadResponse struct {
+	FileID      string             `json:"file_id"`
+	TotalChunks int                `json:"total_chunks"`
+	Stored      int                `json:"stored"`
+	Failed      int                `json:"failed"`
+	Chunks      []BatchChunkStatus `json:"chunks"`
+}
@@ -0,0 +1,153 @@
+package models
+
+import (
+	"encoding/base64"
+	"strings"
+	"time"
+)
+
+// Message threads are encrypted either with the AES key of a file of the transfer or with a key of their own
+const (
+	// MessageKeySourceFile threads are encrypted with the AES key of one file of the transfer, which recipients
+	// unwrap from their encrypted_file_key
+	MessageKeySourceFile = "file"
+	// MessageKeySourceThread threads are encrypted with a per-thread AES key wrapped for each participant,
+	// so the sender (who holds no wrapped file key) can read replies too
+	MessageKeySourceThread = "thread"
+)
+
+const (
+	// MaxMessageCiphertextLength is the longest base64 message ciphertext accepted
+	MaxMessageCiphertextLength = 64 * 1024
+	// messageIVSize is the size in bytes of the AES-GCM IV of a message
+	messageIVSize = 12
+)
+
+// IsValidThreadID reports whether threadID has the format of a server-issued message thread ID
+func IsValidThreadID(threadID string) bool {
+	return fileIDPattern.MatchString(threadID)
+}
+
+// PostMessageRequest represents the request body for posting a message on a transfer
+// Without a thread_id the message starts a new thread. KeyFileID names the file whose AES key encrypts a thread
+// with key_source "file"; it may be omitted when the transfer has a single file. ThreadKeys maps participant
+// emails to the thread's AES key wrapped with their public key; it is required when starting a thread with
+// key_source "thread" and may be sent with a reply to give the key to participants who do not have it yet
+type PostMessageRequest struct {
+	ThreadID   string            `json:"thread_id,omitempty"`
+	KeySource  string            `json:"key_source,omitempty"`
+	KeyFileID  string            `json:"key_file_id,omitempty"`
+	ThreadKeys map[string]string `json:"thread_keys,omitempty"`
+	Ciphertext string            `json:"ciphertext"`
+	IV         string            `json:"iv"`
+}
+
+// Validate validates the post message request
+func (req *PostMessageRequest) Validate() error {
+	req.ThreadID = strings.TrimSpace(req.ThreadID)
+	req.KeySource = strings.TrimSpace(req.KeySource)
+	req.KeyFileID = strings.TrimSpace(req.KeyFileID)
+	req.Ciphertext = strings.TrimSpace(req.Ciphertext)
+	req.IV = strings.TrimSpace(req.IV)
+
+	if req.Ciphertext == "" {
+		return &ValidationError{Field: "ciphertext", Message: "Message ciphertext is required"}
+	}
+	if len(req.Ciphertext) > MaxMessageCiphertextLength {
+		return &ValidationError{Field: "ciphertext", Message: "Message is too long"}
+	}
+	if _, err := base64.StdEncoding.DecodeString(req.Ciphertext); err != nil {
+		return &ValidationError{Field: "ciphertext", Message: "Message ciphertext must be base64 encoded"}
+	}
+	if iv, err := base64.StdEncoding.DecodeString(req.IV); err != nil || len(iv) != messageIVSize {
+		return &ValidationError{Field: "iv", Message: "iv must be a base64 encoded 12-byte AES-GCM IV"}
+	}
+
+	if req.ThreadID == "" {
+		if req.KeySource == "" {
+			req.KeySource = MessageKeySourceFile
+		}
+		if req.KeySource != MessageKeySourceFile && req.KeySource != MessageKeySourceThread {
+			return &ValidationError{Field: "key_source", Message: "key_source must be file or thread"}
+		}
+		if req.KeySource == MessageKeySourceThread && len(req.ThreadKeys) == 0 {
+			return &ValidationError{Field: "thread_keys", Message: "thread_keys are required for a thread with its own key"}
+		}
+		if req.KeySource == MessageKeySourceThread && req.KeyFileID != "" {
+			return &ValidationError{Field: "key_file_id", Message: "key_file_id can only be set for a thread encrypted with a file key"}
+		}
+		if req.KeyFileID != "" && !IsValidFileID(req.KeyFileID) {
+			return &ValidationError{Field: "key_file_id", Message: "Invalid key_file_id"}
+		}
+	} else {
+		if !IsValidThreadID(req.ThreadID) {
+			return &ValidationError{Field: "thread_id", Message: "Invalid thread ID"}
+		}
+		if req.KeySource != "" || req.KeyFileID != "" {
+			return &ValidationError{Field: "key_source", Message: "key_source and key_file_id can only be set when starting a thread"}
+		}
+	}
+
+	// Wrapped keys are stored by lowercase email, like recipient removals
+	threadKeys := make(map[string]string, len(req.ThreadKeys))
+	for email, key := range req.ThreadKeys {
+		email = strings.ToLower(strings.TrimSpace(email))
+		key = strings.TrimSpace(key)
+		if email == "" || key == "" {
+			return &ValidationError{Field: "thread_keys", Message: "Every thread key needs an email and a wrapped key"}
+		}
+		threadKeys[email] = key
+	}
+	req.ThreadKeys = threadKeys
+
+	return nil
+}
+
+// Message is one encrypted message of a thread
+type Message struct {
+	MessageID  string    `json:"message_id"`
+	ThreadID   string    `json:"thread_id"`
+	Sender     User      `json:"sender"`
+	Ciphertext string    `json:"ciphertext"`
+	IV         string    `json:"iv"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// PostMessageResponse represents the response after a message has been posted
+// TransferID is set for multi-file transfers and FileID for files sent on their own
+// MissingKeys lists participants of a thread with its own key who have no wrapped copy of it yet
+type PostMessageResponse struct {
+	Message     string   `json:"message"`
+	TransferID  string   `json:"transfer_id,omitempty"`
+	FileID      string   `json:"file_id,omitempty"`
+	KeySource   string   `json:"key_source"`
+	KeyFileID   string   `json:"key_file_id,omitempty"`
+	Posted      Message  `json:"posted"`
+	MissingKeys []string `json:"missing_keys"`
+}
+
+// MessageThread is a thread of messages on a transfer, oldest message first
+// For threads encrypted with a file key, KeyFileID names the file and EncryptedFileKey is the caller's wrapped
+// key of it; for threads with their own key, EncryptedThreadKey is the caller's wrapped thread key. The keys are
+// empty when none was wrapped for the caller
+type MessageThread struct {
+	ThreadID           string    `json:"thread_id"`
+	KeySource          string    `json:"key_source"`
+	KeyFileID          string    `json:"key_file_id,omitempty"`
+	CreatedBy          User      `json:"created_by"`
+	CreatedAt          time.Time `json:"created_at"`
+	EncryptedFileKey   string    `json:"encrypted_file_key,omitempty"`
+	EncryptedThreadKey string    `json:"encrypted_thread_key,omitempty"`
+	Messages           []Message `json:"messages"`
+}
+
+// MessagesResponse represents a page of the message threads on a transfer, oldest thread first
+// TransferID is set for multi-file transfers and FileID for files sent on their own
+type MessagesResponse struct {
+	TransferID string          `json:"transfer_id,omitempty"`
+	FileID     string          `json:"file_id,omitempty"`
+	Threads    []MessageThread `json:"threads"`
+	Total      int             `json:"total"`
+	Limit      int             `json:"limit"`
+	Offset     int             `json:"offset"`
+}
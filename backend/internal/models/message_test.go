@@ -0,0 +1,61 @@
+package models
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func TestPostMessageRequestValidate(t *testing.T) {
+	iv := base64.StdEncoding.EncodeToString(make([]byte, 12))
+	ciphertext := base64.StdEncoding.EncodeToString([]byte("encrypted note"))
+
+	req := PostMessageRequest{Ciphertext: ciphertext, IV: iv}
+	if err := req.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if req.KeySource != MessageKeySourceFile {
+		t.Errorf("expected new threads to default to the file key, got %q", req.KeySource)
+	}
+
+	req = PostMessageRequest{
+		KeySource:  MessageKeySourceThread,
+		ThreadKeys: map[string]string{" Alice@Example.com ": "wrapped"},
+		Ciphertext: ciphertext,
+		IV:         iv,
+	}
+	if err := req.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if req.ThreadKeys["alice@example.com"] != "wrapped" {
+		t.Errorf("expected thread keys keyed by lowercase email, got %v", req.ThreadKeys)
+	}
+
+	req = PostMessageRequest{KeyFileID: " 123e4567-e89b-12d3-a456-426614174000 ", Ciphertext: ciphertext, IV: iv}
+	if err := req.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if req.KeyFileID != "123e4567-e89b-12d3-a456-426614174000" {
+		t.Errorf("expected trimmed key_file_id, got %q", req.KeyFileID)
+	}
+
+	invalid := map[string]PostMessageRequest{
+		"missing ciphertext":       {IV: iv},
+		"ciphertext not base64":    {Ciphertext: "not base64!", IV: iv},
+		"ciphertext too long":      {Ciphertext: strings.Repeat("A", MaxMessageCiphertextLength+4), IV: iv},
+		"short iv":                 {Ciphertext: ciphertext, IV: base64.StdEncoding.EncodeToString(make([]byte, 8))},
+		"unknown key source":       {KeySource: "session", Ciphertext: ciphertext, IV: iv},
+		"thread key without keys":  {KeySource: MessageKeySourceThread, Ciphertext: ciphertext, IV: iv},
+		"invalid thread id":        {ThreadID: "not-a-thread", Ciphertext: ciphertext, IV: iv},
+		"key source on reply":      {ThreadID: "123e4567-e89b-12d3-a456-426614174000", KeySource: MessageKeySourceFile, Ciphertext: ciphertext, IV: iv},
+		"thread key without email": {KeySource: MessageKeySourceThread, ThreadKeys: map[string]string{" ": "wrapped"}, Ciphertext: ciphertext, IV: iv},
+		"invalid key file id":      {KeyFileID: "not-a-file", Ciphertext: ciphertext, IV: iv},
+		"key file on thread key":   {KeySource: MessageKeySourceThread, KeyFileID: "123e4567-e89b-12d3-a456-426614174000", ThreadKeys: map[string]string{"a@example.com": "wrapped"}, Ciphertext: ciphertext, IV: iv},
+		"key file on reply":        {ThreadID: "123e4567-e89b-12d3-a456-426614174000", KeyFileID: "123e4567-e89b-12d3-a456-426614174000", Ciphertext: ciphertext, IV: iv},
+	}
+	for name, req := range invalid {
+		if err := req.Validate(); err == nil {
+			t.Errorf("%s: expected request to be rejected", name)
+		}
+	}
+}
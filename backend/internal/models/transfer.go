@@ -0,0 +1,304 @@
+package models
+
+import (
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	// MaxTransferFiles is the largest number of files a single transfer may contain
+	MaxTransferFiles = 1000
+	// maxRelativePathLength is the longest relative path accepted for a file in a transfer
+	maxRelativePathLength = 1024
+	// maxPathSegmentLength is the longest single directory or file name accepted in a relative path
+	maxPathSegmentLength = 255
+)
+
+// IsValidTransferID reports whether transferID has the format of a server-issued transfer ID
+func IsValidTransferID(transferID string) bool {
+	return fileIDPattern.MatchString(transferID)
+}
+
+// ValidateRelativePath checks the relative path of a file in a transfer, e.g. "reports/2024/q1.pdf"
+// Paths use forward slashes and may not be absolute, contain empty, "." or ".." segments, backslashes
+// or control characters, so they can be recreated safely under any download folder
+func ValidateRelativePath(path string) error {
+	if path == "" {
+		return &ValidationError{Field: "relative_path", Message: "Relative path is required"}
+	}
+	if len(path) > maxRelativePathLength {
+		return &ValidationError{Field: "relative_path", Message: "Relative path is too long: " + path}
+	}
+	if strings.HasPrefix(path, "/") {
+		return &ValidationError{Field: "relative_path", Message: "Relative path must not be absolute: " + path}
+	}
+	for _, r := range path {
+		if r == '\\' || unicode.IsControl(r) {
+			return &ValidationError{Field: "relative_path", Message: "Relative path contains an invalid character: " + path}
+		}
+	}
+
+	for _, segment := range strings.Split(path, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return &ValidationError{Field: "relative_path", Message: "Relative path contains an invalid segment: " + path}
+		}
+		if len(segment) > maxPathSegmentLength {
+			return &ValidationError{Field: "relative_path", Message: "Relative path contains a name that is too long: " + path}
+		}
+	}
+
+	return nil
+}
+
+// TransferFileRequest describes one file of a new transfer
+// EncryptedKeys maps recipient emails to this file's AES key wrapped with their public key
+type TransferFileRequest struct {
+	RelativePath  string            `json:"relative_path"`
+	FileSize      int64             `json:"file_size"`
+	TotalChunks   int               `json:"total_chunks"`
+	MimeType      string            `json:"mime_type"`
+	EncryptedKeys map[string]string `json:"encrypted_keys"`
+}
+
+// TransferRecipientRequest describes one recipient of a new transfer
+type TransferRecipientRequest struct {
+	Email        string `json:"email"`
+	MaxDownloads *int   `json:"max_downloads,omitempty"`
+}
+
+// CreateTransferRequest represents the request body for starting a multi-file transfer
+// All files share the recipient list, expiry and forward policy
+type CreateTransferRequest struct {
+	ExpiresAt     string                     `json:"expires_at,omitempty"`
+	ForwardPolicy string                     `json:"forward_policy,omitempty"`
+	Recipients    []TransferRecipientRequest `json:"recipients"`
+	Files         []TransferFileRequest      `json:"files"`
+}
+
+// FileRecipients returns the recipients of the transfer without wrapped keys, which are set per file
+func (req *CreateTransferRequest) FileRecipients() []FileRecipientRequest {
+	return transferFileRecipients(req.Recipients)
+}
+
+// transferFileRecipients converts the recipients of a transfer to file recipients without wrapped keys
+func transferFileRecipients(recipients []TransferRecipientRequest) []FileRecipientRequest {
+	fileRecipients := make([]FileRecipientRequest, len(recipients))
+	for i, recipient := range recipients {
+		fileRecipients[i] = FileRecipientRequest{Email: recipient.Email, MaxDownloads: recipient.MaxDownloads}
+	}
+	return fileRecipients
+}
+
+// validateTransferRecipients validates the recipients of a transfer and trims their emails
+// Returns the emails as given, keyed by lowercase email, for matching the keys of wrapped key maps
+func validateTransferRecipients(recipients []TransferRecipientRequest) (map[string]string, error) {
+	fileRecipients := transferFileRecipients(recipients)
+	if err := validateRecipients(fileRecipients); err != nil {
+		return nil, err
+	}
+	recipientEmails := make(map[string]string, len(fileRecipients))
+	for i := range fileRecipients {
+		recipients[i].Email = fileRecipients[i].Email
+		recipientEmails[strings.ToLower(fileRecipients[i].Email)] = fileRecipients[i].Email
+	}
+	return recipientEmails, nil
+}
+
+// normalizeWrappedKeys keys the wrapped keys of one file by the recipient emails as given in the recipient list
+// Keys for unknown recipients, and several keys for the same recipient differing only in case or spacing, are
+// rejected; file names the file in error messages
+func normalizeWrappedKeys(keys map[string]string, recipientEmails map[string]string, file string) (map[string]string, error) {
+	encryptedKeys := make(map[string]string, len(keys))
+	for email, key := range keys {
+		recipientEmail, ok := recipientEmails[strings.ToLower(strings.TrimSpace(email))]
+		if !ok {
+			return nil, &ValidationError{Field: "files", Message: "Wrapped key for unknown recipient: " + email}
+		}
+		if _, ok := encryptedKeys[recipientEmail]; ok {
+			return nil, &ValidationError{Field: "files", Message: "Duplicate wrapped key for recipient: " + recipientEmail + " in " + file}
+		}
+		encryptedKeys[recipientEmail] = strings.TrimSpace(key)
+	}
+	return encryptedKeys, nil
+}
+
+// Validate validates the create transfer request
+func (req *CreateTransferRequest) Validate() error {
+	recipientEmails, err := validateTransferRecipients(req.Recipients)
+	if err != nil {
+		return err
+	}
+
+	req.ForwardPolicy = strings.TrimSpace(req.ForwardPolicy)
+	if req.ForwardPolicy == "" {
+		req.ForwardPolicy = ForwardPolicyForbidden
+	}
+	if !IsValidForwardPolicy(req.ForwardPolicy) {
+		return &ValidationError{Field: "forward_policy", Message: "forward_policy must be allowed, same_domain or forbidden"}
+	}
+
+	if len(req.Files) == 0 {
+		return &ValidationError{Field: "files", Message: "At least one file is required"}
+	}
+	if len(req.Files) > MaxTransferFiles {
+		return &ValidationError{Field: "files", Message: "Too many files in one transfer"}
+	}
+
+	// Paths are compared case-insensitively so the tree can be recreated on case-insensitive file systems
+	seenPaths := make(map[string]bool, len(req.Files))
+	for i := range req.Files {
+		file := &req.Files[i]
+		file.MimeType = strings.TrimSpace(file.MimeType)
+
+		if err := ValidateRelativePath(file.RelativePath); err != nil {
+			return err
+		}
+		if seenPaths[strings.ToLower(file.RelativePath)] {
+			return &ValidationError{Field: "files", Message: "Duplicate relative path: " + file.RelativePath}
+		}
+		seenPaths[strings.ToLower(file.RelativePath)] = true
+
+		if file.FileSize < 0 {
+			return &ValidationError{Field: "files", Message: "File size must not be negative: " + file.RelativePath}
+		}
+		if file.TotalChunks < 1 {
+			return &ValidationError{Field: "files", Message: "File must have at least one chunk: " + file.RelativePath}
+		}
+
+		encryptedKeys, err := normalizeWrappedKeys(file.EncryptedKeys, recipientEmails, file.RelativePath)
+		if err != nil {
+			return err
+		}
+		file.EncryptedKeys = encryptedKeys
+	}
+
+	return nil
+}
+
+// FileName returns the last segment of the file's relative path
+func (f *TransferFileRequest) FileName() string {
+	return f.RelativePath[strings.LastIndex(f.RelativePath, "/")+1:]
+}
+
+// TransferRecipientsRequest represents the request body for adding recipients to, or forwarding, a whole transfer
+// The files of a transfer share one recipient list, so every new recipient is added to every file.
+// EncryptedKeys maps each file ID of the transfer to that file's AES key wrapped for every new recipient
+// (email -> wrapped key)
+type TransferRecipientsRequest struct {
+	Recipients    []TransferRecipientRequest   `json:"recipients"`
+	EncryptedKeys map[string]map[string]string `json:"encrypted_keys"`
+}
+
+// FileRecipients returns the recipients of the request without wrapped keys, which are set per file
+func (req *TransferRecipientsRequest) FileRecipients() []FileRecipientRequest {
+	return transferFileRecipients(req.Recipients)
+}
+
+// Validate validates the transfer recipients request
+// That every file of the transfer has a key for every recipient is checked against the transfer's files
+func (req *TransferRecipientsRequest) Validate() error {
+	recipientEmails, err := validateTransferRecipients(req.Recipients)
+	if err != nil {
+		return err
+	}
+
+	encryptedKeys := make(map[string]map[string]string, len(req.EncryptedKeys))
+	for fileID, keys := range req.EncryptedKeys {
+		if !IsValidFileID(fileID) {
+			return &ValidationError{Field: "encrypted_keys", Message: "Invalid file ID: " + fileID}
+		}
+		fileKeys, err := normalizeWrappedKeys(keys, recipientEmails, fileID)
+		if err != nil {
+			return err
+		}
+		for email, key := range fileKeys {
+			if key == "" {
+				return &ValidationError{Field: "encrypted_keys", Message: "Missing wrapped key of file " + fileID + " for recipient: " + email}
+			}
+		}
+		encryptedKeys[fileID] = fileKeys
+	}
+	req.EncryptedKeys = encryptedKeys
+
+	return nil
+}
+
+// TransferRecipientsResponse reports which recipients were added to the files of a transfer
+// AlreadyRecipients lists requested emails that already had access to every file and were left unchanged
+type TransferRecipientsResponse struct {
+	Message           string   `json:"message"`
+	TransferID        string   `json:"transfer_id"`
+	Added             []string `json:"added"`
+	AlreadyRecipients []string `json:"already_recipients"`
+}
+
+// RemoveTransferRecipientResponse represents the response after a recipient was removed from a transfer
+// Removals maps the ID of every file the recipient was removed from to the removal
+type RemoveTransferRecipientResponse struct {
+	Message    string                      `json:"message"`
+	TransferID string                      `json:"transfer_id"`
+	Removals   map[string]RecipientRemoval `json:"removals"`
+}
+
+// CreatedTransferFile describes one file of a newly created transfer
+// MissingKeys lists recipients for whom no wrapped key of this file was supplied
+type CreatedTransferFile struct {
+	FileID       string   `json:"file_id"`
+	RelativePath string   `json:"relative_path"`
+	TotalChunks  int      `json:"total_chunks"`
+	MissingKeys  []string `json:"missing_keys"`
+}
+
+// CreateTransferResponse represents the response after a transfer has been created
+// Files are listed in the order they were requested
+type CreateTransferResponse struct {
+	Message       string                `json:"message"`
+	TransferID    string                `json:"transfer_id"`
+	ExpiresAt     time.Time             `json:"expires_at"`
+	ForwardPolicy string                `json:"forward_policy"`
+	Files         []CreatedTransferFile `json:"files"`
+}
+
+// TransferFile describes one file of a transfer
+type TransferFile struct {
+	FileID       string     `json:"file_id"`
+	RelativePath string     `json:"relative_path"`
+	FileSize     int64      `json:"file_size"`
+	MimeType     string     `json:"mime_type"`
+	TotalChunks  int        `json:"total_chunks"`
+	CompletedAt  *time.Time `json:"completed_at"`
+}
+
+// Transfer describes a multi-file transfer
+// FileCount, TotalSize and Completed cover every file of the transfer; Files is only set on the detail view
+// and lists the files visible to the caller
+type Transfer struct {
+	TransferID string         `json:"transfer_id"`
+	Sender     User           `json:"sender"`
+	IsSender   bool           `json:"is_sender"`
+	CreatedAt  time.Time      `json:"created_at"`
+	ExpiresAt  time.Time      `json:"expires_at"`
+	Expired    bool           `json:"expired"`
+	FileCount  int            `json:"file_count"`
+	TotalSize  int64          `json:"total_size"`
+	Completed  bool           `json:"completed"`
+	Files      []TransferFile `json:"files,omitempty"`
+}
+
+// TransfersResponse represents a page of transfers sent or received by the authenticated user
+type TransfersResponse struct {
+	Transfers []Transfer `json:"transfers"`
+	Total     int        `json:"total"`
+	Limit     int        `json:"limit"`
+	Offset    int        `json:"offset"`
+}
+
+// TransferManifest contains everything a client needs to download and decrypt a whole transfer
+// Files lists the manifest of every file the caller can currently download
+type TransferManifest struct {
+	TransferID string         `json:"transfer_id"`
+	ExpiresAt  time.Time      `json:"expires_at"`
+	Completed  bool           `json:"completed"`
+	Files      []FileManifest `json:"files"`
+}
@@ -0,0 +1,106 @@
+package models
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateRelativePath(t *testing.T) {
+	valid := []string{
+		"report.pdf",
+		"reports/2024/q1.pdf",
+		"photos/.hidden",
+		"names with spaces/ünïcode.txt",
+	}
+	for _, path := range valid {
+		if err := ValidateRelativePath(path); err != nil {
+			t.Errorf("expected %q to be valid, got %v", path, err)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"/etc/passwd",
+		"../secret.txt",
+		"reports/../../secret.txt",
+		"reports/./q1.pdf",
+		"reports//q1.pdf",
+		"reports/",
+		`reports\q1.pdf`,
+		"reports/q1\x00.pdf",
+		"reports/q1\n.pdf",
+		strings.Repeat("a", 256),
+		strings.Repeat("a/", 600) + "b",
+	}
+	for _, path := range invalid {
+		if err := ValidateRelativePath(path); err == nil {
+			t.Errorf("expected %q to be rejected", path)
+		}
+	}
+}
+
+func TestCreateTransferRequestValidate(t *testing.T) {
+	req := CreateTransferRequest{
+		Recipients: []TransferRecipientRequest{{Email: " Bob@Example.com "}},
+		Files: []TransferFileRequest{
+			{RelativePath: "docs/a.txt", FileSize: 10, TotalChunks: 1, EncryptedKeys: map[string]string{"bob@example.com": "key-a"}},
+			{RelativePath: "docs/b.txt", FileSize: 10, TotalChunks: 1},
+		},
+	}
+	if err := req.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if req.ForwardPolicy != ForwardPolicyForbidden {
+		t.Errorf("expected default forward policy, got %q", req.ForwardPolicy)
+	}
+	if req.Files[0].EncryptedKeys["Bob@Example.com"] != "key-a" {
+		t.Errorf("expected wrapped key keyed by the recipient email, got %v", req.Files[0].EncryptedKeys)
+	}
+	if name := req.Files[0].FileName(); name != "a.txt" {
+		t.Errorf("expected file name a.txt, got %q", name)
+	}
+
+	req.Files[1].RelativePath = "DOCS/A.txt"
+	if err := req.Validate(); err == nil {
+		t.Error("expected duplicate paths differing only in case to be rejected")
+	}
+
+	req.Files[1].RelativePath = "docs/b.txt"
+	req.Files[1].EncryptedKeys = map[string]string{"carol@example.com": "key-b"}
+	if err := req.Validate(); err == nil {
+		t.Error("expected a wrapped key for a non-recipient to be rejected")
+	}
+
+	req.Files[1].EncryptedKeys = map[string]string{"bob@example.com": "key-b", "BOB@example.com ": "key-c"}
+	if err := req.Validate(); err == nil {
+		t.Error("expected wrapped keys for the same recipient differing only in case to be rejected")
+	}
+}
+
+func TestTransferRecipientsRequestValidate(t *testing.T) {
+	fileID := "123e4567-e89b-12d3-a456-426614174000"
+	req := TransferRecipientsRequest{
+		Recipients:    []TransferRecipientRequest{{Email: " Bob@Example.com "}},
+		EncryptedKeys: map[string]map[string]string{fileID: {"bob@example.com": " key-a "}},
+	}
+	if err := req.Validate(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if req.EncryptedKeys[fileID]["Bob@Example.com"] != "key-a" {
+		t.Errorf("expected wrapped key keyed by the recipient email, got %v", req.EncryptedKeys[fileID])
+	}
+
+	invalid := map[string]TransferRecipientsRequest{
+		"no recipients":        {EncryptedKeys: map[string]map[string]string{fileID: {}}},
+		"invalid file id":      {Recipients: req.Recipients, EncryptedKeys: map[string]map[string]string{"../x": {"bob@example.com": "key"}}},
+		"unknown recipient":    {Recipients: req.Recipients, EncryptedKeys: map[string]map[string]string{fileID: {"carol@example.com": "key"}}},
+		"empty wrapped key":    {Recipients: req.Recipients, EncryptedKeys: map[string]map[string]string{fileID: {"bob@example.com": " "}}},
+		"duplicate by case":    {Recipients: req.Recipients, EncryptedKeys: map[string]map[string]string{fileID: {"bob@example.com": "a", "BOB@example.com": "b"}}},
+		"duplicate recipients": {Recipients: []TransferRecipientRequest{{Email: "bob@example.com"}, {Email: "BOB@example.com"}}},
+	}
+	for name, req := range invalid {
+		if err := req.Validate(); err == nil {
+			t.Errorf("%s: expected request to be rejected", name)
+		}
+	}
+}
@@ -1,40 +1,50 @@
 package storage
 
 import (
-	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
 
 	"secure-document-transfer/internal/config"
+	"secure-document-transfer/internal/models"
 	storage_go "github.com/supabase-community/storage-go"
 )
 
 const (
 	// BucketName is the name of the Supabase storage bucket for encrypted files
 	BucketName = "encrypted-files"
+	// listPageSize is the number of objects requested per storage listing
+	listPageSize = 100
 )
 
-// UploadEncryptedChunk uploads an encrypted chunk to Supabase Storage
+// UploadEncryptedChunk streams an encrypted chunk to Supabase Storage without buffering it
+// Every upload gets its own storage path, so a retried or concurrent upload never overwrites a stored chunk;
+// the caller records the path of the upload that wins and deletes the others
 // Returns the storage path of the uploaded chunk
-// userToken is the JWT token of the authenticated user
-func UploadEncryptedChunk(fileID string, chunkIndex int, data io.Reader, userToken string) (string, error) {
-	// Generate storage path
-	storagePath := fmt.Sprintf("%s/chunk_%d.enc", fileID, chunkIndex)
+func UploadEncryptedChunk(fileID string, chunkIndex int, data io.Reader) (string, error) {
+	if !models.IsValidFileID(fileID) {
+		return "", fmt.Errorf("invalid file ID %q", fileID)
+	}
 
-	// Read data into buffer
-	buf := new(bytes.Buffer)
-	if _, err := io.Copy(buf, data); err != nil {
-		return "", fmt.Errorf("failed to read chunk data: %w", err)
+	uploadID := make([]byte, 8)
+	if _, err := rand.Read(uploadID); err != nil {
+		return "", fmt.Errorf("failed to generate upload ID: %w", err)
 	}
 
-	// Create a client with the user's token for authenticated storage access
-	supabaseURL := os.Getenv("SUPABASE_URL")
-	
-	userClient := storage_go.NewClient(supabaseURL+"/storage/v1", userToken, nil)
+	// Generate storage path
+	storagePath := fmt.Sprintf("%s/chunk_%d_%s.enc", fileID, chunkIndex, hex.EncodeToString(uploadID))
+
+	// The backend has already checked that the caller may upload to this file
+	client, err := serviceRoleClient()
+	if err != nil {
+		return "", err
+	}
 
-	// Upload to Supabase Storage using the user's authenticated client
-	_, err := userClient.UploadFile(BucketName, storagePath, buf)
+	contentType := "application/octet-stream"
+	_, err = client.UploadFile(BucketName, storagePath, data, storage_go.FileOptions{ContentType: &contentType})
 	if err != nil {
 		return "", fmt.Errorf("failed to upload chunk to storage: %w", err)
 	}
@@ -42,44 +52,123 @@ func UploadEncryptedChunk(fileID string, chunkIndex int, data io.Reader, userTok
 	return storagePath, nil
 }
 
-// DownloadEncryptedChunk downloads an encrypted chunk from Supabase Storage
-// userToken is the JWT token of the authenticated user
-func DownloadEncryptedChunk(storagePath string, userToken string) ([]byte, error) {
-	// Create a client with the user's token for authenticated storage access
-	supabaseURL := os.Getenv("SUPABASE_URL")
-	
-	userClient := storage_go.NewClient(supabaseURL+"/storage/v1", userToken, nil)
+// UploadTusSegment streams one segment of a tus upload to Supabase Storage
+// Segments live in the file's folder, so revoking or expiring the file removes them too
+// Returns the storage path of the segment
+func UploadTusSegment(fileID, uploadID string, offset int64, data io.Reader) (string, error) {
+	if !models.IsValidFileID(fileID) || !models.IsValidUploadID(uploadID) {
+		return "", fmt.Errorf("invalid file ID %q or upload ID %q", fileID, uploadID)
+	}
+
+	storagePath := fmt.Sprintf("%s/tus_%s_%d.part", fileID, uploadID, offset)
+
+	client, err := serviceRoleClient()
+	if err != nil {
+		return "", err
+	}
+
+	contentType := "application/octet-stream"
+	_, err = client.UploadFile(BucketName, storagePath, data, storage_go.FileOptions{ContentType: &contentType})
+	if err != nil {
+		return "", fmt.Errorf("failed to upload tus segment to storage: %w", err)
+	}
+
+	return storagePath, nil
+}
 
-	data, err := userClient.DownloadFile(BucketName, storagePath)
+// DeleteChunk deletes a single chunk object, e.g. one whose upload was rejected after it was stored
+func DeleteChunk(storagePath string) error {
+	client, err := serviceRoleClient()
 	if err != nil {
-		return nil, fmt.Errorf("failed to download chunk from storage: %w", err)
+		return err
+	}
+
+	if _, err := client.RemoveFile(BucketName, []string{storagePath}); err != nil {
+		return fmt.Errorf("failed to delete chunk: %w", err)
 	}
 
-	return data, nil
+	return nil
 }
 
-// DeleteFile deletes all chunks of a file from Supabase Storage
-func DeleteFile(fileID string) error {
-	// List all files in the fileID folder
-	files, err := config.SupabaseClient.Storage.ListFiles(BucketName, fileID, storage_go.FileSearchOptions{})
+// DownloadEncryptedChunk opens a streaming download of an encrypted chunk from Supabase Storage
+// The bucket does not allow authenticated users to read objects directly, so the chunk is fetched
+// with the service role key and callers must check the user's access to the file beforehand
+// Returns the chunk body, which the caller must close, and its size (-1 if unknown)
+func DownloadEncryptedChunk(storagePath string) (io.ReadCloser, int64, error) {
+	client, err := serviceRoleClient()
 	if err != nil {
-		return fmt.Errorf("failed to list file chunks: %w", err)
+		return nil, 0, err
 	}
 
-	// Delete each file
-	paths := make([]string, len(files))
-	for i, file := range files {
-		paths[i] = fmt.Sprintf("%s/%s", fileID, file.Name)
+	req, err := client.NewRequest(http.MethodGet, storageURL()+"/object/"+BucketName+"/"+storagePath)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to create download request: %w", err)
 	}
 
-	if len(paths) > 0 {
-		_, err = config.SupabaseClient.Storage.RemoveFile(BucketName, paths)
+	resp, err := client.Do(req, nil)
+	if err != nil {
+		if resp != nil && resp.Body != nil {
+			resp.Body.Close()
+		}
+		return nil, 0, fmt.Errorf("failed to download chunk from storage: %w", err)
+	}
+
+	return resp.Body, resp.ContentLength, nil
+}
+
+// DeleteFile deletes all chunks and tus upload segments of a file from Supabase Storage
+// The listing is paged, so files with more chunks than a single listing returns are fully removed
+func DeleteFile(fileID string) error {
+	// The file ID is the folder prefix to delete, so it must never be empty or contain a path
+	if !models.IsValidFileID(fileID) {
+		return fmt.Errorf("invalid file ID %q", fileID)
+	}
+
+	client, err := serviceRoleClient()
+	if err != nil {
+		return err
+	}
+
+	for {
+		// List the remaining files in the fileID folder
+		files, err := client.ListFiles(BucketName, fileID, storage_go.FileSearchOptions{Limit: listPageSize})
+		if err != nil {
+			return fmt.Errorf("failed to list file chunks: %w", err)
+		}
+		if len(files) == 0 {
+			return nil
+		}
+
+		// Delete each file
+		paths := make([]string, len(files))
+		for i, file := range files {
+			paths[i] = fmt.Sprintf("%s/%s", fileID, file.Name)
+		}
+
+		removed, err := client.RemoveFile(BucketName, paths)
 		if err != nil {
 			return fmt.Errorf("failed to delete file chunks: %w", err)
 		}
+		if len(removed) == 0 {
+			return fmt.Errorf("failed to delete file chunks: storage removed none of %d objects", len(paths))
+		}
 	}
+}
 
-	return nil
+// storageURL returns the base URL of the Supabase Storage API
+func storageURL() string {
+	return os.Getenv("SUPABASE_URL") + "/storage/v1"
+}
+
+// serviceRoleClient creates a storage client authenticated with the service role key
+// This client bypasses the bucket policies, so it must only be used after application-level access checks
+func serviceRoleClient() (*storage_go.Client, error) {
+	serviceRoleKey := os.Getenv("SUPABASE_SERVICE_ROLE_KEY")
+	if os.Getenv("SUPABASE_URL") == "" || serviceRoleKey == "" {
+		return nil, fmt.Errorf("SUPABASE_URL and SUPABASE_SERVICE_ROLE_KEY must be set")
+	}
+
+	return storage_go.NewClient(storageURL(), serviceRoleKey, map[string]string{"apikey": serviceRoleKey}), nil
 }
 
 // InitializeBucket checks if the storage bucket exists
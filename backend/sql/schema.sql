@@ -60,26 +60,56 @@ CREATE TRIGGER update_users_updated_at
 -- ============================================================================
 
 -- Drop existing file-related tables if they exist
+DROP TABLE IF EXISTS public.messages CASCADE;
+DROP TABLE IF EXISTS public.message_thread_keys CASCADE;
+DROP TABLE IF EXISTS public.message_threads CASCADE;
+DROP TABLE IF EXISTS public.file_recipient_removals CASCADE;
+DROP TABLE IF EXISTS public.tus_uploads CASCADE;
+DROP TABLE IF EXISTS public.user_quotas CASCADE;
+DROP TABLE IF EXISTS public.file_tombstones CASCADE;
+DROP TABLE IF EXISTS public.file_chunk_downloads CASCADE;
 DROP TABLE IF EXISTS public.file_recipients CASCADE;
 DROP TABLE IF EXISTS public.file_chunks CASCADE;
 DROP TABLE IF EXISTS public.file_metadata CASCADE;
+DROP TABLE IF EXISTS public.transfers CASCADE;
+
+-- Create the transfers table to group several files under one recipient list and one expiry
+-- Each file of a transfer is a file_metadata row with its own chunks and wrapped keys
+CREATE TABLE public.transfers (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(), -- Server-issued transfer ID
+    sender_id UUID NOT NULL REFERENCES auth.users(id) ON DELETE CASCADE,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL, -- Shared by every file of the transfer
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX idx_transfers_sender_id ON public.transfers(sender_id);
 
 -- Create the file_metadata table to track files being transferred
 CREATE TABLE public.file_metadata (
     id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
-    file_id TEXT NOT NULL UNIQUE, -- Client-generated file ID
+    file_id TEXT NOT NULL UNIQUE DEFAULT gen_random_uuid()::text, -- Server-issued file ID
     sender_id UUID NOT NULL REFERENCES auth.users(id) ON DELETE CASCADE,
     original_filename TEXT NOT NULL,
     file_size BIGINT NOT NULL,
     total_chunks INTEGER NOT NULL,
     mime_type TEXT,
     created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
-    completed_at TIMESTAMP WITH TIME ZONE
+    completed_at TIMESTAMP WITH TIME ZONE,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW() + INTERVAL '7 days', -- Chosen by the sender at upload time
+    expired_at TIMESTAMP WITH TIME ZONE, -- Set once the expiry reaper has deleted the chunks
+    merkle_root TEXT, -- Hex Merkle root over the ordered chunk hashes, set when the upload is finalized
+    forward_policy TEXT NOT NULL DEFAULT 'forbidden' CHECK (forward_policy IN ('allowed', 'same_domain', 'forbidden')), -- Whether recipients may forward the file
+    transfer_id UUID REFERENCES public.transfers(id) ON DELETE CASCADE, -- NULL for files sent on their own
+    relative_path TEXT, -- Path of the file within its transfer, e.g. "reports/2024/q1.pdf"
+    UNIQUE(transfer_id, relative_path)
 );
 
 -- Create index for faster lookups
 CREATE INDEX idx_file_metadata_file_id ON public.file_metadata(file_id);
 CREATE INDEX idx_file_metadata_sender_id ON public.file_metadata(sender_id);
+CREATE INDEX idx_file_metadata_expires_at ON public.file_metadata(expires_at) WHERE expired_at IS NULL;
+CREATE INDEX idx_file_metadata_transfer_id ON public.file_metadata(transfer_id);
+CREATE INDEX idx_file_metadata_incomplete ON public.file_metadata(created_at) WHERE completed_at IS NULL;
 
 -- Create the file_chunks table to track individual chunks
 CREATE TABLE public.file_chunks (
@@ -89,8 +119,11 @@ CREATE TABLE public.file_chunks (
     chunk_size BIGINT NOT NULL,
     storage_path TEXT NOT NULL, -- Path in Supabase Storage
     encryption_iv TEXT NOT NULL, -- IV used for chunk encryption (base64)
+    content_sha256 TEXT NOT NULL, -- Hex SHA-256 of the encrypted chunk, used to recognise retried uploads
+    idempotency_key TEXT, -- Optional Idempotency-Key header of the upload that stored the chunk
     created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
-    UNIQUE(file_id, chunk_index)
+    UNIQUE(file_id, chunk_index),
+    UNIQUE(file_id, idempotency_key)
 );
 
 -- Create indexes for efficient chunk retrieval
@@ -105,7 +138,11 @@ CREATE TABLE public.file_recipients (
     recipient_id UUID REFERENCES auth.users(id) ON DELETE CASCADE,
     recipient_email TEXT NOT NULL, -- Store email for recipients who don't have accounts yet
     encrypted_file_key TEXT NOT NULL, -- AES key encrypted with recipient's public key (base64)
-    downloaded_at TIMESTAMP WITH TIME ZONE,
+    downloaded_at TIMESTAMP WITH TIME ZONE, -- First completed download (delivery receipt)
+    last_downloaded_at TIMESTAMP WITH TIME ZONE, -- Most recent completed download
+    max_downloads INTEGER CHECK (max_downloads > 0), -- NULL means unlimited
+    download_count INTEGER NOT NULL DEFAULT 0, -- Completed downloads; the wrapped key is wiped once it reaches max_downloads
+    forwarded_by UUID REFERENCES auth.users(id) ON DELETE SET NULL, -- Recipient who forwarded the file; NULL when added by the sender
     created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
     -- Ensure each recipient can only be added once per file (for concurrent upload safety)
     UNIQUE(file_id, recipient_email)
@@ -116,14 +153,136 @@ CREATE INDEX idx_file_recipients_file_id ON public.file_recipients(file_id);
 CREATE INDEX idx_file_recipients_recipient_id ON public.file_recipients(recipient_id);
 CREATE INDEX idx_file_recipients_recipient_email ON public.file_recipients(recipient_email);
 
+-- Create the file_chunk_downloads table to track which chunks a recipient has fetched
+-- Once every chunk has been fetched the download is recorded on file_recipients and the rows are cleared
+CREATE TABLE public.file_chunk_downloads (
+    file_recipient_id UUID NOT NULL REFERENCES public.file_recipients(id) ON DELETE CASCADE,
+    chunk_index INTEGER NOT NULL,
+    fetched_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    PRIMARY KEY (file_recipient_id, chunk_index)
+);
+
+-- Create the file_recipient_removals table to record recipients the sender cut off
+-- The recipient's file_recipients row (and wrapped key) is deleted; the removal lets the
+-- sender see who lost access and when, and tells the former recipient their access was removed
+CREATE TABLE public.file_recipient_removals (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    file_id TEXT NOT NULL REFERENCES public.file_metadata(file_id) ON DELETE CASCADE,
+    recipient_id UUID REFERENCES auth.users(id) ON DELETE SET NULL,
+    recipient_email TEXT NOT NULL, -- Stored lowercase
+    download_count INTEGER NOT NULL DEFAULT 0, -- Completed downloads before access was removed
+    removed_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX idx_file_recipient_removals_file_id ON public.file_recipient_removals(file_id);
+
+-- Create the file_tombstones table to remember files revoked by their sender
+-- The file's metadata, chunks and recipients are deleted; the tombstone lets former
+-- recipients get a "revoked by sender" error instead of a 404
+CREATE TABLE public.file_tombstones (
+    file_id TEXT PRIMARY KEY,
+    sender_id UUID NOT NULL REFERENCES auth.users(id) ON DELETE CASCADE,
+    original_filename TEXT NOT NULL,
+    recipient_ids UUID[] NOT NULL DEFAULT '{}',
+    recipient_emails TEXT[] NOT NULL DEFAULT '{}', -- Stored lowercase
+    revoked_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- Create the user_quotas table for per-user limits
+-- Users without a row (or with a NULL column) get the defaults from
+-- STORAGE_QUOTA_BYTES and ACTIVE_TRANSFER_QUOTA
+CREATE TABLE public.user_quotas (
+    user_id UUID PRIMARY KEY REFERENCES auth.users(id) ON DELETE CASCADE,
+    max_storage_bytes BIGINT CHECK (max_storage_bytes > 0), -- Ciphertext bytes across all of the user's files
+    max_active_transfers INTEGER CHECK (max_active_transfers > 0), -- Unexpired transfers; a file sent on its own counts as one
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- Create the tus_uploads table to track tus resumable uploads
+-- Each tus upload carries one encrypted chunk of an existing file. The bytes received
+-- so far are stored as segment objects under the file's storage folder and are
+-- assembled into the chunk once upload_offset reaches upload_length
+CREATE TABLE public.tus_uploads (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    file_id TEXT NOT NULL REFERENCES public.file_metadata(file_id) ON DELETE CASCADE,
+    sender_id UUID NOT NULL REFERENCES auth.users(id) ON DELETE CASCADE,
+    chunk_index INTEGER NOT NULL,
+    encryption_iv TEXT NOT NULL,
+    content_sha256 TEXT, -- Optional client checksum, verified when the chunk is assembled
+    upload_length BIGINT NOT NULL CHECK (upload_length >= 0),
+    upload_offset BIGINT NOT NULL DEFAULT 0,
+    segment_paths TEXT[] NOT NULL DEFAULT '{}', -- Storage paths of the received segments, in order
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+-- Create the message_threads table for end-to-end encrypted conversations on a transfer
+-- Threads of a multi-file transfer reference the transfer; a file sent on its own is its own
+-- transfer and its threads reference the file. A thread is encrypted with the AES key of one
+-- file of the transfer (key_source 'file', key_file_id) or with an AES key of its own that is
+-- wrapped for each participant in message_thread_keys (key_source 'thread')
+CREATE TABLE public.message_threads (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    transfer_id UUID REFERENCES public.transfers(id) ON DELETE CASCADE, -- Set for multi-file transfers
+    file_id TEXT REFERENCES public.file_metadata(file_id) ON DELETE CASCADE, -- Set for files sent on their own
+    created_by UUID NOT NULL REFERENCES auth.users(id) ON DELETE CASCADE,
+    key_source TEXT NOT NULL CHECK (key_source IN ('file', 'thread')),
+    key_file_id TEXT REFERENCES public.file_metadata(file_id) ON DELETE CASCADE, -- File whose key encrypts a 'file' thread; nobody can read the thread once it is revoked
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    CHECK ((transfer_id IS NULL) <> (file_id IS NULL)),
+    CHECK ((key_source = 'file') = (key_file_id IS NOT NULL))
+);
+
+CREATE INDEX idx_message_threads_transfer_id ON public.message_threads(transfer_id, created_at) WHERE transfer_id IS NOT NULL;
+CREATE INDEX idx_message_threads_file_id ON public.message_threads(file_id, created_at) WHERE file_id IS NOT NULL;
+
+-- Create the message_thread_keys table to store a thread's AES key wrapped for each participant
+-- Keys are wrapped with the participant's RSA public key, like file_recipients.encrypted_file_key
+CREATE TABLE public.message_thread_keys (
+    thread_id UUID NOT NULL REFERENCES public.message_threads(id) ON DELETE CASCADE,
+    recipient_email TEXT NOT NULL, -- Stored lowercase
+    encrypted_thread_key TEXT NOT NULL, -- Thread AES key encrypted with the participant's public key (base64)
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    PRIMARY KEY (thread_id, recipient_email)
+);
+
+-- Create the messages table to store encrypted messages
+-- The server only stores the AES-GCM ciphertext and IV and cannot read any message
+CREATE TABLE public.messages (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    thread_id UUID NOT NULL REFERENCES public.message_threads(id) ON DELETE CASCADE,
+    sender_id UUID NOT NULL REFERENCES auth.users(id) ON DELETE CASCADE,
+    ciphertext TEXT NOT NULL, -- AES-GCM encrypted message body (base64)
+    iv TEXT NOT NULL, -- IV used for message encryption (base64)
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+CREATE INDEX idx_messages_thread_id ON public.messages(thread_id, created_at);
+
 -- ============================================================================
 -- ROW LEVEL SECURITY POLICIES FOR FILE TABLES
 -- ============================================================================
 
 -- Enable RLS on all file tables
 ALTER TABLE public.file_metadata ENABLE ROW LEVEL SECURITY;
+-- transfers has no policies: it is only written and read by the backend
+ALTER TABLE public.transfers ENABLE ROW LEVEL SECURITY;
 ALTER TABLE public.file_chunks ENABLE ROW LEVEL SECURITY;
 ALTER TABLE public.file_recipients ENABLE ROW LEVEL SECURITY;
+-- file_chunk_downloads has no policies: it is only written by the backend
+ALTER TABLE public.file_chunk_downloads ENABLE ROW LEVEL SECURITY;
+-- file_tombstones has no policies: it is only written and read by the backend
+ALTER TABLE public.file_tombstones ENABLE ROW LEVEL SECURITY;
+-- file_recipient_removals has no policies: it is only written and read by the backend
+ALTER TABLE public.file_recipient_removals ENABLE ROW LEVEL SECURITY;
+-- user_quotas has no policies: it is managed by administrators and read by the backend
+ALTER TABLE public.user_quotas ENABLE ROW LEVEL SECURITY;
+-- tus_uploads has no policies: it is only written and read by the backend
+ALTER TABLE public.tus_uploads ENABLE ROW LEVEL SECURITY;
+-- message tables have no policies: messages are only written and read by the backend
+ALTER TABLE public.message_threads ENABLE ROW LEVEL SECURITY;
+ALTER TABLE public.message_thread_keys ENABLE ROW LEVEL SECURITY;
+ALTER TABLE public.messages ENABLE ROW LEVEL SECURITY;
 
 -- file_metadata policies
 CREATE POLICY "Users can insert their own files"
@@ -198,13 +357,8 @@ CREATE POLICY "Users can view recipient records for their files"
         OR recipient_email = (SELECT email FROM auth.users WHERE id = auth.uid()::uuid)
     );
 
-CREATE POLICY "Recipients can update their download status"
-    ON public.file_recipients
-    FOR UPDATE
-    USING (
-        recipient_id = auth.uid()::uuid
-        OR recipient_email = (SELECT email FROM auth.users WHERE id = auth.uid()::uuid)
-    );
+-- file_recipients has no UPDATE policy: download counts, limits and timestamps are only written by the backend,
+-- so recipients cannot reset their own download limit
 
 -- ============================================================================
 -- STORAGE BUCKET POLICIES
@@ -217,7 +371,7 @@ CREATE POLICY "Recipients can update their download status"
 --   4. Enable RLS
 
 -- Storage policies use the storage.objects table
--- Path format: encrypted-files/{file_id}/chunk_{index}.enc
+-- Path format: encrypted-files/{file_id}/chunk_{index}_{upload id}.enc
 
 -- Simplified storage policies to avoid infinite recursion with RLS
 -- We rely on application-level checks in the backend for fine-grained access control
@@ -232,15 +386,11 @@ CREATE POLICY "Authenticated users can upload encrypted files"
         AND auth.uid() IS NOT NULL
     );
 
--- Policy: Allow authenticated users to download from encrypted-files bucket
--- The backend ensures users only download chunks they have access to
-CREATE POLICY "Authenticated users can download encrypted files"
-    ON storage.objects
-    FOR SELECT
-    USING (
-        bucket_id = 'encrypted-files'
-        AND auth.uid() IS NOT NULL
-    );
+-- Note: There is intentionally no SELECT policy for the encrypted-files bucket
+-- Authenticated users cannot read objects directly; downloads go through
+-- GET /api/files/{file_id}/chunks/{index}, which checks that the caller is the
+-- sender or a recipient of the file before streaming the chunk with the service role key
+DROP POLICY IF EXISTS "Authenticated users can download encrypted files" ON storage.objects;
 
 -- Policy: Allow authenticated users to delete from encrypted-files bucket
 -- The backend ensures users only delete their own files
@@ -1,6 +1,6 @@
 import React, { useEffect, useState } from 'react';
 import { useNavigate } from 'react-router-dom';
-import { authService, userService } from '../services/api';
+import { authService, fileService, userService } from '../services/api';
 import type { User } from '../types/auth';
 import type { FileChunk, ChunkedFile } from '../types/file';
 import { 
@@ -9,11 +9,23 @@ import {
   encryptChunk, 
   arrayBufferToBase64,
   encryptKeyForRecipient,
-  getMimeType 
+  getMimeType,
+  sha256Hex
 } from '../utils/crypto';
 
 // Configuration for file chunking
 const CHUNK_SIZE = 1024 * 1024 * 2; // 2MB chunks
+const CHUNKS_PER_BATCH = 8; // Chunks sent per batch upload request
+
+// A file whose key has been generated and wrapped, ready to be added to a transfer
+interface PreparedFile {
+  file: File;
+  relativePath: string;
+  aesKey: CryptoKey;
+  encryptedKeys: { [email: string]: string };
+  totalChunks: number;
+  mimeType: string;
+}
 
 const Dashboard: React.FC = () => {
   const navigate = useNavigate();
@@ -137,22 +149,12 @@ const Dashboard: React.FC = () => {
     setSelectedUsers(prev => prev.filter(u => u.id !== userId));
   };
 
-  // Generate a unique file ID
-  const generateFileId = (): string => {
-    return `${Date.now()}-${Math.random().toString(36).substring(2, 15)}`;
-  };
-
-  // Chunk and encrypt a single file
-  const chunkFile = async (
-    file: File, 
-    recipientEmails: string[], 
+  // Generate a file's AES key and wrap it for every recipient that has a public key
+  const prepareFile = async (
+    file: File,
+    recipientEmails: string[],
     recipientPublicKeys: { [email: string]: string }
-  ): Promise<ChunkedFile> => {
-    const fileId = generateFileId();
-    const chunks: FileChunk[] = [];
-    const totalChunks = Math.ceil(file.size / CHUNK_SIZE);
-    const mimeType = getMimeType(file);
-
+  ): Promise<PreparedFile> => {
     // Generate a single AES key for the entire file
     const aesKey = await generateAESKey();
 
@@ -169,6 +171,22 @@ const Dashboard: React.FC = () => {
       }
     }
 
+    return {
+      file,
+      // Files picked from a folder keep their path so the tree can be recreated
+      relativePath: file.webkitRelativePath || file.name,
+      aesKey,
+      encryptedKeys,
+      totalChunks: Math.max(1, Math.ceil(file.size / CHUNK_SIZE)),
+      mimeType: getMimeType(file),
+    };
+  };
+
+  // Chunk and encrypt a single file of a transfer
+  const chunkFile = async (prepared: PreparedFile, fileId: string): Promise<ChunkedFile> => {
+    const { file, aesKey, totalChunks } = prepared;
+    const chunks: FileChunk[] = [];
+
     // Process each chunk
     for (let i = 0; i < totalChunks; i++) {
       const start = i * CHUNK_SIZE;
@@ -181,6 +199,7 @@ const Dashboard: React.FC = () => {
       // Encrypt the chunk
       const encryptedData = await encryptChunk(chunkBlob, aesKey, iv);
       const encryptedBlob = new Blob([encryptedData]);
+      const checksum = await sha256Hex(encryptedData);
 
       // Convert IV to base64 for transmission
       const ivBase64 = arrayBufferToBase64(iv.buffer as ArrayBuffer);
@@ -191,11 +210,9 @@ const Dashboard: React.FC = () => {
         total_chunks: totalChunks,
         chunk_data: encryptedBlob,
         original_filename: file.name,
-        file_size: file.size,
         chunk_size: encryptedBlob.size,
         iv: ivBase64,
-        encrypted_keys: encryptedKeys,
-        mime_type: mimeType,
+        sha256: checksum,
       });
     }
 
@@ -241,13 +258,33 @@ const Dashboard: React.FC = () => {
         }
       }
 
+      // Wrap a fresh key per file, then create all files as one transfer with a shared recipient list
+      const preparedFiles: PreparedFile[] = [];
+      for (const file of files) {
+        preparedFiles.push(await prepareFile(file, recipientEmails, recipientPublicKeys));
+      }
+
+      const transfer = await userService.createTransfer({
+        recipients: recipientEmails.map(email => ({ email })),
+        files: preparedFiles.map(prepared => ({
+          relative_path: prepared.relativePath,
+          file_size: prepared.file.size,
+          total_chunks: prepared.totalChunks,
+          mime_type: prepared.mimeType,
+          encrypted_keys: prepared.encryptedKeys,
+        })),
+      });
+      console.log(`Created transfer ${transfer.transfer_id} with ${transfer.files.length} file(s)`);
+
       // Chunk and encrypt all files
       const chunkedFiles: ChunkedFile[] = [];
-      for (const file of files) {
-        console.log(`Starting encryption for file: ${file.name}`);
+      for (let fileIndex = 0; fileIndex < preparedFiles.length; fileIndex++) {
+        const prepared = preparedFiles[fileIndex];
+        const file = prepared.file;
+        console.log(`Starting encryption for file: ${prepared.relativePath}`);
         try {
-          const chunked = await chunkFile(file, recipientEmails, recipientPublicKeys);
-          console.log(`File "${file.name}" chunked and encrypted:`, {
+          const chunked = await chunkFile(prepared, transfer.files[fileIndex].file_id);
+          console.log(`File "${prepared.relativePath}" chunked and encrypted:`, {
             file_id: chunked.file_id,
             total_chunks: chunked.total_chunks,
             original_size: file.size,
@@ -262,8 +299,8 @@ const Dashboard: React.FC = () => {
           });
           chunkedFiles.push(chunked);
         } catch (encryptError) {
-          console.error(`Encryption error for file ${file.name}:`, encryptError);
-          throw new Error(`Failed to encrypt file "${file.name}": ${encryptError instanceof Error ? encryptError.message : String(encryptError)}`);
+          console.error(`Encryption error for file ${prepared.relativePath}:`, encryptError);
+          throw new Error(`Failed to encrypt file "${prepared.relativePath}": ${encryptError instanceof Error ? encryptError.message : String(encryptError)}`);
         }
       }
 
@@ -272,29 +309,38 @@ const Dashboard: React.FC = () => {
         const chunkedFile = chunkedFiles[fileIndex];
         console.log(`Starting upload for file ${fileIndex + 1}/${chunkedFiles.length}`);
         
-        for (let chunkIndex = 0; chunkIndex < chunkedFile.chunks.length; chunkIndex++) {
-          const chunk = chunkedFile.chunks[chunkIndex];
+        for (let start = 0; start < chunkedFile.chunks.length; start += CHUNKS_PER_BATCH) {
+          const batch = chunkedFile.chunks.slice(start, start + CHUNKS_PER_BATCH);
+          const last = start + batch.length;
           
           // Update progress
           setUploadProgress({
-            currentFile: chunk.original_filename,
-            currentChunk: chunkIndex + 1,
-            totalChunks: chunk.total_chunks,
+            currentFile: chunkedFile.original_file.name,
+            currentChunk: last,
+            totalChunks: chunkedFile.total_chunks,
             fileIndex: fileIndex + 1,
             totalFiles: chunkedFiles.length,
           });
 
-          console.log(`Uploading chunk ${chunkIndex + 1}/${chunk.total_chunks} for ${chunk.original_filename}`);
+          console.log(`Uploading chunks ${start + 1}-${last}/${chunkedFile.total_chunks} for ${chunkedFile.original_file.name}`);
           
-          // Send the chunk
+          // Send the chunks in one request
           try {
-            await userService.sendFileChunk(chunk, recipientEmails);
-            console.log(`Successfully uploaded chunk ${chunkIndex + 1}/${chunk.total_chunks}`);
+            const result = await userService.sendFileChunks(chunkedFile.file_id, batch);
+            const failed = result.chunks.filter(c => c.status !== 200);
+            if (failed.length > 0) {
+              throw new Error(failed.map(c => `chunk ${c.chunk_index + 1}: ${c.error}`).join(', '));
+            }
+            console.log(`Successfully uploaded chunks ${start + 1}-${last}/${chunkedFile.total_chunks}`);
           } catch (uploadError) {
-            console.error(`Upload error for chunk ${chunkIndex + 1}:`, uploadError);
-            throw new Error(`Failed to upload chunk ${chunkIndex + 1}: ${uploadError instanceof Error ? uploadError.message : String(uploadError)}`);
+            console.error(`Upload error for chunks ${start + 1}-${last}:`, uploadError);
+            throw new Error(`Failed to upload chunks ${start + 1}-${last}: ${uploadError instanceof Error ? uploadError.message : String(uploadError)}`);
           }
         }
+
+        // Mark the upload complete; the server checks that every chunk and recipient key is present
+        await fileService.finalizeFile(chunkedFile.file_id);
+        console.log(`Finalized file ${chunkedFile.original_file.name}`);
       }
       
       // Reset form and progress
@@ -306,7 +352,10 @@ const Dashboard: React.FC = () => {
       alert('Files sent successfully!');
     } catch (err: any) {
       console.error('Upload error:', err);
-      const errorMessage = err.response?.data?.error || err.message || 'Failed to send files. Please try again.';
+      const problems: string[] | undefined = err.response?.data?.problems;
+      const errorMessage = problems?.length
+        ? `${err.response.data.error}:\n\n${problems.join('\n')}`
+        : err.response?.data?.error || err.message || 'Failed to send files. Please try again.';
       alert(errorMessage);
       setUploadProgress(null);
     } finally {
@@ -542,7 +591,24 @@ const Dashboard: React.FC = () => {
                 Click to browse or drag and drop files here
               </div>
               <div style={{ fontSize: '0.875rem', color: 'var(--text-muted)' }}>
-                You can attach multiple files
+                You can attach multiple files or{' '}
+                <button
+                  type="button"
+                  onClick={(e) => {
+                    e.stopPropagation();
+                    document.getElementById('folder-input')?.click();
+                  }}
+                  style={{
+                    background: 'none',
+                    border: 'none',
+                    padding: 0,
+                    color: 'var(--primary-color)',
+                    cursor: 'pointer',
+                    fontSize: 'inherit'
+                  }}
+                >
+                  a whole folder
+                </button>
               </div>
               <input
                 id="file-input"
@@ -551,6 +617,14 @@ const Dashboard: React.FC = () => {
                 onChange={handleFileSelect}
                 style={{ display: 'none' }}
               />
+              <input
+                id="folder-input"
+                type="file"
+                multiple
+                ref={(el) => el?.setAttribute('webkitdirectory', '')}
+                onChange={handleFileSelect}
+                style={{ display: 'none' }}
+              />
             </div>
 
             {/* Attached Files List */}
@@ -585,7 +659,7 @@ const Dashboard: React.FC = () => {
                           overflow: 'hidden',
                           textOverflow: 'ellipsis'
                         }}>
-                          {file.name}
+                          {file.webkitRelativePath || file.name}
                         </div>
                         <div style={{ fontSize: '0.875rem', color: 'var(--text-muted)' }}>
                           {formatFileSize(file.size)}
@@ -1,6 +1,6 @@
 import axios from 'axios';
 import type { SignUpRequest, SignUpResponse, SignInRequest, SignInResponse, User, PasswordResetRequest, PasswordResetResponse, PasswordResetConfirm } from '../types/auth';
-import type { FileChunk } from '../types/file';
+import type { AddRecipientsResponse, BatchUploadResponse, CreateFileRequest, CreateFileResponse, CreateTransferRequest, CreateTransferResponse, FileChunk, FileManifest, FileRecipientRequest, FinalizeFileResponse, ForwardPolicy, MessagesResponse, PostMessageRequest, PostMessageResponse, StorageUsage, TransferRecipientsRequest, TransferRecipientsResponse, UploadStatus } from '../types/file';
 
 const api = axios.create({
   baseURL: '/api',
@@ -70,22 +70,23 @@ export const userService = {
     return response.data;
   },
 
-  sendFileChunk: async (chunk: FileChunk, recipientEmails: string[]): Promise<{ message: string }> => {
+  createFile: async (request: CreateFileRequest): Promise<CreateFileResponse> => {
+    const response = await api.post<CreateFileResponse>('/files', request);
+    return response.data;
+  },
+
+  createTransfer: async (request: CreateTransferRequest): Promise<CreateTransferResponse> => {
+    const response = await api.post<CreateTransferResponse>('/transfers', request);
+    return response.data;
+  },
+
+  sendFileChunk: async (chunk: FileChunk): Promise<{ message: string }> => {
     const formData = new FormData();
-    formData.append('encrypted_chunk', chunk.chunk_data);
     formData.append('file_id', chunk.file_id);
     formData.append('chunk_index', chunk.chunk_index.toString());
-    formData.append('total_chunks', chunk.total_chunks.toString());
-    formData.append('original_filename', chunk.original_filename);
-    formData.append('file_size', chunk.file_size.toString());
-    formData.append('chunk_size', chunk.chunk_size.toString());
     formData.append('iv', chunk.iv);
-    formData.append('encrypted_keys', JSON.stringify(chunk.encrypted_keys));
-    formData.append('mime_type', chunk.mime_type);
-    
-    recipientEmails.forEach(email => {
-      formData.append('recipient_emails[]', email);
-    });
+    formData.append('sha256', chunk.sha256);
+    formData.append('encrypted_chunk', chunk.chunk_data);
 
     const response = await api.post<{ message: string }>('/files/send-chunk', formData, {
       headers: {
@@ -94,6 +95,118 @@ export const userService = {
     });
     return response.data;
   },
+
+  // Uploads several chunks of one file in a single request; the manifest must come before the chunk parts
+  sendFileChunks: async (fileId: string, chunks: FileChunk[]): Promise<BatchUploadResponse> => {
+    const formData = new FormData();
+    formData.append('manifest', JSON.stringify({
+      chunks: chunks.map(chunk => ({
+        chunk_index: chunk.chunk_index,
+        iv: chunk.iv,
+        sha256: chunk.sha256,
+      })),
+    }));
+    chunks.forEach(chunk => {
+      formData.append(`chunk_${chunk.chunk_index}`, chunk.chunk_data);
+    });
+
+    const response = await api.post<BatchUploadResponse>(
+      `/files/${encodeURIComponent(fileId)}/chunks/batch`,
+      formData,
+      {
+        headers: {
+          'Content-Type': 'multipart/form-data',
+        },
+      }
+    );
+    return response.data;
+  },
+};
+
+export const fileService = {
+  getUsage: async (): Promise<StorageUsage> => {
+    const response = await api.get<StorageUsage>('/usage');
+    return response.data;
+  },
+
+  // Missing recipient keys (email -> wrapped key) can be supplied when finalizing
+  finalizeFile: async (fileId: string, encryptedKeys?: { [email: string]: string }): Promise<FinalizeFileResponse> => {
+    const response = await api.post<FinalizeFileResponse>(
+      `/files/${encodeURIComponent(fileId)}/finalize`,
+      { encrypted_keys: encryptedKeys }
+    );
+    return response.data;
+  },
+
+  addRecipients: async (fileId: string, recipients: FileRecipientRequest[]): Promise<AddRecipientsResponse> => {
+    const response = await api.post<AddRecipientsResponse>(
+      `/files/${encodeURIComponent(fileId)}/recipients`,
+      { recipients }
+    );
+    return response.data;
+  },
+
+  setForwardPolicy: async (fileId: string, forwardPolicy: ForwardPolicy): Promise<void> => {
+    await api.put(`/files/${encodeURIComponent(fileId)}/forward-policy`, { forward_policy: forwardPolicy });
+  },
+
+  forwardFile: async (fileId: string, recipients: FileRecipientRequest[]): Promise<AddRecipientsResponse> => {
+    const response = await api.post<AddRecipientsResponse>(
+      `/files/${encodeURIComponent(fileId)}/forward`,
+      { recipients }
+    );
+    return response.data;
+  },
+
+  addTransferRecipients: async (transferId: string, request: TransferRecipientsRequest): Promise<TransferRecipientsResponse> => {
+    const response = await api.post<TransferRecipientsResponse>(
+      `/transfers/${encodeURIComponent(transferId)}/recipients`,
+      request
+    );
+    return response.data;
+  },
+
+  forwardTransfer: async (transferId: string, request: TransferRecipientsRequest): Promise<TransferRecipientsResponse> => {
+    const response = await api.post<TransferRecipientsResponse>(
+      `/transfers/${encodeURIComponent(transferId)}/forward`,
+      request
+    );
+    return response.data;
+  },
+
+  postMessage: async (fileId: string, request: PostMessageRequest): Promise<PostMessageResponse> => {
+    const response = await api.post<PostMessageResponse>(`/files/${encodeURIComponent(fileId)}/messages`, request);
+    return response.data;
+  },
+
+  getMessages: async (fileId: string, limit?: number, offset?: number): Promise<MessagesResponse> => {
+    const response = await api.get<MessagesResponse>(`/files/${encodeURIComponent(fileId)}/messages`, {
+      params: { limit, offset },
+    });
+    return response.data;
+  },
+
+  postTransferMessage: async (transferId: string, request: PostMessageRequest): Promise<PostMessageResponse> => {
+    const response = await api.post<PostMessageResponse>(`/transfers/${encodeURIComponent(transferId)}/messages`, request);
+    return response.data;
+  },
+
+  getTransferMessages: async (transferId: string, limit?: number, offset?: number): Promise<MessagesResponse> => {
+    const response = await api.get<MessagesResponse>(`/transfers/${encodeURIComponent(transferId)}/messages`, {
+      params: { limit, offset },
+    });
+    return response.data;
+  },
+
+  getUploadStatus: async (fileId: string): Promise<UploadStatus> => {
+    const response = await api.get<UploadStatus>(`/files/${encodeURIComponent(fileId)}/upload-status`);
+    return response.data;
+  },
+
+  getManifest: async (fileId: string): Promise<FileManifest> => {
+    const response = await api.get<FileManifest>(`/files/${encodeURIComponent(fileId)}/manifest`);
+    return response.data;
+  },
 };
 
 export default api;
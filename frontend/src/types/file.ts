@@ -1,14 +1,81 @@
 export interface FileChunk {
-  file_id: string;           // Unique identifier for the original file
+  file_id: string;           // Server-issued identifier returned by POST /files
   chunk_index: number;        // Index of this chunk (0-based)
   total_chunks: number;       // Total number of chunks for this file
   chunk_data: Blob;           // The actual encrypted chunk data
   original_filename: string;  // Name of the original file
-  file_size: number;          // Total size of the original file
   chunk_size: number;         // Size of this specific chunk
   iv: string;                 // Base64-encoded initialization vector
-  encrypted_keys: { [email: string]: string }; // Encrypted AES keys for each recipient
-  mime_type: string;          // MIME type of the original file
+  sha256: string;             // Hex SHA-256 of the encrypted chunk data
+}
+
+export interface FileRecipientRequest {
+  email: string;
+  encrypted_key: string;      // AES key wrapped with the recipient's RSA public key
+  max_downloads?: number;
+}
+
+export type ForwardPolicy = 'allowed' | 'same_domain' | 'forbidden';
+
+export interface CreateFileRequest {
+  original_filename: string;
+  file_size: number;
+  total_chunks: number;
+  mime_type: string;
+  expires_at?: string;        // RFC 3339, defaults to the server's transfer expiry
+  forward_policy?: ForwardPolicy; // Defaults to 'forbidden'
+  recipients: FileRecipientRequest[];
+}
+
+export interface CreateFileResponse {
+  message: string;
+  file_id: string;
+  total_chunks: number;
+  expires_at: string;
+  missing_keys: string[];
+}
+
+export interface TransferFileRequest {
+  relative_path: string;      // e.g. "reports/2024/q1.pdf"
+  file_size: number;
+  total_chunks: number;
+  mime_type: string;
+  encrypted_keys: { [email: string]: string }; // This file's AES key wrapped for each recipient
+}
+
+export interface CreateTransferRequest {
+  expires_at?: string;
+  forward_policy?: ForwardPolicy;
+  recipients: { email: string; max_downloads?: number }[];
+  files: TransferFileRequest[];
+}
+
+// Adds recipients to, or forwards, every file of a transfer; the files share one recipient list
+export interface TransferRecipientsRequest {
+  recipients: { email: string; max_downloads?: number }[];
+  encrypted_keys: { [fileId: string]: { [email: string]: string } }; // Each file's AES key wrapped for each new recipient
+}
+
+export interface TransferRecipientsResponse {
+  message: string;
+  transfer_id: string;
+  added: string[];
+  already_recipients: string[];
+}
+
+export interface CreatedTransferFile {
+  file_id: string;
+  relative_path: string;
+  total_chunks: number;
+  missing_keys: string[];
+}
+
+export interface CreateTransferResponse {
+  message: string;
+  transfer_id: string;
+  expires_at: string;
+  forward_policy: ForwardPolicy;
+  files: CreatedTransferFile[];
 }
 
 export interface ChunkedFile {
@@ -18,3 +85,136 @@ export interface ChunkedFile {
   total_chunks: number;
 }
 
+
+export interface ManifestChunk {
+  chunk_index: number;
+  chunk_size: number;
+  storage_path: string;
+  iv: string;                 // Base64-encoded IV used to encrypt this chunk
+  sha256: string;             // Hex SHA-256 of the encrypted chunk, check before decrypting
+  proof?: string[];           // Hex Merkle inclusion proof under the file's merkle_root, leaf to root
+}
+
+export interface FileManifest {
+  file_id: string;
+  original_filename: string;
+  relative_path?: string;     // Path within the transfer, for files sent as part of one
+  transfer_id?: string;
+  file_size: number;
+  mime_type: string;
+  total_chunks: number;
+  sender_id: string;
+  created_at: string;
+  completed_at: string | null;
+  merkle_root?: string;       // Hex Merkle root over the ordered chunk hashes, set once finalized
+  forward_policy: ForwardPolicy;
+  encrypted_file_key?: string; // AES key wrapped with the caller's RSA public key
+  chunks: ManifestChunk[];
+}
+
+export interface ChunkRange {
+  start: number;              // First missing chunk index (inclusive)
+  end: number;                // Last missing chunk index (inclusive)
+}
+
+export interface UploadStatus {
+  file_id: string;
+  total_chunks: number;
+  received_chunks: number[];
+  missing_ranges: ChunkRange[];
+  bytes_received: number;
+  completed: boolean;
+}
+
+export interface AddRecipientsResponse {
+  message: string;
+  file_id: string;
+  added: string[];
+  already_recipients: string[];
+}
+
+export interface FinalizeFileResponse {
+  message: string;
+  file_id: string;
+  completed_at: string;
+  merkle_root: string;
+}
+
+export interface StorageUsage {
+  stored_bytes: number;
+  max_storage_bytes: number;
+  active_transfers: number;
+  max_active_transfers: number;
+}
+
+export interface BatchChunkStatus {
+  chunk_index: number;
+  status: number;             // HTTP status for this chunk, 200 when stored
+  error?: string;
+  details?: string;
+  already_stored?: boolean;
+  storage_path?: string;
+}
+
+export interface BatchUploadResponse {
+  file_id: string;
+  total_chunks: number;
+  stored: number;
+  failed: number;
+  chunks: BatchChunkStatus[];
+}
+
+export type MessageKeySource = 'file' | 'thread';
+
+export interface PostMessageRequest {
+  thread_id?: string;                       // Omit to start a new thread
+  key_source?: MessageKeySource;            // Only when starting a thread, defaults to 'file'
+  key_file_id?: string;                     // File whose key encrypts a 'file' thread, optional for single files
+  thread_keys?: { [email: string]: string }; // Thread AES key wrapped per participant
+  ciphertext: string;                       // AES-GCM encrypted message (base64)
+  iv: string;                               // 12-byte IV (base64)
+}
+
+export interface MessageSender {
+  id: string;
+  email: string;
+}
+
+export interface Message {
+  message_id: string;
+  thread_id: string;
+  sender: MessageSender;
+  ciphertext: string;
+  iv: string;
+  created_at: string;
+}
+
+export interface PostMessageResponse {
+  message: string;
+  transfer_id?: string;                     // Set for multi-file transfers
+  file_id?: string;                         // Set for files sent on their own
+  key_source: MessageKeySource;
+  key_file_id?: string;
+  posted: Message;
+  missing_keys: string[];
+}
+
+export interface MessageThread {
+  thread_id: string;
+  key_source: MessageKeySource;
+  key_file_id?: string;
+  created_by: MessageSender;
+  created_at: string;
+  encrypted_file_key?: string;
+  encrypted_thread_key?: string;
+  messages: Message[];
+}
+
+export interface MessagesResponse {
+  transfer_id?: string;
+  file_id?: string;
+  threads: MessageThread[];
+  total: number;
+  limit: number;
+  offset: number;
+}
@@ -196,6 +196,99 @@ export async function encryptChunk(
   return await encryptData(arrayBuffer, aesKey, iv);
 }
 
+/**
+ * Decrypt a file chunk produced by encryptChunk
+ * ivBase64 is the chunk IV as listed in the download manifest
+ */
+export async function decryptChunk(
+  encryptedData: ArrayBuffer,
+  aesKey: CryptoKey,
+  ivBase64: string
+): Promise<ArrayBuffer> {
+  const iv = new Uint8Array(base64ToArrayBuffer(ivBase64));
+
+  return await window.crypto.subtle.decrypt(
+    {
+      name: 'AES-GCM',
+      iv: iv as BufferSource,
+    },
+    aesKey,
+    encryptedData
+  );
+}
+
+/**
+ * Compute the hex-encoded SHA-256 of an encrypted chunk
+ * Sent with each chunk upload and listed in the download manifest so integrity can be
+ * checked before attempting AES-GCM decryption
+ */
+export async function sha256Hex(data: ArrayBuffer): Promise<string> {
+  const digest = await window.crypto.subtle.digest('SHA-256', data);
+  return Array.from(new Uint8Array(digest))
+    .map(b => b.toString(16).padStart(2, '0'))
+    .join('');
+}
+
+const hexToBytes = (hex: string): Uint8Array => {
+  const bytes = new Uint8Array(hex.length / 2);
+  for (let i = 0; i < bytes.length; i++) {
+    bytes[i] = parseInt(hex.substr(i * 2, 2), 16);
+  }
+  return bytes;
+};
+
+const merkleHash = async (prefix: number, ...parts: Uint8Array[]): Promise<Uint8Array> => {
+  const length = parts.reduce((total, part) => total + part.length, 1);
+  const data = new Uint8Array(length);
+  data[0] = prefix;
+  let offset = 1;
+  for (const part of parts) {
+    data.set(part, offset);
+    offset += part.length;
+  }
+  return new Uint8Array(await window.crypto.subtle.digest('SHA-256', data));
+};
+
+/**
+ * Verify that a chunk belongs at chunkIndex of a file with totalChunks chunks,
+ * using the chunk's inclusion proof and the file's Merkle root from the manifest
+ * Leaves are SHA-256(0x00 || chunk hash) and nodes SHA-256(0x01 || left || right);
+ * a node without a sibling is promoted unchanged (RFC 6962 tree shape)
+ */
+export async function verifyChunkProof(
+  merkleRootHex: string,
+  chunkSha256Hex: string,
+  chunkIndex: number,
+  totalChunks: number,
+  proofHex: string[]
+): Promise<boolean> {
+  if (chunkIndex < 0 || chunkIndex >= totalChunks) {
+    return false;
+  }
+
+  const proof = proofHex.map(hexToBytes);
+  let hash = await merkleHash(0x00, hexToBytes(chunkSha256Hex));
+  let index = chunkIndex;
+  let size = totalChunks;
+
+  while (size > 1) {
+    if (index % 2 === 1) {
+      const sibling = proof.shift();
+      if (!sibling) return false;
+      hash = await merkleHash(0x01, sibling, hash);
+    } else if (index + 1 < size) {
+      const sibling = proof.shift();
+      if (!sibling) return false;
+      hash = await merkleHash(0x01, hash, sibling);
+    }
+    index = Math.floor(index / 2);
+    size = Math.ceil(size / 2);
+  }
+
+  const root = hexToBytes(merkleRootHex);
+  return proof.length === 0 && root.length === hash.length && root.every((b, i) => b === hash[i]);
+}
+
 /**
  * Get MIME type from file
  */